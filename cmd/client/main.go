@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"distributed-file-system/pkg/golang/config"
 	"distributed-file-system/pkg/golang/rpc"
 	"distributed-file-system/pkg/golang/service"
@@ -18,7 +19,14 @@ var serverAddr = ":8080"
 func main() {
 
 	id := flag.String("id", "1", "id of the client")
-	addr := flag.String("addr", ":8081", "address of the client")
+	addr := flag.String("addr", "", "address of a callback endpoint for servers that can not call the client back over its connection, none if empty")
+	server := flag.String("server", serverAddr, "address of the server, prefix with tcp:// to connect over tcp")
+	codec := flag.String("codec", "lab", "codec of the requests: lab, gob or json")
+	timeout := flag.Duration("timeout", 0, "time limit of each command, e.g. 5s; 0 waits forever")
+	keys := flag.String("keys", "", "yaml file holding the key shared with the server, messages are not authenticated if empty")
+	encrypt := flag.Bool("encrypt", false, "encrypt the messages with the keys given by -keys")
+	metricsAddr := flag.String("metrics", "", "address to serve the metrics on over http, e.g. :9091, disabled if empty")
+	spans := flag.String("spans", "", "file to append the spans of the commands to as json lines, disabled if empty")
 	s := flag.String("setting", "AtLeastOnceIdempotent", "")
 	flag.Parse()
 
@@ -53,14 +61,53 @@ func main() {
 		return
 	}
 
-	c := service.NewFileClient(*id, *addr, serverAddr)
+	codecTypes := map[string]rpc.Type{"lab": rpc.LabType, "gob": rpc.GobType, "json": rpc.JSONType}
+	codecType, ok := codecTypes[*codec]
+	if !ok {
+		fmt.Printf("error flag")
+		return
+	}
+
+	var key []byte
+	if *keys != "" {
+		clientKeys, err := config.LoadKeys(*keys)
+		if err != nil {
+			fmt.Printf("error loading the keys: %v\n", err)
+			return
+		}
+		if key, ok = clientKeys[*id]; !ok {
+			fmt.Printf("no key for client %s in %s\n", *id, *keys)
+			return
+		}
+	}
+
+	c := service.NewFileClientWithKey(*id, *addr, *server, key, *encrypt)
+	if err := c.SetCodec(codecType); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return
+	}
+	if *metricsAddr != "" {
+		if err := c.ServeMetrics(*metricsAddr); err != nil {
+			fmt.Printf("error serving the metrics: %v\n", err)
+			return
+		}
+	}
+	if *spans != "" {
+		if err := c.ExportSpans(*spans); err != nil {
+			fmt.Printf("error exporting the spans: %v\n", err)
+			return
+		}
+	}
 	go c.Run()
 
 	fmt.Printf("Starting file client %s...\n> ", *id)
 	scanner := bufio.NewScanner(os.Stdin)
 	var err error
 	var fd *service.FileDescriptor
+	cancel := context.CancelFunc(func() {})
+	defer func() { cancel() }()
 	for scanner.Scan() {
+		cancel() // release the context of the previous command
 		line := scanner.Text()
 		words := strings.Split(line, " ")
 		if len(words) <= 0 {
@@ -68,6 +115,10 @@ func main() {
 			continue
 		}
 		cmd := strings.TrimSpace(words[0])
+		ctx := context.Background()
+		if *timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, *timeout)
+		}
 		switch cmd {
 		case "mount": // mount path/to/source/dir/at/server path/to/target/dir/at/client filesystemtype=e.g.AFS,SNFS
 			if len(words) != 4 {
@@ -87,14 +138,16 @@ func main() {
 			} else {
 				fs = service.SunNetworkFileSystemType
 			}
-			c.Mount(srcDir, targetDir, fs)
+			if err := c.Mount(ctx, srcDir, targetDir, fs); err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+			}
 		case "open":
 			if len(words) != 2 {
 				fmt.Printf("ERROR: invalid input\n")
 				continue
 			}
 			localDir := strings.TrimSpace(words[1])
-			fd, err = c.Open(localDir)
+			fd, err = c.Open(ctx, localDir)
 			if err != nil {
 				fmt.Printf("ERROR: %v\n", err)
 				continue
@@ -106,14 +159,18 @@ func main() {
 			}
 			offset, _ := strconv.Atoi(words[1])
 			n, _ := strconv.Atoi(words[2])
-			c.ReadAt(fd, offset, n)
+			if _, err := c.ReadAt(ctx, fd, offset, n); err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+			}
 		case "read": // non idempotent read
 			if fd == nil {
 				fmt.Printf("ERROR: file not opened\n")
 				continue
 			}
 			n, _ := strconv.Atoi(words[1])
-			c.Read(fd, n)
+			if _, err := c.Read(ctx, fd, n); err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+			}
 		case "write":
 			if len(words) != 3 {
 				fmt.Printf("ERROR: invalid input\n")
@@ -125,7 +182,7 @@ func main() {
 			}
 			offset, _ := strconv.Atoi(words[1])
 			data := []byte(words[2])
-			n, err := c.Write(fd, offset, data)
+			n, err := c.Write(ctx, fd, offset, data)
 			if err != nil {
 				fmt.Printf("ERROR: %v\n", err)
 			}
@@ -6,11 +6,31 @@ import (
 	"distributed-file-system/pkg/golang/service"
 	"flag"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 var serverAddr = ":8080"
 
 func main() {
+	addr := flag.String("addr", serverAddr, "address of the server, prefix with tcp:// to serve over tcp")
+	replyLog := flag.String("replylog", "", "file to keep the reply cache in across restarts, disabled if empty")
+	keys := flag.String("keys", "", "yaml file of the keys shared with the clients, messages are not authenticated if empty")
+	encrypt := flag.Bool("encrypt", false, "encrypt the messages with the keys given by -keys")
+	rate := flag.Float64("rate", 0, "requests per second each client may send, unlimited if 0")
+	burst := flag.Int("burst", 10, "requests a client may send at once on top of -rate")
+	methodRates := make(map[string]rpc.RateLimit)
+	flag.Func("methodrate", "requests per second each client may send for a method, as <method>=<rate>:<burst>, e.g. Write=5:10; may be repeated", func(v string) error {
+		method, limit, err := parseMethodRate(v)
+		if err != nil {
+			return err
+		}
+		methodRates[method] = limit
+		return nil
+	})
+	maxConcurrent := flag.Int("maxconcurrent", 0, "requests executing at once, unlimited if 0")
+	metricsAddr := flag.String("metrics", "", "address to serve the metrics on over http, e.g. :9090, disabled if empty")
+	spans := flag.String("spans", "", "file to append the spans of the requests to as json lines, disabled if empty")
 	s := flag.String("setting", "SimpleTest", "")
 	flag.Parse()
 
@@ -43,10 +63,66 @@ func main() {
 
 	if conf, ok := settings[*s]; ok {
 		rpc.ServerSideNetworkPacketLossProbability = conf.ServerSideNetworkPacketLossProbability
-		server := service.NewFileServer(serverAddr)
+		server := service.NewFileServer(*addr)
+		if *replyLog != "" {
+			if err := server.EnableReplyLog(*replyLog); err != nil {
+				fmt.Printf("error opening the reply log: %v\n", err)
+				return
+			}
+		}
+		if *keys != "" {
+			clientKeys, err := config.LoadKeys(*keys)
+			if err != nil {
+				fmt.Printf("error loading the keys: %v\n", err)
+				return
+			}
+			keyring := rpc.NewKeyring()
+			for id, key := range clientKeys {
+				keyring.Add(id, key)
+			}
+			server.SetKeyring(keyring, *encrypt)
+		}
+		server.SetClientRateLimit(rpc.RateLimit{Rate: *rate, Burst: *burst})
+		for method, limit := range methodRates {
+			server.SetMethodRateLimit(method, limit)
+		}
+		server.SetMaxConcurrentRequests(*maxConcurrent)
+		if *metricsAddr != "" {
+			if err := server.ServeMetrics(*metricsAddr); err != nil {
+				fmt.Printf("error serving the metrics: %v\n", err)
+				return
+			}
+		}
+		if *spans != "" {
+			if err := server.ExportSpans(*spans); err != nil {
+				fmt.Printf("error exporting the spans: %v\n", err)
+				return
+			}
+		}
 		server.Run()
 	} else {
 		fmt.Printf("error flag")
 		return
 	}
 }
+
+// parseMethodRate parses <method>=<rate>:<burst>
+func parseMethodRate(v string) (string, rpc.RateLimit, error) {
+	method, limit, ok := strings.Cut(v, "=")
+	if !ok {
+		return "", rpc.RateLimit{}, fmt.Errorf("expecting <method>=<rate>:<burst>, got %q", v)
+	}
+	rate, burst, ok := strings.Cut(limit, ":")
+	if !ok {
+		return "", rpc.RateLimit{}, fmt.Errorf("expecting <method>=<rate>:<burst>, got %q", v)
+	}
+	r, err := strconv.ParseFloat(rate, 64)
+	if err != nil {
+		return "", rpc.RateLimit{}, err
+	}
+	b, err := strconv.Atoi(burst)
+	if err != nil {
+		return "", rpc.RateLimit{}, err
+	}
+	return method, rpc.RateLimit{Rate: r, Burst: b}, nil
+}
@@ -0,0 +1,25 @@
+package config
+
+import (
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadKeys reads the shared keys of the clients from a yaml file
+// mapping every client id to its key, e.g. `"1": some-secret`
+func LoadKeys(path string) (map[string][]byte, error) {
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]string
+	if err := yaml.Unmarshal(f, &entries); err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte, len(entries))
+	for id, key := range entries {
+		keys[id] = []byte(key)
+	}
+	return keys, nil
+}
@@ -1,8 +1,12 @@
 package logger
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
+
+	"distributed-file-system/pkg/golang/trace"
 )
 
 type Logger struct {
@@ -17,6 +21,16 @@ func NewLogger(path string) *Logger {
 	return &Logger{log.New(f, "", log.LstdFlags|log.Lshortfile|log.Ltime)}
 }
 
+// PrintfContext is Printf prefixed with the trace and span ids carried by ctx,
+// so that the lines of one user action can be found in the logs of every process
+func (l *Logger) PrintfContext(ctx context.Context, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if sc, ok := trace.FromContext(ctx); ok {
+		msg = fmt.Sprintf("[%s] %s", sc, msg)
+	}
+	l.Output(2, msg)
+}
+
 func openLogFile(path string) (*os.File, error) {
 	logFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
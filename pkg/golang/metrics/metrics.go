@@ -0,0 +1,294 @@
+// Package metrics keeps counters, gauges and histograms and serves them
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the latency histograms, in seconds
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds the metrics of a process, or of a single server or client
+// when several of them live in the same process
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+	names    map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+type family interface {
+	write(w io.Writer)
+}
+
+func (r *Registry) register(name string, f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s is registered twice", name))
+	}
+	r.names[name] = true
+	r.families = append(r.families, f)
+}
+
+// WriteText writes every metric in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) {
+	r.mu.Lock()
+	families := append([]family(nil), r.families...)
+	r.mu.Unlock()
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteText(w)
+}
+
+// Serve listens on addr and serves the metrics at /metrics in the background
+func (r *Registry) Serve(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	go http.Serve(l, mux)
+	return l, nil
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.ReplaceAll(d.help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+func (d *desc) checkLabels(values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+}
+
+// formatLabels renders {name="value",...}, extra being appended as is
+func formatLabels(names, values []string, extra string) string {
+	var parts []string
+	for i, name := range names {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, v))
+	}
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+const labelSeparator = "\xff"
+
+// values is a set of series of one metric, by label values
+type values struct {
+	desc
+	mu     sync.Mutex
+	series map[string]float64
+}
+
+func (v *values) add(delta float64, labelValues []string) {
+	v.checkLabels(labelValues)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.series[strings.Join(labelValues, labelSeparator)] += delta
+}
+
+func (v *values) set(value float64, labelValues []string) {
+	v.checkLabels(labelValues)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.series[strings.Join(labelValues, labelSeparator)] = value
+}
+
+func (v *values) write(w io.Writer) {
+	v.writeHeader(w)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, splitKey(k, len(v.labels)), ""), formatValue(v.series[k]))
+	}
+}
+
+func splitKey(key string, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	return strings.Split(key, labelSeparator)
+}
+
+// Counter is a value that only goes up, e.g. the number of requests
+type Counter struct{ values }
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{values{desc: desc{name, help, "counter", labels}, series: make(map[string]float64)}}
+	r.register(name, c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) { c.add(1, labelValues) }
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("metrics: counter %s can not decrease", c.name))
+	}
+	c.add(delta, labelValues)
+}
+
+// Gauge is a value that goes up and down, e.g. the number of pending calls
+type Gauge struct{ values }
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{values{desc: desc{name, help, "gauge", labels}, series: make(map[string]float64)}}
+	r.register(name, g)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) { g.set(value, labelValues) }
+
+func (g *Gauge) Add(delta float64, labelValues ...string) { g.add(delta, labelValues) }
+
+// Histogram counts observations, e.g. latencies, in buckets
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: append([]float64(nil), buckets...),
+		series:  make(map[string]*histogramSeries),
+	}
+	sort.Float64s(h.buckets)
+	r.register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.checkLabels(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, labelSeparator)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.writeHeader(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s, labelValues := h.series[k], splitKey(k, len(h.labels))
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, labelValues, fmt.Sprintf(`le="%s"`, formatValue(bound))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, labelValues, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, labelValues, ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, labelValues, ""), s.count)
+	}
+}
+
+// Sample is a value collected when the metrics are written
+type Sample struct {
+	Value       float64
+	LabelValues []string
+}
+
+// collected is a metric whose values are read from elsewhere when the metrics are written
+type collected struct {
+	desc
+	collect func() []Sample
+}
+
+func (c *collected) write(w io.Writer) {
+	c.writeHeader(w)
+	samples := c.collect()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].LabelValues, labelSeparator) < strings.Join(samples[j].LabelValues, labelSeparator)
+	})
+	for _, s := range samples {
+		c.checkLabels(s.LabelValues)
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.LabelValues, ""), formatValue(s.Value))
+	}
+}
+
+// NewCounterFunc exposes a counter kept elsewhere, fn is called whenever the metrics are written
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(name, &collected{desc{name, help, "counter", nil}, func() []Sample { return []Sample{{Value: fn()}} }})
+}
+
+// NewGaugeFunc exposes a gauge kept elsewhere, fn is called whenever the metrics are written
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &collected{desc{name, help, "gauge", nil}, func() []Sample { return []Sample{{Value: fn()}} }})
+}
+
+// NewCollector exposes a labelled metric of type typ ("counter" or "gauge") kept elsewhere,
+// collect is called whenever the metrics are written
+func (r *Registry) NewCollector(name, help, typ string, labels []string, collect func() []Sample) {
+	r.register(name, &collected{desc{name, help, typ, labels}, collect})
+}
@@ -0,0 +1,286 @@
+package rpc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"distributed-file-system/pkg/golang/logger"
+)
+
+// default setting
+var (
+	AuthWindow time.Duration = 30 * time.Second // how far the timestamp of a message may be from the local clock
+)
+
+// errors returned when authenticating messages
+var (
+	ErrUnknownKey   = errors.New("rpc auth: unknown key")
+	ErrBadMAC       = errors.New("rpc auth: message authentication code mismatch")
+	ErrDecrypt      = errors.New("rpc auth: message can not be decrypted")
+	ErrStale        = errors.New("rpc auth: message timestamp is outside of the window")
+	ErrReplayed     = errors.New("rpc auth: message has been received before")
+	ErrNoIdentity   = errors.New("rpc auth: no key to sign the message with")
+	errShortMessage = errors.New("rpc auth: message is too short")
+)
+
+// Keyring holds the shared secrets of the peers, by key id.
+// A server holds the key of every client, a client only its own.
+type Keyring struct {
+	mu   sync.RWMutex
+	keys map[string][]byte // key: key id, usually the client id
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string][]byte)}
+}
+
+func (k *Keyring) Add(id string, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = append([]byte(nil), key...)
+}
+
+func (k *Keyring) Remove(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, id)
+}
+
+func (k *Keyring) key(id string) ([]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// AuthAddr is the address of a peer whose message has been authenticated with the key KeyId.
+// The replies written to it are signed with the same key.
+type AuthAddr struct {
+	net.Addr
+	KeyId string
+}
+
+// authTransport signs every message it writes and drops every message it reads
+// that is not signed with a key of its keyring, is too old or has been seen before.
+// A message is [key id length][key id][timestamp][nonce][payload][HMAC-SHA256 of all the preceding bytes].
+// When encrypting, the payload and the HMAC are replaced by [AES-GCM nonce][sealed payload],
+// the preceding bytes being authenticated as additional data.
+type authTransport struct {
+	Transport
+	keyring *Keyring
+	keyId   string // key the messages to peers that have not been heard from are signed with
+	encrypt bool
+	mu      sync.Mutex
+	seen    map[string]time.Time // key: "<key id>-<nonce>", value: expiry
+	pruned  time.Time
+	logger  *logger.Logger
+}
+
+// NewAuthTransport authenticates the messages of the transport with the keys of the keyring.
+// keyId is the identity the messages are signed with unless they reply to an authenticated peer,
+// it may be empty for a transport that only serves requests.
+func NewAuthTransport(t Transport, keyring *Keyring, keyId string, logger *logger.Logger) Transport {
+	return &authTransport{
+		Transport: t,
+		keyring:   keyring,
+		keyId:     keyId,
+		seen:      make(map[string]time.Time),
+		logger:    logger,
+	}
+}
+
+// NewSecureTransport is like NewAuthTransport, but also encrypts the messages
+// with a key derived from the shared key, so that file contents do not cross the network in plaintext
+func NewSecureTransport(t Transport, keyring *Keyring, keyId string, logger *logger.Logger) Transport {
+	a := NewAuthTransport(t, keyring, keyId, logger).(*authTransport)
+	a.encrypt = true
+	return a
+}
+
+// newAEAD derives the encryption key from the shared key, so that
+// the same secret is never used both for HMAC and for encryption
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	derived := sha256.Sum256(append([]byte("rpc encryption key:"), key...))
+	block, err := aes.NewCipher(derived[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var rejectedMessages atomic.Uint64
+
+// RejectedMessages returns the number of messages dropped so far because they failed authentication
+func RejectedMessages() uint64 {
+	return rejectedMessages.Load()
+}
+
+func (t *authTransport) ReadMessage() ([]byte, net.Addr, error) {
+	for {
+		data, addr, err := t.Transport.ReadMessage()
+		if err != nil {
+			return nil, nil, err
+		}
+		payload, keyId, err := t.open(data)
+		if err != nil {
+			rejectedMessages.Add(1)
+			t.logger.Printf("[ERROR] rpc auth: dropping message from %s: %v", addr, err)
+			continue
+		}
+		return payload, &AuthAddr{Addr: addr, KeyId: keyId}, nil
+	}
+}
+
+func (t *authTransport) WriteMessage(data []byte, addr net.Addr) error {
+	keyId := t.keyId
+	if a, ok := addr.(*AuthAddr); ok {
+		keyId = a.KeyId
+		addr = a.Addr
+	}
+	if keyId == "" {
+		return ErrNoIdentity
+	}
+	key, ok := t.keyring.key(keyId)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownKey, keyId)
+	}
+	var buf bytes.Buffer
+	encodeString(&buf, keyId)
+	buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano())))
+	nonce := make([]byte, 8)
+	if _, err := crand.Read(nonce); err != nil {
+		return err
+	}
+	buf.Write(nonce)
+	if t.encrypt {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return err
+		}
+		sealNonce := make([]byte, aead.NonceSize())
+		if _, err := crand.Read(sealNonce); err != nil {
+			return err
+		}
+		header := buf.Bytes()
+		return t.Transport.WriteMessage(aead.Seal(append(header, sealNonce...), sealNonce, data, header), addr)
+	}
+	buf.Write(data)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf.Bytes())
+	buf.Write(mac.Sum(nil))
+	return t.Transport.WriteMessage(buf.Bytes(), addr)
+}
+
+// open authenticates the message and returns its payload and the id of the key it is signed with
+func (t *authTransport) open(data []byte) ([]byte, string, error) {
+	r := newLabReader(data)
+	keyId, err := r.chunk()
+	if err != nil {
+		return nil, "", err
+	}
+	timestamp, err := r.uint64()
+	if err != nil {
+		return nil, "", err
+	}
+	nonce, err := r.uint64()
+	if err != nil {
+		return nil, "", err
+	}
+	key, ok := t.keyring.key(string(keyId))
+	if !ok {
+		return nil, "", ErrUnknownKey
+	}
+	payload, err := t.verify(data, r.off, key)
+	if err != nil {
+		return nil, "", err
+	}
+	sent := time.Unix(0, int64(timestamp))
+	if d := time.Since(sent); d > AuthWindow || d < -AuthWindow {
+		return nil, "", ErrStale
+	}
+	if err := t.remember(fmt.Sprintf("%s-%x", keyId, nonce)); err != nil {
+		return nil, "", err
+	}
+	return payload, string(keyId), nil
+}
+
+// verify checks the HMAC of the message, or decrypts it, and returns the payload following the header
+func (t *authTransport) verify(data []byte, headerSize int, key []byte) ([]byte, error) {
+	header := data[:headerSize]
+	if t.encrypt {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(data)-headerSize < aead.NonceSize()+aead.Overhead() {
+			return nil, errShortMessage
+		}
+		sealNonce := data[headerSize : headerSize+aead.NonceSize()]
+		payload, err := aead.Open(nil, sealNonce, data[headerSize+aead.NonceSize():], header)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		return payload, nil
+	}
+	if len(data)-headerSize < sha256.Size {
+		return nil, errShortMessage
+	}
+	signed, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), sum) {
+		return nil, ErrBadMAC
+	}
+	return signed[headerSize:], nil
+}
+
+// remember records the nonce of a message, long enough for its timestamp to go out of the window
+func (t *authTransport) remember(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Sub(t.pruned) > AuthWindow {
+		for id, expiry := range t.seen {
+			if now.After(expiry) {
+				delete(t.seen, id)
+			}
+		}
+		t.pruned = now
+	}
+	if _, ok := t.seen[id]; ok {
+		return ErrReplayed
+	}
+	t.seen[id] = now.Add(2 * AuthWindow)
+	return nil
+}
+
+// DialWithKey connects to the server like Dial and signs the requests with the key of id
+func DialWithKey(addr, id string, key []byte, logger *logger.Logger) (*Client, error) {
+	return dialWithKey(addr, id, key, NewAuthTransport, logger)
+}
+
+// DialSecure connects to the server like Dial and signs and encrypts the requests with the key of id
+func DialSecure(addr, id string, key []byte, logger *logger.Logger) (*Client, error) {
+	return dialWithKey(addr, id, key, NewSecureTransport, logger)
+}
+
+func dialWithKey(addr, id string, key []byte, wrap func(Transport, *Keyring, string, *logger.Logger) Transport, logger *logger.Logger) (*Client, error) {
+	transport, remote, err := DialTransport(addr, logger)
+	if err != nil {
+		return nil, err
+	}
+	keyring := NewKeyring()
+	keyring.Add(id, key)
+	return NewClient(wrap(transport, keyring, id, logger), remote, logger), nil
+}
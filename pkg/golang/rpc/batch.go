@@ -0,0 +1,292 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// default setting
+var (
+	MaxBatchSize int = MaxBufferSize - 1024 // size of a batch message, leaving room in the datagram for the fragment header and the authentication envelope
+)
+
+// servers of this protocol version onwards serve batches
+const batchVersion uint16 = 6
+
+const batchMethod = "Server.Batch"
+
+// BatchRequest is the body of a batch message, every request is a whole encoded frame
+// with its own header, so that it is served as if it had been sent on its own
+type BatchRequest struct {
+	Requests [][]byte
+}
+
+// BatchResponse is the body of a message carrying the responses to the requests of a batch
+type BatchResponse struct {
+	Responses [][]byte
+}
+
+func init() {
+	RegisterType(BatchRequest{})
+	RegisterType(BatchResponse{})
+}
+
+// batchRequest returns the body of a batch message, whichever way the codec decoded it
+func batchRequest(body interface{}) (*BatchRequest, bool) {
+	switch b := body.(type) {
+	case *BatchRequest:
+		return b, true
+	case BatchRequest:
+		return &b, true
+	}
+	return nil, false
+}
+
+// batchResponse returns the body of a batch response, whichever way the codec decoded it
+func batchResponse(body interface{}) (*BatchResponse, bool) {
+	switch b := body.(type) {
+	case *BatchResponse:
+		return b, true
+	case BatchResponse:
+		return &b, true
+	}
+	return nil, false
+}
+
+// batchFrameOverhead is what a frame adds to the batch message besides itself, i.e. its length prefix
+const batchFrameOverhead = 4
+
+// batchMessage is an encoded batch message carrying the frames [start, end) of a batch
+type batchMessage struct {
+	data       []byte
+	start, end int
+}
+
+// packBatches groups the frames into messages of at most MaxBatchSize bytes, in order.
+// A frame too large to share a message goes alone. encode builds the message of a group of frames.
+func packBatches(frames [][]byte, encode func(frames [][]byte) ([]byte, error)) ([]batchMessage, error) {
+	var messages []batchMessage
+	var pack func(start, end int) error
+	pack = func(start, end int) error {
+		data, err := encode(frames[start:end])
+		if err != nil {
+			return err
+		}
+		if len(data) > MaxBatchSize && end-start > 1 {
+			// the frames grew more than estimated, e.g. json writes bytes as base64, so split the group in two
+			mid := (start + end) / 2
+			if err := pack(start, mid); err != nil {
+				return err
+			}
+			return pack(mid, end)
+		}
+		messages = append(messages, batchMessage{data: data, start: start, end: end})
+		return nil
+	}
+	start, size := 0, 0
+	for i, frame := range frames {
+		if i > start && size+len(frame)+batchFrameOverhead > MaxBatchSize {
+			if err := pack(start, i); err != nil {
+				return nil, err
+			}
+			start, size = i, 0
+		}
+		size += len(frame) + batchFrameOverhead
+	}
+	if start < len(frames) {
+		if err := pack(start, len(frames)); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+// Batch is a set of calls sent to the server together, packed in as few messages as fit in a datagram,
+// so that they cost a single round trip. Each call completes on its own with its reply or its error,
+// and a call whose request or response is lost or throttled is retransmitted alone.
+// Servers that predate batches get the requests one by one.
+type Batch struct {
+	client *Client
+	ctx    context.Context
+	calls  []*Call
+}
+
+// NewBatch starts a batch of calls, which all are spans of the trace carried by ctx.
+// If ctx is canceled or its deadline passes, the calls still waiting for their reply complete with ctx.Err().
+func (client *Client) NewBatch(ctx context.Context) *Batch {
+	return &Batch{client: client, ctx: ctx}
+}
+
+// Add adds a call to the batch, it is sent by Do
+func (b *Batch) Add(serviceMethod string, args, reply interface{}) *Call {
+	call := b.client.newCall(b.ctx, serviceMethod, args, reply, make(chan *Call, 1))
+	b.calls = append(b.calls, call)
+	return call
+}
+
+// Do sends the calls of the batch and waits for all of them to complete.
+// The outcome of each call is in its Reply and Error.
+func (b *Batch) Do() {
+	client := b.client
+	client.mu.Lock()
+	interceptors := client.interceptors
+	client.mu.Unlock()
+	if len(interceptors) > 0 {
+		b.intercept(interceptors)
+	} else {
+		client.startBatch(b.ctx, b.calls)
+	}
+	for _, call := range b.calls {
+		<-call.finished
+	}
+}
+
+// intercept runs every call of the batch through the interceptor chain of the client. The requests
+// the chains send are held back until every chain has either sent its request or completed, and then
+// sent together. A chain sending more than one request, e.g. to retry, sends the following ones alone.
+func (b *Batch) intercept(interceptors []ClientInterceptor) {
+	client := b.client
+	var mu sync.Mutex
+	var requests []*Call
+	waiting := len(b.calls)
+	// ready is called once by every chain, with the first request it sends or nil if it sends none
+	ready := func(request *Call) {
+		mu.Lock()
+		if request != nil {
+			requests = append(requests, request)
+		}
+		waiting--
+		last := waiting == 0
+		mu.Unlock()
+		if last {
+			client.startBatch(b.ctx, requests)
+		}
+	}
+	for _, call := range b.calls {
+		var once sync.Once
+		invoker := func(ctx context.Context, h *Header, args, reply interface{}) error {
+			inner := newInnerCall(ctx, h, args, reply)
+			first := false
+			once.Do(func() {
+				first = true
+				ready(inner)
+			})
+			if !first {
+				client.start(ctx, inner)
+			}
+			return (<-inner.Done).Error
+		}
+		go func(call *Call) {
+			h := call.header
+			call.Error = chainClient(interceptors, invoker)(call.ctx, &h, call.Args, call.Reply)
+			once.Do(func() { ready(nil) })
+			call.done()
+		}(call)
+	}
+}
+
+// startBatch registers the calls and sends their requests together once the handshake is over.
+// Each call is abandoned once its own ctx is done, which an interceptor may have narrowed down
+// from the ctx of the batch; the handshake is waited for until the ctx of the batch is done.
+func (client *Client) startBatch(ctx context.Context, calls []*Call) {
+	var registered []*Call
+	for _, call := range calls {
+		if client.register(call.ctx, call) {
+			registered = append(registered, call)
+		}
+	}
+	if len(registered) == 0 {
+		return
+	}
+	select {
+	case <-client.ready:
+	case <-ctx.Done():
+		return // the calls are abandoned by watch
+	}
+	if client.version.Load() < uint32(batchVersion) || len(registered) == 1 {
+		for _, call := range registered {
+			client.send(call.Seq, call)
+		}
+		return
+	}
+	client.sendBatch(registered)
+}
+
+// sendBatch sends the requests of the calls packed in batch messages
+func (client *Client) sendBatch(calls []*Call) {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+
+	var frames [][]byte
+	var sent []*Call
+	for _, call := range calls {
+		if data, ok := client.encodeRequest(call.Seq, call); ok {
+			frames = append(frames, data)
+			sent = append(sent, call)
+		}
+	}
+	messages, err := packBatches(frames, func(frames [][]byte) ([]byte, error) {
+		h := Header{ServiceMethod: batchMethod, Version: uint16(client.version.Load()), Session: client.session}
+		return EncodeFrame(client.codec, &h, &BatchRequest{Requests: frames})
+	})
+	if err != nil {
+		for _, call := range sent {
+			client.fail(call.Seq, err)
+		}
+		return
+	}
+	for _, m := range messages {
+		// simulate packet loss
+		if !simulated(client.transport) && lost(ClientSideNetworkPacketLossProbability) {
+			client.logger.Printf("[INFO] rpc client: batch of %d requests is sent but lost.", m.end-m.start)
+			client.metrics.Load().drop("simulated_loss")
+			continue
+		}
+		if err := client.transport.WriteMessage(m.data, client.remote); err != nil {
+			for _, call := range sent[m.start:m.end] {
+				client.fail(call.Seq, err)
+			}
+		}
+	}
+}
+
+// batchCollector stands in for the transport while the requests of a batch are served, it keeps their responses
+type batchCollector struct {
+	Transport
+	mu        sync.Mutex
+	responses [][]byte
+}
+
+func (c *batchCollector) WriteMessage(data []byte, addr net.Addr) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.responses = append(c.responses, data)
+	return nil
+}
+
+// serveBatch serves the requests of a batch in order, each one as if it had been sent on its own,
+// and sends their responses back packed in as few batch responses as fit in a datagram
+func (server *Server) serveBatch(transport Transport, addr net.Addr, req *request) {
+	if _, nested := transport.(*batchCollector); nested {
+		server.logger.Printf("[ERROR] rpc server: dropping a batch nested in a batch from %s", addr)
+		server.metrics.Load().drop("nested_batch")
+		return
+	}
+	server.logger.Printf("[INFO] rpc server: serving a batch of %d requests from %s", len(req.batch.Requests), addr)
+	collector := &batchCollector{Transport: transport}
+	for _, data := range req.batch.Requests {
+		server.ServeConn(collector, addr, data)
+	}
+	req.h.Response = true
+	messages, err := packBatches(collector.responses, func(frames [][]byte) ([]byte, error) {
+		return EncodeFrame(req.codec, req.h, &BatchResponse{Responses: frames})
+	})
+	if err != nil {
+		server.logger.Printf("[ERROR] rpc server: encode batch response error: %v", err)
+		return
+	}
+	for _, m := range messages {
+		server.writeResponse(transport, addr, req.h, m.data)
+	}
+}
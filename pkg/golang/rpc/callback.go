@@ -0,0 +1,259 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// default setting
+var (
+	PeerIdleTimeout time.Duration = 10 * time.Minute // clients calling back a peer that neither sends requests nor is called this long are closed
+)
+
+// clients and servers of this protocol version onwards mark their responses,
+// so that requests can go both ways over the connection of a client
+const callbackVersion uint16 = 8
+
+var ErrNoPeer = errors.New("rpc: no peer to call back, the context does not come from a served request")
+
+type peerContextKey struct{}
+
+// peer is where a request comes from, and the transport to call its client back over
+type peer struct {
+	server    *Server
+	transport Transport
+	addr      net.Addr
+	version   uint16    // protocol version of the request
+	session   uint64    // session of the client, 0 if it does not send one
+	seen      time.Time // when the request was received
+}
+
+// withPeer records in ctx where the request comes from, so that the method can call the client back with Peer
+func (server *Server) withPeer(ctx context.Context, transport Transport, addr net.Addr, h *Header) context.Context {
+	if c, ok := transport.(*batchCollector); ok {
+		transport = c.Transport // calls go over the transport the batch came from
+	}
+	if v, ok := server.peers.Load(peerKey{transport: transport, addr: addr.String()}); ok {
+		v.(*Client).transport.(*peerTransport).touch() // the peer is still around
+	}
+	p := &peer{server: server, transport: transport, addr: addr, version: h.Version, session: h.Session, seen: time.Now()}
+	if h.Session != 0 && h.Version >= callbackVersion {
+		// a client reconnecting over a stream comes from another address, its references follow it there
+		server.rebound.Store(h.Session, p)
+	}
+	return context.WithValue(ctx, peerContextKey{}, p)
+}
+
+// Peer returns a client calling back the client that sent the request served with ctx. The calls go over
+// the connection of the request, the way its response does, so they reach clients behind NAT or firewalls
+// that only let in the responses to their own requests. The client must speak protocol version 8 and
+// serve the calls with Client.Serve. Every request of the same peer gets the same client, which lives
+// until it is closed, the peer restarts, the peer neither sends requests nor is called for PeerIdleTimeout,
+// or the server is shut down; the requests the peer sends afterwards get a new client.
+// To call the peer back long after the request, keep its PeerRef instead.
+func Peer(ctx context.Context) (*Client, error) {
+	ref, err := PeerOf(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p := ref.p
+	return p.server.peerClient(p.transport, p.addr, p.version, p.session), nil
+}
+
+// PeerRef refers to the client that sent a request, so that it can be called back over its connection
+// for as long as it is around, whether or not the client calling it back has been closed in the meantime
+type PeerRef struct {
+	p *peer
+}
+
+// PeerOf returns the reference to the client that sent the request served with ctx, see Peer
+func PeerOf(ctx context.Context) (*PeerRef, error) {
+	p, ok := ctx.Value(peerContextKey{}).(*peer)
+	if !ok {
+		return nil, ErrNoPeer
+	}
+	if p.version < callbackVersion {
+		return nil, fmt.Errorf("rpc: peer %s speaks protocol version %d, calling it back needs version %d", p.addr, p.version, callbackVersion)
+	}
+	return &PeerRef{p: p}, nil
+}
+
+// Client returns the client calling back the peer, a new one if the previous one has been closed,
+// e.g. because the peer was idle. The calls go over the connection the peer last sent a request over,
+// which is another one once the peer has reconnected. It fails with ErrShutdown once the server is shut down.
+func (ref *PeerRef) Client() (*Client, error) {
+	p := ref.p
+	if p.session != 0 {
+		if v, ok := p.server.rebound.Load(p.session); ok {
+			p = v.(*peer)
+		}
+	}
+	select {
+	case <-p.server.close:
+		return nil, ErrShutdown
+	default:
+	}
+	key := peerKey{transport: p.transport, addr: p.addr.String()}
+	if v, ok := p.server.peers.Load(key); ok {
+		// the peer may have restarted since, its current session is called back then
+		return v.(*Client), nil
+	}
+	return p.server.newPeerClient(key, p.transport, p.addr, p.version, p.session), nil
+}
+
+type peerKey struct {
+	transport Transport
+	addr      string
+}
+
+// peerClient returns the client calling back the peer at addr over the transport, creating it on first use,
+// or once the peer has restarted with another session, since the calls of the previous one are left unanswered
+func (server *Server) peerClient(transport Transport, addr net.Addr, version uint16, session uint64) *Client {
+	key := peerKey{transport: transport, addr: addr.String()}
+	if v, ok := server.peers.Load(key); ok {
+		client := v.(*Client)
+		t := client.transport.(*peerTransport)
+		if session == 0 || t.session == session {
+			client.version.Store(uint32(version)) // the peer may have been restarted with another version
+			return client
+		}
+		server.logger.Printf("[INFO] rpc server: peer %s restarted, closing the client calling back its session %x", addr, t.session)
+		client.Close()
+	}
+	return server.newPeerClient(key, transport, addr, version, session)
+}
+
+// newPeerClient creates the client calling back the peer, unless another one has been created in the meantime
+func (server *Server) newPeerClient(key peerKey, transport Transport, addr net.Addr, version uint16, session uint64) *Client {
+	t := &peerTransport{
+		Transport: transport,
+		addr:      addr,
+		session:   session,
+		incoming:  make(chan []byte, ServerQueueSize),
+		closed:    make(chan struct{}),
+	}
+	client := newClient(t, addr, server.logger)
+	client.exporter = server.spanExporter()
+	// the version is known from the requests of the peer, so there is no handshake
+	client.version.Store(uint32(version))
+	close(client.ready)
+	t.remove = func() { server.peers.CompareAndDelete(key, client) }
+	t.touch()
+	if v, loaded := server.peers.LoadOrStore(key, client); loaded {
+		return v.(*Client)
+	}
+	server.logger.Printf("[INFO] rpc server: calling back %s over its connection, speaking protocol version %d", addr, version)
+	go client.receive()
+	return client
+}
+
+// evictIdlePeers closes the clients of the peers that have neither sent a request nor been called for PeerIdleTimeout
+func (server *Server) evictIdlePeers() {
+	server.peers.Range(func(key, value interface{}) bool {
+		if idle := value.(*Client).transport.(*peerTransport).idle(); idle > PeerIdleTimeout {
+			server.logger.Printf("[INFO] rpc server: peer %s idle for %v, closing the client calling it back", key.(peerKey).addr, idle)
+			value.(*Client).Close()
+		}
+		return true
+	})
+	server.rebound.Range(func(key, value interface{}) bool {
+		if time.Since(value.(*peer).seen) > PeerIdleTimeout {
+			server.rebound.CompareAndDelete(key, value)
+		}
+		return true
+	})
+}
+
+// serveResponse hands the response of a peer over to the client that called it back
+func (server *Server) serveResponse(transport Transport, addr net.Addr, data []byte) {
+	v, ok := server.peers.Load(peerKey{transport: transport, addr: addr.String()})
+	if !ok {
+		server.logger.Printf("[ERROR] rpc server: dropping a response from %s, which is not called back", addr)
+		server.metrics.Load().drop("unexpected_response")
+		return
+	}
+	v.(*Client).transport.(*peerTransport).push(data)
+}
+
+// peerTransport carries the calls of a server to a peer over the transport the server serves the peer on.
+// The server reads the responses of the peer and pushes them, closing the peerTransport leaves the transport
+// of the server open.
+type peerTransport struct {
+	Transport
+	addr     net.Addr
+	session  uint64 // session of the peer the client calls back
+	incoming chan []byte
+	closed   chan struct{}
+	once     sync.Once
+	remove   func()       // forgets the client of the peer
+	lastUsed atomic.Int64 // unix nanoseconds of the last request, call or response of the peer
+}
+
+func (t *peerTransport) touch() {
+	t.lastUsed.Store(time.Now().UnixNano())
+}
+
+// idle returns the time since the peer last sent a request or a response, or was called
+func (t *peerTransport) idle() time.Duration {
+	return time.Since(time.Unix(0, t.lastUsed.Load()))
+}
+
+func (t *peerTransport) push(data []byte) {
+	t.touch()
+	select {
+	case <-t.closed:
+	case t.incoming <- data:
+	default:
+		// the queue is full, the response is dropped like a lost one
+	}
+}
+
+func (t *peerTransport) WriteMessage(data []byte, addr net.Addr) error {
+	t.touch()
+	return t.Transport.WriteMessage(data, addr)
+}
+
+func (t *peerTransport) ReadMessage() ([]byte, net.Addr, error) {
+	select {
+	case data := <-t.incoming:
+		return data, t.addr, nil
+	case <-t.closed:
+		return nil, nil, net.ErrClosed
+	}
+}
+
+func (t *peerTransport) Close() error {
+	t.once.Do(func() {
+		close(t.closed)
+		t.remove()
+	})
+	return nil
+}
+
+// Serve serves the requests the server sends over the connection of the client with the methods registered
+// in callbacks, so that the server can call the client without the client listening on an address of its own.
+// The responses go back over the connection.
+func (client *Client) Serve(callbacks *Server) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.callbacks = callbacks
+}
+
+// serveRequest serves a request the server sends over the connection. It runs in the background,
+// since the method may call the server and wait for a response the client has yet to read.
+func (client *Client) serveRequest(addr net.Addr, h *Header, data []byte) {
+	client.mu.Lock()
+	callbacks := client.callbacks
+	client.mu.Unlock()
+	if callbacks == nil {
+		client.logger.Printf("[ERROR] rpc client: dropping request %s from %s, the client serves no requests", h.ServiceMethod, addr)
+		client.metrics.Load().drop("unexpected_request")
+		return
+	}
+	go callbacks.ServeConn(client.transport, addr, data)
+}
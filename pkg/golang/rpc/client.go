@@ -1,10 +1,14 @@
 package rpc
 
 import (
+	"context"
 	"distributed-file-system/pkg/golang/logger"
+	"distributed-file-system/pkg/golang/trace"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -21,17 +25,37 @@ var (
 // Call represents an active RPC.
 type Call struct {
 	Attempts         atomic.Uint64 // count number of attempts made
-	LastTryTimestamp time.Time     // timestamp for last retry attempt
+	LastTryTimestamp time.Time     // timestamp for last retry attempt, guarded by mu
 	Seq              uint64
-	ServiceMethod    string      // format "<service>.<method>"
-	Args             interface{} // arguments to the function
-	Reply            interface{} // reply from the function
-	Error            error       // if error occurs, it will be set
-	Done             chan *Call  // Strobes when call is complete.
+	ServiceMethod    string        // format "<service>.<method>"
+	Args             interface{}   // arguments to the function
+	Reply            interface{}   // reply from the function
+	Error            error         // if error occurs, it will be set
+	Done             chan *Call    // Strobes when call is complete.
+	finished         chan struct{} // closed when call is complete
+	once             sync.Once
+	header           Header          // template of the request header
+	ctx              context.Context // carries the span of the call
+	span             *trace.Span     // nil for the calls made on behalf of an interceptor chain
+	exporter         trace.Exporter
+	policy           RetryPolicy // retry policy in effect for this call
+	mu               sync.Mutex  // protect following
+	timer            *time.Timer // fires the next retransmission
 }
 
 func (call *Call) done() {
-	call.Done <- call
+	call.once.Do(func() {
+		call.mu.Lock()
+		if call.timer != nil {
+			call.timer.Stop()
+		}
+		call.mu.Unlock()
+		if call.span != nil {
+			call.span.End(call.exporter, call.Error)
+		}
+		close(call.finished)
+		call.Done <- call
+	})
 }
 
 // Client represents an RPC client stub
@@ -39,15 +63,27 @@ func (call *Call) done() {
 // with a single Client, and a Client may be used by
 // multiple goroutines simultaneously.
 type Client struct {
-	conn     *net.UDPConn
-	cc       Codec
-	sending  sync.Mutex // guard for sending the message
-	mu       sync.Mutex // protect following pending queue
-	seq      uint64     // latest sequence number for a new message, initialize with 1
-	pending  sync.Map   // pending queue to store the messages
-	logger   *logger.Logger
-	closing  bool // user has called Close
-	shutdown bool
+	transport Transport
+	remote    net.Addr      // address of the server
+	codec     Type          // codec the requests are encoded with
+	sending   sync.Mutex    // guard for sending the message
+	mu        sync.Mutex    // protect following pending queue
+	seq       uint64        // latest sequence number for a new message, initialize with 1
+	pending   sync.Map      // pending queue to store the messages
+	version   atomic.Uint32 // negotiated protocol version
+	ready     chan struct{} // closed once the protocol version is settled
+	session   uint64        // incarnation of this client, lets the server tell it apart from earlier clients on the same address
+	rtt       *rttEstimator // round trip time estimate of the server
+	callbacks *Server       // serves the requests the server sends over the connection, nil unless set
+	logger    *logger.Logger
+
+	interceptors        []ClientInterceptor
+	exporter            trace.Exporter                // exports the spans of the calls, nil unless set
+	metrics             atomic.Pointer[clientMetrics] // nil unless instrumented
+	retryPolicy         RetryPolicy                   // retry policy of every method without one of its own
+	methodRetryPolicies map[string]RetryPolicy        // key: "<service>.<method>"
+	closing             bool                          // user has called Close
+	shutdown            bool
 }
 
 var _ io.Closer = (*Client)(nil)
@@ -62,7 +98,7 @@ func (client *Client) Close() error {
 		return ErrShutdown
 	}
 	client.closing = true
-	return client.conn.Close()
+	return client.transport.Close()
 }
 
 func (client *Client) registerCall(call *Call) (uint64, error) {
@@ -94,6 +130,7 @@ func (client *Client) terminateCalls(err error) {
 	defer client.mu.Unlock()
 	client.shutdown = true
 	client.pending.Range(func(key, value interface{}) bool {
+		client.pending.Delete(key)
 		call := value.(*Call)
 		call.Error = err
 		call.done()
@@ -101,90 +138,136 @@ func (client *Client) terminateCalls(err error) {
 	})
 }
 
-func (client *Client) retry() {
+func (client *Client) receive() {
 	for {
-		client.pending.Range(func(key, value interface{}) bool {
-			call := value.(*Call)
-			if call.Attempts.Load() >= RetryLimit {
-				client.terminateCalls(fmt.Errorf("rpc client packet %d lost due to poor internet connection", call.Seq))
-				return true
-			}
-			if time.Since(call.LastTryTimestamp) >= Timeout {
-				// try again
-				client.send(call.Seq, call)
+		data, addr, err := client.transport.ReadMessage()
+		if err != nil {
+			if client.isClosing() {
+				break
 			}
-			return true
-		})
+			client.logger.Printf("[ERROR] rpc client: error reading from %s: %v", client.remote, err)
+			continue
+		}
+		client.handleResponse(data, addr, false)
 	}
-
+	// the transport is closed, so terminate pending calls
+	client.terminateCalls(ErrShutdown)
 }
 
-func (client *Client) receive() {
-	var err error
-	for err == nil {
-		buf := make([]byte, MaxBufferSize)
-		n, _, err := client.conn.ReadFromUDP(buf)
-		if err != nil {
-			client.logger.Printf("[ERROR] rpc client: error reading from UDP: %v", err)
-			continue
-		}
-		var m Message
-		err = client.cc.Decode(buf[:n], &m)
-		if err != nil {
-			client.logger.Printf("[ERROR] rpc client: error decode the message: %v", err)
-		}
-		// log.Printf("rpc client response for packet seq %d is received.\n", m.Header.Seq)
-		h := m.Header
-		call := client.removeCall(h.Seq)
-		switch {
-		case call == nil:
-			// it usually means that Write partially failed
-			// and call was already removed.
-		case h.Error != "":
-			call.Error = fmt.Errorf(h.Error)
-			call.done()
-		default:
-			deepCopy(m.Body, call.Reply)
-			call.done()
+// handleResponse completes the call the response is for, or every call a batch response answers.
+// Requests the server sends over the connection are served instead.
+func (client *Client) handleResponse(data []byte, addr net.Addr, batched bool) {
+	var m Message
+	_, err := DecodeFrame(data, &m)
+	// servers that predate InvalidRequest send error responses with a body no codec can decode
+	var unknownType *UnknownTypeError
+	if errors.As(err, &unknownType) && m.Header.Error != "" {
+		err = nil
+	}
+	if err != nil {
+		client.logger.Printf("[ERROR] rpc client: error decode the message: %v", err)
+		client.metrics.Load().drop("undecodable")
+		return
+	}
+	// log.Printf("rpc client response for packet seq %d is received.\n", m.Header.Seq)
+	h := m.Header
+	if h.Version >= callbackVersion && !h.Response {
+		client.serveRequest(addr, &h, data)
+		return
+	}
+	if batch, ok := batchResponse(m.Body); ok && !batched {
+		for _, response := range batch.Responses {
+			client.handleResponse(response, addr, true)
 		}
+		return
+	}
+	if t, ok := throttledRequest(m.Body); ok && h.Error != "" {
+		client.backOff(h.Seq, time.Duration(t.RetryAfter))
+		return
+	}
+	call := client.removeCall(h.Seq)
+	switch {
+	case call == nil:
+		// it usually means that Write partially failed
+		// and call was already removed.
+	case h.Error != "":
+		call.Error = fmt.Errorf(h.Error)
+		call.done()
+	default:
+		client.observe(call)
+		deepCopy(m.Body, call.Reply)
+		call.done()
 	}
-	// error occurs, so terminateCalls pending calls
-	client.terminateCalls(err)
 }
 
-func NewClient(conn *net.UDPConn, logger *logger.Logger) *Client {
-	codecFunc := NewCodecFuncMap[DefaultCodecType]
-	client := &Client{
-		seq:     1, // seq starts with 1, 0 means invalid call
-		conn:    conn,
-		cc:      codecFunc(),
-		pending: sync.Map{},
-		logger:  logger,
+func (client *Client) isClosing() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.closing
+}
+
+// NewClient creates a client stub talking to the server at remote over the given transport
+func NewClient(transport Transport, remote net.Addr, logger *logger.Logger) *Client {
+	client := newClient(transport, remote, logger)
+	if t, ok := dialedTCP(transport); ok {
+		// the server sees a new connection as another peer, the handshake over it tells the server where the client is now
+		t.onReconnect(func() { go client.rehandshake() })
 	}
 	go client.receive()
-	go client.retry()
+	go client.handshake()
 
 	return client
 }
 
-// Dial connects to an RPC server at the specified network address
-func Dial(addr string, logger *logger.Logger) (*Client, error) {
-	s, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		panic(fmt.Sprintf("error resolving udp address: %v", err))
+func newClient(transport Transport, remote net.Addr, logger *logger.Logger) *Client {
+	client := &Client{
+		seq:       1, // seq starts with 1, 0 means invalid call
+		transport: transport,
+		remote:    remote,
+		session:   newSession(),
+		rtt:       rttEstimatorFor(remote.String()),
+		codec:     DefaultCodecType,
+		pending:   sync.Map{},
+		ready:     make(chan struct{}),
+		logger:    logger,
+
+		retryPolicy:         DefaultRetryPolicy(),
+		methodRetryPolicies: make(map[string]RetryPolicy),
 	}
-	conn, err := net.DialUDP("udp", nil, s)
+	client.version.Store(uint32(MinProtocolVersion))
+	return client
+}
+
+// newSession picks a random non-zero session id
+func newSession() uint64 {
+	for {
+		if session := rand.Uint64(); session != 0 {
+			return session
+		}
+	}
+}
+
+// SetCodec chooses the codec the requests are encoded with, the server replies with the same one.
+// It only takes effect once the server is known to speak protocol version 3, until then LabCodec is used.
+func (client *Client) SetCodec(t Type) error {
+	if _, ok := NewCodecFuncMap[t]; !ok {
+		return fmt.Errorf("rpc client: invalid codec type %s", t)
+	}
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	client.codec = t
+	return nil
+}
+
+// Dial connects to an RPC server at the specified network address.
+// The address may carry a scheme to choose the transport, e.g. "tcp://:8080";
+// addresses without a scheme use udp.
+func Dial(addr string, logger *logger.Logger) (*Client, error) {
+	transport, remote, err := DialTransport(addr, logger)
 	if err != nil {
 		return nil, err
 	}
-	client := NewClient(conn, logger)
-	// close the connection if client is nil
-	defer func() {
-		if client == nil {
-			_ = conn.Close()
-		}
-	}()
-	return client, nil
+	return NewClient(transport, remote, logger), nil
 }
 
 func (client *Client) send(seq uint64, call *Call) {
@@ -192,77 +275,175 @@ func (client *Client) send(seq uint64, call *Call) {
 	client.sending.Lock()
 	defer client.sending.Unlock()
 
-	// prepare request header
-	var header Header
-	header.ServiceMethod = call.ServiceMethod
-	header.Seq = seq
-
-	// encode and send the request
-	data, err := client.cc.Encode(&header, call.Args)
-	if err != nil {
-		call := client.removeCall(seq)
-		// call may be nil, it usually means that Write partially failed,
-		// client has received the response and handled
-		if call != nil {
-			call.Error = err
-			call.done()
-		}
+	data, ok := client.encodeRequest(seq, call)
+	if !ok {
 		return
 	}
 
-	call.Attempts.Add(1)
-
 	// simulate packet loss
-	if randomNumberGenerator.Intn(100) < ClientSideNetworkPacketLossProbability {
-		client.logger.Printf("[INFO] rpc client: packet seq %d is sent but lost.", header.Seq)
+	if !simulated(client.transport) && lost(ClientSideNetworkPacketLossProbability) {
+		client.logger.PrintfContext(call.ctx, "[INFO] rpc client: packet seq %d is sent but lost.", seq)
+		client.metrics.Load().drop("simulated_loss")
 		return
 	}
 
-	// log.Printf("sending packet %d...", header.Seq)
-	_, err = client.conn.Write(data)
+	// log.Printf("sending packet %d...", seq)
+	if err := client.transport.WriteMessage(data, client.remote); err != nil {
+		client.fail(seq, err)
+	}
+}
+
+// encodeRequest encodes the request of the call and arms its retransmission,
+// the call fails if it can not be encoded. client.sending must be held.
+func (client *Client) encodeRequest(seq uint64, call *Call) ([]byte, bool) {
+	// prepare request header
+	header := call.header
+	header.Seq = seq
+	header.Version = uint16(client.version.Load())
+	header.Session = client.session
+
+	data, err := EncodeFrame(client.codec, &header, call.Args)
 	if err != nil {
-		call := client.removeCall(seq)
-		// call may be nil, it usually means that Write partially failed,
-		// client has received the response and handled
-		if call != nil {
-			call.Error = err
-			call.done()
-		}
-		return
+		client.fail(seq, err)
+		return nil, false
+	}
+
+	call.Attempts.Add(1)
+	call.mu.Lock()
+	call.LastTryTimestamp = time.Now()
+	call.mu.Unlock()
+	client.scheduleRetry(call)
+	return data, true
+}
+
+// fail completes the call with err, unless it has completed already
+func (client *Client) fail(seq uint64, err error) {
+	call := client.removeCall(seq)
+	// call may be nil, it usually means that Write partially failed,
+	// client has received the response and handled
+	if call != nil {
+		call.Error = err
+		call.done()
 	}
 }
 
 // Go invokes the function asynchronously.
 // It returns the Call structure representing the invocation.
 func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	return client.GoContext(context.Background(), serviceMethod, args, reply, done)
+}
+
+// GoContext invokes the function asynchronously like Go.
+// If ctx is canceled or its deadline passes before the reply arrives,
+// the call stops being retransmitted and completes with ctx.Err().
+// The call is a span of the trace carried by ctx, or the root of a new trace.
+func (client *Client) GoContext(ctx context.Context, serviceMethod string, args, reply interface{}, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10)
 	} else if cap(done) == 0 {
 		panic("rpc client: done channel is unbuffered")
 	}
-	call := &Call{
+	call := client.newCall(ctx, serviceMethod, args, reply, done)
+	client.mu.Lock()
+	interceptors := client.interceptors
+	client.mu.Unlock()
+	if len(interceptors) > 0 {
+		go client.intercept(call.ctx, call, interceptors)
+		return call
+	}
+	return client.start(call.ctx, call)
+}
+
+// newCall creates a call, which is a span of the trace carried by ctx
+func (client *Client) newCall(ctx context.Context, serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	ctx, span := trace.StartSpan(ctx, serviceMethod, trace.KindClient)
+	client.mu.Lock()
+	exporter := client.exporter
+	client.mu.Unlock()
+	return &Call{
 		ServiceMethod:    serviceMethod,
 		Args:             args,
 		Reply:            reply,
 		LastTryTimestamp: time.Now(),
+		header:           Header{ServiceMethod: serviceMethod, TraceId: span.TraceId, SpanId: span.SpanId},
+		ctx:              ctx,
+		span:             span,
+		exporter:         exporter,
 		Done:             done,
+		finished:         make(chan struct{}),
+	}
+}
+
+// start registers the call and sends its request
+func (client *Client) start(ctx context.Context, call *Call) *Call {
+	if !client.register(ctx, call) {
+		return call
+	}
+	seq := call.Seq
+
+	// requests wait for the handshake, so that they are sent with every
+	// safeguard of the negotiated protocol version, e.g. the checksum
+	select {
+	case <-client.ready:
+		client.send(seq, call)
+	default:
+		if call.ServiceMethod == handshakeMethod {
+			client.send(seq, call)
+			break
+		}
+		go func() {
+			select {
+			case <-client.ready:
+				client.send(seq, call)
+			case <-call.finished:
+			}
+		}()
+	}
+	return call
+}
+
+// register registers the call, which completes at once if it can not be made
+func (client *Client) register(ctx context.Context, call *Call) bool {
+	call.policy = client.retryPolicyFor(call.ServiceMethod)
+	if err := ctx.Err(); err != nil {
+		call.Error = err
+		call.done()
+		return false
 	}
 
 	// register this call.
-	seq, err := client.registerCall(call)
-	if err != nil {
+	if _, err := client.registerCall(call); err != nil {
 		call.Error = err
 		call.done()
-		return call
+		return false
+	}
+	if ctx.Done() != nil {
+		go client.watch(ctx, call)
 	}
+	return true
+}
 
-	client.send(seq, call)
-	return call
+// watch abandons the call once ctx is done, unless the call completes first
+func (client *Client) watch(ctx context.Context, call *Call) {
+	select {
+	case <-ctx.Done():
+		if call := client.removeCall(call.Seq); call != nil {
+			call.Error = ctx.Err()
+			call.done()
+		}
+	case <-call.finished:
+	}
 }
 
 // synchronous Call invokes the named function, waits for it to complete,
 // and returns its error status.
 func (client *Client) Call(serviceMethod string, args, reply interface{}) error {
-	call := <-client.Go(serviceMethod, args, reply, make(chan *Call, 1)).Done
+	return client.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// CallContext invokes the named function and waits for it to complete
+// or for ctx to be done, whichever happens first.
+func (client *Client) CallContext(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	call := <-client.GoContext(ctx, serviceMethod, args, reply, make(chan *Call, 1)).Done
 	return call.Error
 }
@@ -1,5 +1,12 @@
 package rpc
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
 type Message struct {
 	Header Header
 	Body   interface{}
@@ -9,6 +16,12 @@ type Header struct {
 	ServiceMethod string // format "Service.Method" will be casted to string
 	Seq           uint64 // sequence number chosen by client
 	Error         string
+	Version       uint16 // protocol version the message is encoded with
+	Session       uint64 // incarnation of the client, chosen at random whenever a client is created, 0 if unknown
+	TraceId       uint64 // trace the call belongs to, 0 if unknown
+	SpanId        uint64 // span of the call at the client, the parent of the span at the server
+	Notify        bool   // the request is a one-way notification, the server sends no response
+	Response      bool   // the message is a response, carried in the frame tag so that it is told apart from requests without decoding
 }
 
 type Codec interface {
@@ -19,7 +32,9 @@ type Codec interface {
 type NewCodecFunc func() Codec
 
 const (
-	LabType Type = "application/lab"
+	GobType  Type = "application/gob"
+	LabType  Type = "application/lab"
+	JSONType Type = "application/json"
 )
 
 const (
@@ -30,5 +45,91 @@ const (
 type Type string
 
 var NewCodecFuncMap = map[Type]NewCodecFunc{
-	LabType: NewLabCodec,
+	GobType:  NewGobCodec,
+	LabType:  NewLabCodec,
+	JSONType: NewJSONCodec,
+}
+
+// codecIds identifies the codec of a frame in its first byte
+var codecIds = map[Type]byte{
+	LabType:  1,
+	GobType:  2,
+	JSONType: 3,
+}
+
+// frameMagic follows the codec id at the start of every frame.
+// Frames of the older protocol versions are bare LabCodec messages starting
+// with a 4 bytes little endian header length, which can never be this large,
+// so both kinds of frames can be told apart.
+var frameMagic = []byte{0xFF, 0xFF, 0xFF}
+
+const framePrefixSize = 4
+
+// frameResponse is set in the codec id of the frames carrying a response from protocol version 8 on,
+// so that requests can go both ways over a connection
+const frameResponse byte = 0x80
+
+// EncodeFrame encodes the message with the codec of type t and tags the frame with it.
+// Messages of protocol versions older than 3 can only be encoded with LabCodec and carry no tag.
+func EncodeFrame(t Type, h *Header, body interface{}) ([]byte, error) {
+	if h.Version < 3 {
+		return NewLabCodec().Encode(h, body)
+	}
+	newCodec, ok := NewCodecFuncMap[t]
+	if !ok {
+		return nil, fmt.Errorf("rpc codec: invalid codec type %s", t)
+	}
+	data, err := newCodec().Encode(h, body)
+	if err != nil {
+		return nil, err
+	}
+	id := codecIds[t]
+	if h.Response && h.Version >= callbackVersion {
+		id |= frameResponse
+	}
+	frame := make([]byte, 0, framePrefixSize+len(data))
+	frame = append(frame, id)
+	frame = append(frame, frameMagic...)
+	return append(frame, data...), nil
+}
+
+var corruptedMessages atomic.Uint64
+
+// CorruptedMessages returns the number of messages dropped so far because their checksum did not match.
+// The sender retransmits them like lost messages.
+func CorruptedMessages() uint64 {
+	return corruptedMessages.Load()
+}
+
+// DecodeFrame decodes a frame with the codec it is tagged with and returns the codec type
+func DecodeFrame(data []byte, m *Message) (Type, error) {
+	t, err := decodeFrame(data, m)
+	if errors.Is(err, ErrChecksum) {
+		corruptedMessages.Add(1)
+	}
+	return t, err
+}
+
+func decodeFrame(data []byte, m *Message) (Type, error) {
+	if len(data) < framePrefixSize || !bytes.Equal(data[1:framePrefixSize], frameMagic) {
+		return LabType, NewLabCodec().Decode(data, m)
+	}
+	for t, id := range codecIds {
+		if id == data[0]&^frameResponse {
+			var err error
+			if t == LabType {
+				err = NewLabCodec().(*LabCodec).decodeTagged(data[framePrefixSize:], m)
+			} else {
+				err = NewCodecFuncMap[t]().Decode(data[framePrefixSize:], m)
+			}
+			m.Header.Response = isResponse(data)
+			return t, err
+		}
+	}
+	return "", fmt.Errorf("rpc codec: unknown codec id %d", data[0])
+}
+
+// isResponse reports whether the frame carries a response, without decoding it
+func isResponse(data []byte) bool {
+	return len(data) >= framePrefixSize && bytes.Equal(data[1:framePrefixSize], frameMagic) && data[0]&frameResponse != 0
 }
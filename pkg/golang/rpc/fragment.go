@@ -0,0 +1,316 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"distributed-file-system/pkg/golang/logger"
+)
+
+// default setting
+var (
+	FragmentTimeout    time.Duration = 100 * time.Millisecond // time to wait for a missing fragment before asking for it again
+	FragmentRetryLimit int           = 10                     // number of times the missing fragments are requested before a partial message is dropped
+	FragmentCacheTTL   time.Duration = 30 * time.Second       // how long sent fragments are kept for retransmission
+	FragmentMaxPartial int           = 64                     // number of incomplete messages kept per sender, the oldest is dropped to make room
+)
+
+const (
+	MaxMessageSize = 1024 * 1024 * 64 // upper bound of a reassembled message
+
+	fragmentData byte = 0xF1 // datagram carries a piece of a message
+	fragmentNack byte = 0xF2 // datagram asks the sender to retransmit the listed pieces
+
+	// kind(1) + message id(8) + fragment index(4) + total fragments(4)
+	fragmentHeaderSize  = 17
+	fragmentPayloadSize = MaxBufferSize - fragmentHeaderSize
+)
+
+// outgoingMessage keeps the fragments of a sent message around
+// so that the missing ones can be retransmitted on request
+type outgoingMessage struct {
+	fragments [][]byte
+	sentAt    time.Time
+}
+
+// partialMessage is a message whose fragments are being collected
+type partialMessage struct {
+	id        uint64
+	addr      string // sender of the message
+	fragments [][]byte
+	received  int
+	lastSeen  time.Time
+	nacks     int                // number of retransmission requests sent
+	write     func([]byte) error // writes back to the sender of the message
+}
+
+// fragmenter splits encoded messages into numbered datagrams of at most
+// MaxBufferSize bytes and reassembles them at the receiving side.
+// Only the fragments reported missing by the receiver are retransmitted.
+type fragmenter struct {
+	mu       sync.Mutex
+	nextId   uint64
+	outbox   map[uint64]*outgoingMessage // key: message id
+	partials map[string]*partialMessage  // key: "<addr>-<message id>"
+	pending  map[string]int              // number of partials of each sender, key: addr
+	complete map[string]time.Time        // messages reassembled lately, key: "<addr>-<message id>", value: completion time
+	close    chan struct{}
+	logger   *logger.Logger
+}
+
+func newFragmenter(logger *logger.Logger) *fragmenter {
+	f := &fragmenter{
+		nextId:   rand.Uint64(),
+		outbox:   make(map[uint64]*outgoingMessage),
+		partials: make(map[string]*partialMessage),
+		pending:  make(map[string]int),
+		complete: make(map[string]time.Time),
+		close:    make(chan struct{}),
+		logger:   logger,
+	}
+	go f.backgroundCheck()
+	return f
+}
+
+// send splits the data into fragments and writes every one of them
+func (f *fragmenter) send(data []byte, write func([]byte) error) error {
+	if len(data) > MaxMessageSize {
+		return fmt.Errorf("rpc fragmenter: message of %d bytes exceeds the limit of %d bytes", len(data), MaxMessageSize)
+	}
+	total := (len(data) + fragmentPayloadSize - 1) / fragmentPayloadSize
+	if total == 0 {
+		total = 1
+	}
+	f.mu.Lock()
+	id := f.nextId
+	f.nextId++
+	f.mu.Unlock()
+
+	fragments := make([][]byte, total)
+	for i := 0; i < total; i++ {
+		start := i * fragmentPayloadSize
+		end := min(start+fragmentPayloadSize, len(data))
+		fragments[i] = encodeFragment(id, uint32(i), uint32(total), data[start:end])
+	}
+	if total > 1 {
+		f.mu.Lock()
+		f.outbox[id] = &outgoingMessage{fragments: fragments, sentAt: time.Now()}
+		f.mu.Unlock()
+	}
+	for _, frag := range fragments {
+		if err := write(frag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receive handles a single datagram from addr.
+// It returns the whole message once its last missing fragment has arrived, or nil otherwise.
+// write is used to ask the sender for missing fragments.
+func (f *fragmenter) receive(datagram []byte, addr string, write func([]byte) error) ([]byte, error) {
+	if len(datagram) < 1 {
+		return nil, fmt.Errorf("rpc fragmenter: empty datagram")
+	}
+	switch datagram[0] {
+	case fragmentData:
+		return f.receiveFragment(datagram, addr, write)
+	case fragmentNack:
+		return nil, f.retransmit(datagram, write)
+	default:
+		return nil, fmt.Errorf("rpc fragmenter: unknown datagram kind %#x", datagram[0])
+	}
+}
+
+func (f *fragmenter) receiveFragment(datagram []byte, addr string, write func([]byte) error) ([]byte, error) {
+	if len(datagram) < fragmentHeaderSize {
+		return nil, fmt.Errorf("rpc fragmenter: datagram of %d bytes is too short", len(datagram))
+	}
+	id := binary.LittleEndian.Uint64(datagram[1:9])
+	index := binary.LittleEndian.Uint32(datagram[9:13])
+	total := binary.LittleEndian.Uint32(datagram[13:17])
+	payload := datagram[fragmentHeaderSize:]
+	if total == 0 || index >= total || uint64(total)*fragmentPayloadSize > MaxMessageSize+fragmentPayloadSize {
+		return nil, fmt.Errorf("rpc fragmenter: invalid fragment %d of %d", index, total)
+	}
+	if total == 1 {
+		return payload, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fmt.Sprintf("%s-%d", addr, id)
+	if _, done := f.complete[key]; done {
+		// a late or duplicated fragment of a message already delivered, which must not be delivered twice
+		return nil, nil
+	}
+	p, ok := f.partials[key]
+	if !ok {
+		if f.pending[addr] >= FragmentMaxPartial {
+			// a sender must not fill the memory with messages it never completes
+			f.dropOldest(addr)
+		}
+		p = &partialMessage{id: id, addr: addr, fragments: make([][]byte, total)}
+		f.partials[key] = p
+		f.pending[addr]++
+	}
+	if len(p.fragments) != int(total) {
+		return nil, fmt.Errorf("rpc fragmenter: fragment count mismatch for message %s", key)
+	}
+	p.lastSeen = time.Now()
+	p.write = write
+	if p.fragments[index] == nil {
+		p.fragments[index] = payload
+		p.received++
+	}
+	if p.received < len(p.fragments) {
+		return nil, nil
+	}
+	f.forget(key, p)
+	// the sender may resend fragments for as long as it keeps them, i.e. FragmentCacheTTL
+	f.complete[key] = time.Now()
+	size := 0
+	for _, frag := range p.fragments {
+		size += len(frag)
+	}
+	data := make([]byte, 0, size)
+	for _, frag := range p.fragments {
+		data = append(data, frag...)
+	}
+	return data, nil
+}
+
+// forget drops a partial message, the lock must be held
+func (f *fragmenter) forget(key string, p *partialMessage) {
+	delete(f.partials, key)
+	if f.pending[p.addr]--; f.pending[p.addr] <= 0 {
+		delete(f.pending, p.addr)
+	}
+}
+
+// dropOldest drops the partial message of addr that was last heard of the longest ago, the lock must be held
+func (f *fragmenter) dropOldest(addr string) {
+	var oldestKey string
+	var oldest *partialMessage
+	for key, p := range f.partials {
+		if p.addr == addr && (oldest == nil || p.lastSeen.Before(oldest.lastSeen)) {
+			oldestKey, oldest = key, p
+		}
+	}
+	if oldest != nil {
+		f.logger.Printf("[INFO] rpc fragmenter: %s has %d incomplete messages, dropping %s", addr, f.pending[addr], oldestKey)
+		f.forget(oldestKey, oldest)
+	}
+}
+
+// retransmit resends the fragments listed in a nack datagram
+func (f *fragmenter) retransmit(datagram []byte, write func([]byte) error) error {
+	if len(datagram) < 13 {
+		return fmt.Errorf("rpc fragmenter: nack of %d bytes is too short", len(datagram))
+	}
+	id := binary.LittleEndian.Uint64(datagram[1:9])
+	count := binary.LittleEndian.Uint32(datagram[9:13])
+	if uint64(len(datagram)-13) != uint64(count)*4 {
+		return fmt.Errorf("rpc fragmenter: malformed nack for message %d", id)
+	}
+	f.mu.Lock()
+	m, ok := f.outbox[id]
+	f.mu.Unlock()
+	if !ok {
+		return nil // already expired, the rpc layer will retry the whole call
+	}
+	for i := uint32(0); i < count; i++ {
+		index := binary.LittleEndian.Uint32(datagram[13+4*i:])
+		if int(index) >= len(m.fragments) {
+			continue
+		}
+		if err := write(m.fragments[index]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backgroundCheck asks for missing fragments of stalled messages
+// and forgets about messages that are too old
+func (f *fragmenter) backgroundCheck() {
+	ticker := time.NewTicker(FragmentTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.close:
+			return
+		case <-ticker.C:
+			f.mu.Lock()
+			for key, p := range f.partials {
+				if time.Since(p.lastSeen) < FragmentTimeout {
+					continue
+				}
+				if p.nacks >= FragmentRetryLimit {
+					f.logger.Printf("[INFO] rpc fragmenter: dropping incomplete message %s", key)
+					f.forget(key, p)
+					continue
+				}
+				p.nacks++
+				p.lastSeen = time.Now()
+				if err := p.write(encodeNack(p.id, p.missing())); err != nil {
+					f.logger.Printf("[ERROR] rpc fragmenter: error requesting missing fragments: %v", err)
+				}
+			}
+			for id, m := range f.outbox {
+				if time.Since(m.sentAt) > FragmentCacheTTL {
+					delete(f.outbox, id)
+				}
+			}
+			for key, completedAt := range f.complete {
+				if time.Since(completedAt) > FragmentCacheTTL {
+					delete(f.complete, key)
+				}
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+func (f *fragmenter) shutdown() {
+	close(f.close)
+}
+
+func (p *partialMessage) missing() []uint32 {
+	var indices []uint32
+	for i, frag := range p.fragments {
+		if frag == nil {
+			indices = append(indices, uint32(i))
+		}
+	}
+	return indices
+}
+
+func encodeFragment(id uint64, index, total uint32, payload []byte) []byte {
+	buf := make([]byte, fragmentHeaderSize+len(payload))
+	buf[0] = fragmentData
+	binary.LittleEndian.PutUint64(buf[1:9], id)
+	binary.LittleEndian.PutUint32(buf[9:13], index)
+	binary.LittleEndian.PutUint32(buf[13:17], total)
+	copy(buf[fragmentHeaderSize:], payload)
+	return buf
+}
+
+func encodeNack(id uint64, indices []uint32) []byte {
+	// a nack must fit into a single datagram as well
+	maxIndices := (MaxBufferSize - 13) / 4
+	if len(indices) > maxIndices {
+		indices = indices[:maxIndices]
+	}
+	buf := make([]byte, 13+4*len(indices))
+	buf[0] = fragmentNack
+	binary.LittleEndian.PutUint64(buf[1:9], id)
+	binary.LittleEndian.PutUint32(buf[9:13], uint32(len(indices)))
+	for i, index := range indices {
+		binary.LittleEndian.PutUint32(buf[13+4*i:], index)
+	}
+	return buf
+}
@@ -0,0 +1,34 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+)
+
+type GobCodec struct{}
+
+var _ Codec = (*GobCodec)(nil)
+
+func NewGobCodec() Codec {
+	return &GobCodec{}
+}
+
+func (c *GobCodec) Decode(data []byte, m *Message) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(m)
+}
+
+func (c *GobCodec) Encode(h *Header, body interface{}) ([]byte, error) {
+	var m Message
+	m.Header = *h
+	// the body is sent by value, its type is registered to gob by RegisterType
+	if body != nil && reflect.TypeOf(body).Kind() == reflect.Ptr {
+		body = reflect.ValueOf(body).Elem().Interface()
+	}
+	m.Body = body
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,118 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+
+	"distributed-file-system/pkg/golang/trace"
+)
+
+// ServerHandler serves a request. ctx is the one the method gets, it carries the span of the request
+// and the peer the request comes from. args and reply are pointers to the argument and the reply of the method,
+// reply is nil for the methods serving notifications.
+type ServerHandler func(ctx context.Context, addr net.Addr, h *Header, args, reply interface{}) error
+
+// ServerInterceptor is called for every request instead of the method. It may inspect and modify
+// ctx, the header, the argument and the reply, and either call handler to carry on or return an error
+// to short-circuit the request. The header is sent back with the reply, so it carries the changes too.
+type ServerInterceptor func(ctx context.Context, addr net.Addr, h *Header, args, reply interface{}, handler ServerHandler) error
+
+// ClientInvoker sends a request and waits for its reply
+type ClientInvoker func(ctx context.Context, h *Header, args, reply interface{}) error
+
+// ClientInterceptor is called for every call instead of sending the request. It may inspect and modify
+// the header, the argument and the reply, and either call invoker to carry on or return an error
+// to short-circuit the call. Seq, Version and Session of the header are set when the request is sent.
+type ClientInterceptor func(ctx context.Context, h *Header, args, reply interface{}, invoker ClientInvoker) error
+
+// Use appends interceptors to the chain the requests go through, the first one being the outermost
+func (server *Server) Use(interceptors ...ServerInterceptor) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.interceptors = append(server.interceptors, interceptors...)
+}
+
+// Use appends interceptors to the chain the calls go through, the first one being the outermost
+func (client *Client) Use(interceptors ...ClientInterceptor) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.interceptors = append(client.interceptors, interceptors...)
+}
+
+// call runs the method of the request through the interceptor chain, within a span of the trace of the client
+func (server *Server) call(addr net.Addr, req *request) error {
+	ctx, span := trace.StartSpan(req.ctx, req.h.ServiceMethod, trace.KindServer)
+	args := req.argv
+	if args.Kind() != reflect.Ptr {
+		args = args.Addr()
+	}
+	handler := func(ctx context.Context, addr net.Addr, h *Header, args, reply interface{}) error {
+		argv, replyv := reflect.ValueOf(args), reflect.ValueOf(reply)
+		if argv.Type() != reflect.PointerTo(req.mtype.ArgType) && argv.Type() != req.mtype.ArgType {
+			return fmt.Errorf("rpc server: interceptor passed argument of type %s, expecting %s", argv.Type(), req.mtype.ArgType)
+		}
+		if !req.mtype.Notify && (!replyv.IsValid() || replyv.Type() != req.mtype.ReplyType) {
+			return fmt.Errorf("rpc server: interceptor passed reply of type %T, expecting %s", reply, req.mtype.ReplyType)
+		}
+		if req.mtype.ArgType.Kind() != reflect.Ptr {
+			argv = argv.Elem()
+		}
+		req.replyv = replyv
+		return req.svc.call(ctx, req.mtype, argv, replyv)
+	}
+	var reply interface{}
+	if req.replyv.IsValid() {
+		reply = req.replyv.Interface()
+	}
+	server.mu.Lock()
+	interceptors := server.interceptors
+	server.mu.Unlock()
+	err := chainServer(interceptors, handler)(ctx, addr, req.h, args.Interface(), reply)
+	span.End(server.spanExporter(), err)
+	return err
+}
+
+func chainServer(interceptors []ServerInterceptor, handler ServerHandler) ServerHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, addr net.Addr, h *Header, args, reply interface{}) error {
+			return interceptor(ctx, addr, h, args, reply, next)
+		}
+	}
+	return handler
+}
+
+func chainClient(interceptors []ClientInterceptor, invoker ClientInvoker) ClientInvoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, h *Header, args, reply interface{}) error {
+			return interceptor(ctx, h, args, reply, next)
+		}
+	}
+	return invoker
+}
+
+// intercept runs the call through the interceptor chain of the client and completes it with the outcome
+func (client *Client) intercept(ctx context.Context, call *Call, interceptors []ClientInterceptor) {
+	invoker := func(ctx context.Context, h *Header, args, reply interface{}) error {
+		return (<-client.start(ctx, newInnerCall(ctx, h, args, reply)).Done).Error
+	}
+	h := call.header
+	call.Error = chainClient(interceptors, invoker)(ctx, &h, call.Args, call.Reply)
+	call.done()
+}
+
+// newInnerCall creates the call sending the request of an interceptor chain, the span belongs to the outer call
+func newInnerCall(ctx context.Context, h *Header, args, reply interface{}) *Call {
+	return &Call{
+		ServiceMethod: h.ServiceMethod,
+		Args:          args,
+		Reply:         reply,
+		header:        *h,
+		ctx:           ctx,
+		Done:          make(chan *Call, 1),
+		finished:      make(chan struct{}),
+	}
+}
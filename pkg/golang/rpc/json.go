@@ -0,0 +1,56 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// JSONCodec encodes messages as human readable json,
+// which is handy for inspecting the traffic
+type JSONCodec struct{}
+
+var _ Codec = (*JSONCodec)(nil)
+
+func NewJSONCodec() Codec {
+	return &JSONCodec{}
+}
+
+type jsonMessage struct {
+	Header Header          `json:"header"`
+	Type   string          `json:"type"` // name of the registered body type
+	Body   json.RawMessage `json:"body"`
+}
+
+func (c *JSONCodec) Encode(h *Header, body interface{}) ([]byte, error) {
+	if body == nil {
+		return nil, fmt.Errorf("unable to encode nil body")
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&jsonMessage{
+		Header: *h,
+		Type:   reflect.Indirect(reflect.ValueOf(body)).Type().Name(),
+		Body:   b,
+	})
+}
+
+func (c *JSONCodec) Decode(data []byte, m *Message) error {
+	var jm jsonMessage
+	if err := json.Unmarshal(data, &jm); err != nil {
+		return err
+	}
+	m.Header = jm.Header
+	o := findCustomType(jm.Type)
+	if o == nil {
+		return &UnknownTypeError{Name: jm.Type}
+	}
+	body := reflect.New(o.typ)
+	if err := json.Unmarshal(jm.Body, body.Interface()); err != nil {
+		return err
+	}
+	m.Body = body.Interface()
+	return nil
+}
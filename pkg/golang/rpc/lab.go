@@ -3,16 +3,35 @@ package rpc
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"log"
+	"math"
 	"reflect"
+	"sort"
 )
 
 type LabCodec struct{}
 
 var _ Codec = (*LabCodec)(nil)
 
+// messages of this protocol version onwards end with the CRC32C checksum of the rest of the message
+const checksumVersion uint16 = 4
+
+// headers of this protocol version onwards always carry the session, the trace id and the span id
+const traceVersion uint16 = 5
+
+// headers of this protocol version onwards end with a byte of flags
+const flagsVersion uint16 = 7
+
+// header flags
+const (
+	flagNotify byte = 1 << iota
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 func NewLabCodec() Codec {
 	return &LabCodec{}
 }
@@ -22,11 +41,16 @@ func (c *LabCodec) Encode(h *Header, body interface{}) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	bb, err := c.EncodeBody(body)
+	// messages of the first protocol version carry no schema information
+	bb, err := c.encodeBody(body, h.Version > 1)
 	if err != nil {
 		return nil, err
 	}
-	return append(hb, bb...), nil
+	data := append(hb, bb...)
+	if h.Version >= checksumVersion {
+		data = binary.LittleEndian.AppendUint32(data, crc32.Checksum(data, castagnoli))
+	}
+	return data, nil
 }
 
 func (c *LabCodec) EncodeHeader(h *Header) ([]byte, error) {
@@ -47,6 +71,26 @@ func (c *LabCodec) EncodeHeader(h *Header) ([]byte, error) {
 	buf.Write(lenbuf[:4])
 	buf.Write(b)
 	// fmt.Printf("error len: %d, error: %v\n", len(b), b)
+	// fields added after the first protocol version are appended at the end,
+	// where decoders of the older versions do not look for them
+	if h.Version > 1 || h.Session != 0 {
+		buf.Write(binary.LittleEndian.AppendUint16(nil, h.Version))
+	}
+	if h.Version >= traceVersion {
+		buf.Write(binary.LittleEndian.AppendUint64(nil, h.Session))
+		buf.Write(binary.LittleEndian.AppendUint64(nil, h.TraceId))
+		buf.Write(binary.LittleEndian.AppendUint64(nil, h.SpanId))
+	} else if h.Session != 0 {
+		// the session is optional and understood by servers of every protocol version
+		buf.Write(binary.LittleEndian.AppendUint64(nil, h.Session))
+	}
+	if h.Version >= flagsVersion {
+		var flags byte
+		if h.Notify {
+			flags |= flagNotify
+		}
+		buf.WriteByte(flags)
+	}
 	totalHeaderLen := uint32(buf.Len())
 	lenbuf = make([]byte, 4)
 	binary.LittleEndian.PutUint32(lenbuf[:4], totalHeaderLen)
@@ -54,64 +98,42 @@ func (c *LabCodec) EncodeHeader(h *Header) ([]byte, error) {
 }
 
 func (c *LabCodec) EncodeBody(body interface{}) ([]byte, error) {
+	return c.encodeBody(body, true)
+}
+
+// encodeBody encodes the body, optionally followed by the schema version of its type
+func (c *LabCodec) encodeBody(body interface{}, withVersion bool) ([]byte, error) {
+	if body == nil {
+		return nil, fmt.Errorf("unable to encode nil body")
+	}
 	if reflect.TypeOf(body).Kind() == reflect.Ptr {
 		body = reflect.ValueOf(body).Elem().Interface()
 	}
-	var fieldBuf, buf bytes.Buffer
+	if reflect.TypeOf(body).Kind() != reflect.Struct {
+		return nil, fmt.Errorf("unsupported body type %s, body must be a struct", reflect.TypeOf(body))
+	}
+	var buf bytes.Buffer
 	typeName := []byte(reflect.TypeOf(body).Name())
 	typeNameLenBuf := make([]byte, 4)
 	binary.LittleEndian.PutUint32(typeNameLenBuf[:4], uint32(len(typeName)))
 	buf.Write(typeNameLenBuf[:4])
 	buf.Write(typeName)
 	// fmt.Printf("typeNameLen %v, typeName: %v\n", len(typeName), typeName)
-	numOfFields := reflect.TypeOf(body).NumField()
-	for i := 0; i < numOfFields; i++ {
-		f := reflect.TypeOf(body).Field(i)
-		fieldName := []byte(f.Name)
-		fieldNameLenBuf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(fieldNameLenBuf[:4], uint32(len(fieldName)))
-		fieldBuf.Write(fieldNameLenBuf[:4])
-		fieldBuf.Write(fieldName)
-		// fmt.Printf("field name %v, in bytes %v\n", f.Name, fieldName)
-		fieldValue := reflect.ValueOf(body).FieldByName(f.Name).Interface()
-		switch fieldValue.(type) {
-		case string:
-			fieldTypeName := []byte(f.Type.Name())
-			fieldTypeNameLenBuf := make([]byte, 4)
-			binary.LittleEndian.PutUint32(fieldTypeNameLenBuf, uint32(len(fieldTypeName)))
-			// fmt.Printf("field type name %v, in bytes %v\n", f.Type.Name(), fieldTypeName)
-			fieldBuf.Write(fieldTypeNameLenBuf)
-			fieldBuf.Write(fieldTypeName)
-			encodeString(&fieldBuf, fieldValue.(string))
-		case bool:
-			fieldTypeName := []byte(f.Type.Name())
-			fieldTypeNameLenBuf := make([]byte, 4)
-			binary.LittleEndian.PutUint32(fieldTypeNameLenBuf, uint32(len(fieldTypeName)))
-			fieldBuf.Write(fieldTypeNameLenBuf)
-			fieldBuf.Write(fieldTypeName)
-			encodeBool(&fieldBuf, fieldValue.(bool))
-		case int64:
-			fieldTypeName := []byte(f.Type.Name())
-			fieldTypeNameLenBuf := make([]byte, 4)
-			binary.LittleEndian.PutUint32(fieldTypeNameLenBuf, uint32(len(fieldTypeName)))
-			fieldBuf.Write(fieldTypeNameLenBuf)
-			fieldBuf.Write(fieldTypeName)
-			encodeInt64(&fieldBuf, fieldValue.(int64))
-		case []byte:
-			fieldTypeName := []byte("[]byte")
-			fieldTypeNameLenBuf := make([]byte, 4)
-			binary.LittleEndian.PutUint32(fieldTypeNameLenBuf, uint32(len(fieldTypeName)))
-			fieldBuf.Write(fieldTypeNameLenBuf)
-			fieldBuf.Write(fieldTypeName)
-			encodeByteSlice(&fieldBuf, fieldValue.([]byte))
-		default:
-			return nil, fmt.Errorf("unsupported data type")
-		}
+	fields, err := encodeFields(reflect.ValueOf(body))
+	if err != nil {
+		return nil, err
 	}
 	totalFieldLenBuf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(totalFieldLenBuf, uint32(fieldBuf.Len()))
+	binary.LittleEndian.PutUint32(totalFieldLenBuf, uint32(len(fields)))
 	buf.Write(totalFieldLenBuf[:4])
-	buf.Write(fieldBuf.Bytes())
+	buf.Write(fields)
+	if withVersion {
+		var version uint16 = 1
+		if t := findCustomType(string(typeName)); t != nil {
+			version = t.version
+		}
+		buf.Write(binary.LittleEndian.AppendUint16(nil, version))
+	}
 	totalLenBuf := make([]byte, 4)
 	binary.LittleEndian.PutUint32(totalLenBuf, uint32(buf.Len()))
 	return append(totalLenBuf[:4], buf.Bytes()...), nil
@@ -119,112 +141,445 @@ func (c *LabCodec) EncodeBody(body interface{}) ([]byte, error) {
 
 func (c *LabCodec) Decode(data []byte, m *Message) error {
 	// log.Printf("custom types: %v", customTypes)
-	headerLen := binary.LittleEndian.Uint32(data[:4])
-	var base uint32 = 4
-	h, err := c.DecodeHeader(data[base : base+headerLen])
+	r := newLabReader(data)
+	header, err := r.chunk()
+	if err != nil {
+		return fmt.Errorf("error decoding header: %w", err)
+	}
+	h, err := c.DecodeHeader(header)
 	if err != nil {
-		return fmt.Errorf("error decoding header: %v", err)
+		return fmt.Errorf("error decoding header: %w", err)
 	}
 	m.Header = h
-	base += headerLen
-	bodyLen := binary.LittleEndian.Uint32(data[base : base+4])
-	base += 4
-	o, err := c.DecodeBody(data[base : base+bodyLen])
+	body, err := r.chunk()
+	if err != nil {
+		return fmt.Errorf("error decoding body: %w", err)
+	}
+	if h.Version >= checksumVersion {
+		end := r.off
+		checksum, err := r.uint32()
+		if err != nil {
+			return fmt.Errorf("error decoding checksum: %w", err)
+		}
+		if checksum != crc32.Checksum(data[:end], castagnoli) {
+			return ErrChecksum
+		}
+	}
+	if err := r.done(); err != nil {
+		return err
+	}
+	o, err := c.DecodeBody(body)
 	m.Body = o
 	return err
 }
 
+// decodeTagged decodes a message of a tagged frame, i.e. of protocol version 3 onwards. The checksum is
+// verified before anything is parsed, since a bit flip in the header could otherwise fail as a parse error,
+// or lower the version below checksumVersion and turn the verification off. Only the messages of version 3
+// carry no checksum, so a message failing it is accepted only if it is a whole version 3 message.
+func (c *LabCodec) decodeTagged(data []byte, m *Message) error {
+	if end := len(data) - 4; end >= 0 && binary.LittleEndian.Uint32(data[end:]) == crc32.Checksum(data[:end], castagnoli) {
+		return c.Decode(data, m)
+	}
+	var v3 Message
+	err := c.Decode(data, &v3)
+	var unknownType *UnknownTypeError
+	if v3.Header.Version == 3 && (err == nil || errors.As(err, &unknownType)) {
+		*m = v3
+		return err
+	}
+	return ErrChecksum
+}
+
 func (c *LabCodec) DecodeHeader(data []byte) (Header, error) {
 	var h Header
-	datalen := binary.LittleEndian.Uint32(data[:4])
-	var base uint32 = 4
-	h.ServiceMethod = string(bytes.Trim(data[base:base+datalen], "\x00"))
-	base += datalen
-	h.Seq = binary.LittleEndian.Uint64(data[base : base+8])
-	base += 8
-	datalen = binary.LittleEndian.Uint32(data[base : base+4])
-	base += 4
-	h.Error = string(bytes.Trim(data[base:base+datalen], "\x00"))
+	r := newLabReader(data)
+	serviceMethod, err := r.chunk()
+	if err != nil {
+		return h, err
+	}
+	h.ServiceMethod = string(bytes.Trim(serviceMethod, "\x00"))
+	if h.Seq, err = r.uint64(); err != nil {
+		return h, err
+	}
+	errMsg, err := r.chunk()
+	if err != nil {
+		return h, err
+	}
+	h.Error = string(bytes.Trim(errMsg, "\x00"))
+	// headers of the first protocol version end here
+	h.Version = 1
+	if r.remaining() >= 2 {
+		if h.Version, err = r.uint16(); err != nil {
+			return h, err
+		}
+	}
+	if h.Version >= traceVersion {
+		for _, field := range []*uint64{&h.Session, &h.TraceId, &h.SpanId} {
+			if *field, err = r.uint64(); err != nil {
+				return h, err
+			}
+		}
+	} else if r.remaining() >= 8 {
+		if h.Session, err = r.uint64(); err != nil {
+			return h, err
+		}
+	}
+	if h.Version >= flagsVersion {
+		flags, err := r.next(1)
+		if err != nil {
+			return h, err
+		}
+		h.Notify = flags[0]&flagNotify != 0
+	}
+	// anything left was added by a newer protocol version and is ignored
 	return h, nil
 }
 
 func (c *LabCodec) DecodeBody(data []byte) (interface{}, error) {
-	var base uint32 = 0
-	dataLen := binary.LittleEndian.Uint32(data[base : base+4])
-	base += 4
-	typeOfObject := string(bytes.Trim(data[base:base+dataLen], "\x00"))
-	base += dataLen
+	r := newLabReader(data)
+	typeName, err := r.chunk()
+	if err != nil {
+		return nil, err
+	}
+	typeOfObject := string(bytes.Trim(typeName, "\x00"))
 	o := findCustomType(typeOfObject)
 	if o == nil {
-		return nil, fmt.Errorf("unable to find custom type %s", typeOfObject)
-	}
-	totalFieldLen := binary.LittleEndian.Uint32(data[base : base+4])
-	base += 4
-	end := base + totalFieldLen
-	newO := reflect.New(reflect.TypeOf(o))
-	for base < end {
-		fieldNameLen := binary.LittleEndian.Uint32(data[base : base+4])
-		// fmt.Printf("fieldNameLen %d \n", fieldNameLen)
-		base += 4
-		fieldName := string(bytes.Trim(data[base:base+fieldNameLen], "\x00"))
-		base += fieldNameLen
-		fieldTypeNameLen := binary.LittleEndian.Uint32(data[base : base+4])
-		base += 4
-		fieldType := string(bytes.Trim(data[base:base+fieldTypeNameLen], "\x00"))
-		base += fieldTypeNameLen
-		fieldValueLen := binary.LittleEndian.Uint32(data[base : base+4])
-		// fmt.Printf("field name: %v, field type: %v, field value len: %v\n", fieldName, fieldType, fieldValueLen)
-		base += 4
-		switch fieldType {
-		case "string":
-			b := bytes.Trim(data[base:base+fieldValueLen], "\x00")
-			newO.Elem().FieldByName(fieldName).SetString(string(b))
-		case "bool":
-			b := uint8(data[base])
-			newO.Elem().FieldByName(fieldName).SetBool(b == 1)
-		case "int64":
-			b := binary.LittleEndian.Uint64(data[base : base+fieldValueLen])
-			newO.Elem().FieldByName(fieldName).SetInt(int64(b))
-		case "[]byte":
-			newO.Elem().FieldByName(fieldName).SetBytes(data[base : base+fieldValueLen])
-		default:
-			return nil, fmt.Errorf("unsupported data type")
-		}
-		base += fieldValueLen
+		return nil, &UnknownTypeError{Name: typeOfObject}
+	}
+	fields, err := r.chunk()
+	if err != nil {
+		return nil, err
+	}
+	// the schema version is missing in messages of the first protocol version
+	var version uint16
+	if r.remaining() >= 2 {
+		if version, err = r.uint16(); err != nil {
+			return nil, err
+		}
+	}
+	// a message of the same schema version must match the local type exactly,
+	// otherwise unknown fields are skipped and missing fields keep their zero value
+	strict := version == o.version
+	newO := reflect.New(o.typ)
+	if err := decodeFields(fields, newO.Elem(), 0, strict); err != nil {
+		return nil, err
 	}
 	return newO.Interface(), nil
 }
 
-func encodeString(w io.Writer, s string) {
-	buf := []byte(s)
-	lenbuf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(lenbuf, uint32(len(buf)))
-	w.Write(lenbuf[:4])
-	w.Write(buf)
+// encodeFields encodes every exported field of the struct v as
+// [field name length][field name][field type length][field type][value length][value]
+func encodeFields(v reflect.Value) ([]byte, error) {
+	var fieldBuf bytes.Buffer
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		value, err := encodeValue(v.Field(i))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", f.Name, err)
+		}
+		// fmt.Printf("field name %v, field type %v\n", f.Name, typeDescriptor(f.Type))
+		encodeString(&fieldBuf, f.Name)
+		encodeString(&fieldBuf, typeDescriptor(f.Type))
+		encodeByteSlice(&fieldBuf, value)
+	}
+	return fieldBuf.Bytes(), nil
 }
 
-func encodeInt64(w io.Writer, i int64) {
+// encodeValue encodes a single value, without its length prefix
+func encodeValue(v reflect.Value) ([]byte, error) {
 	var buf bytes.Buffer
-	if err := binary.Write(&buf, binary.LittleEndian, i); err != nil {
-		log.Printf("[ERROR] rpc codec: error encoding message: %v", err)
-		return
+	switch v.Kind() {
+	case reflect.String:
+		buf.WriteString(v.String())
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(v.Int())))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf.Write(binary.LittleEndian.AppendUint64(nil, v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		buf.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(v.Float())))
+	case reflect.Ptr:
+		// a presence flag followed by the value pointed to
+		if v.IsNil() {
+			buf.WriteByte(0)
+			break
+		}
+		buf.WriteByte(1)
+		elem, err := encodeValue(v.Elem())
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(elem)
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// []byte and [N]byte are written as they are
+			if v.Kind() == reflect.Slice {
+				buf.Write(v.Bytes())
+				break
+			}
+			// Bytes panics on arrays that are not addressable, e.g. fields of a struct passed by value
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			buf.Write(b)
+			break
+		}
+		// number of elements followed by each length prefixed element
+		buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(v.Len())))
+		for i := 0; i < v.Len(); i++ {
+			elem, err := encodeValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			encodeByteSlice(&buf, elem)
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("unsupported map key type %s", v.Type().Key())
+		}
+		// number of entries followed by each length prefixed key and value,
+		// keys are sorted so that the same map is always encoded the same way
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(keys))))
+		for _, key := range keys {
+			elem, err := encodeValue(v.MapIndex(key))
+			if err != nil {
+				return nil, err
+			}
+			encodeString(&buf, key.String())
+			encodeByteSlice(&buf, elem)
+		}
+	case reflect.Struct:
+		fields, err := encodeFields(v)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(fields)
+	default:
+		return nil, fmt.Errorf("unsupported data type %s", v.Type())
 	}
-	lenbuf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(lenbuf, uint32(buf.Len()))
-	w.Write(lenbuf[:4])
-	w.Write(buf.Bytes())
+	return buf.Bytes(), nil
 }
 
-func encodeBool(w io.Writer, b bool) {
-	var buf bytes.Buffer
-	if err := binary.Write(&buf, binary.LittleEndian, b); err != nil {
-		log.Printf("[ERROR] rpc codec: error encoding message: %v", err)
-		return
+// decodeFields decodes the encoded fields into the struct v.
+// Only exported fields declared directly in the struct can be set,
+// other fields are rejected in strict mode and skipped otherwise.
+func decodeFields(data []byte, v reflect.Value, depth int, strict bool) error {
+	if depth > MaxDecodeDepth {
+		return ErrTooDeep
+	}
+	r := newLabReader(data)
+	for r.remaining() > 0 {
+		fieldName, err := r.chunk()
+		if err != nil {
+			return err
+		}
+		fieldType, err := r.chunk()
+		if err != nil {
+			return err
+		}
+		fieldValue, err := r.chunk()
+		if err != nil {
+			return err
+		}
+		// fmt.Printf("field name: %s, field type: %s, field value len: %v\n", fieldName, fieldType, len(fieldValue))
+		name := string(bytes.Trim(fieldName, "\x00"))
+		f, ok := v.Type().FieldByName(name)
+		if !ok || len(f.Index) != 1 || !f.IsExported() {
+			if strict {
+				return &UnknownFieldError{Type: v.Type().String(), Field: name}
+			}
+			continue
+		}
+		if expected := typeDescriptor(f.Type); expected != string(fieldType) {
+			return &TypeMismatchError{Field: name, Got: string(fieldType), Want: expected}
+		}
+		if err := decodeValue(fieldValue, v.Field(f.Index[0]), depth+1, strict); err != nil {
+			return fmt.Errorf("field %s: %w", name, err)
+		}
 	}
+	return nil
+}
+
+// decodeValue decodes data into v according to the kind of v
+func decodeValue(data []byte, v reflect.Value, depth int, strict bool) error {
+	if depth > MaxDecodeDepth {
+		return ErrTooDeep
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(data))
+	case reflect.Bool:
+		if len(data) != 1 || data[0] > 1 {
+			return ErrInvalidLength
+		}
+		v.SetBool(data[0] == 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if len(data) != 8 {
+			return ErrInvalidLength
+		}
+		i := int64(binary.LittleEndian.Uint64(data))
+		if v.OverflowInt(i) {
+			return fmt.Errorf("value %d overflows %s", i, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if len(data) != 8 {
+			return ErrInvalidLength
+		}
+		u := binary.LittleEndian.Uint64(data)
+		if v.OverflowUint(u) {
+			return fmt.Errorf("value %d overflows %s", u, v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		if len(data) != 8 {
+			return ErrInvalidLength
+		}
+		v.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(data)))
+	case reflect.Ptr:
+		if len(data) == 0 || data[0] > 1 || (data[0] == 0 && len(data) != 1) {
+			return ErrInvalidLength
+		}
+		if data[0] == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			break
+		}
+		elem := reflect.New(v.Type().Elem())
+		if err := decodeValue(data[1:], elem.Elem(), depth+1, strict); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte{}, data...))
+			break
+		}
+		r := newLabReader(data)
+		count, err := r.count(4)
+		if err != nil {
+			return err
+		}
+		slice := reflect.MakeSlice(v.Type(), count, count)
+		for i := 0; i < count; i++ {
+			elem, err := r.chunk()
+			if err != nil {
+				return err
+			}
+			if err := decodeValue(elem, slice.Index(i), depth+1, strict); err != nil {
+				return err
+			}
+		}
+		if err := r.done(); err != nil {
+			return err
+		}
+		v.Set(slice)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if len(data) != v.Len() {
+				return ErrInvalidLength
+			}
+			reflect.Copy(v, reflect.ValueOf(data))
+			break
+		}
+		r := newLabReader(data)
+		count, err := r.count(4)
+		if err != nil {
+			return err
+		}
+		if count != v.Len() {
+			return ErrInvalidLength
+		}
+		for i := 0; i < count; i++ {
+			elem, err := r.chunk()
+			if err != nil {
+				return err
+			}
+			if err := decodeValue(elem, v.Index(i), depth+1, strict); err != nil {
+				return err
+			}
+		}
+		return r.done()
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map key type %s", v.Type().Key())
+		}
+		r := newLabReader(data)
+		count, err := r.count(8)
+		if err != nil {
+			return err
+		}
+		m := reflect.MakeMapWithSize(v.Type(), count)
+		for i := 0; i < count; i++ {
+			k, err := r.chunk()
+			if err != nil {
+				return err
+			}
+			elemData, err := r.chunk()
+			if err != nil {
+				return err
+			}
+			key := reflect.New(v.Type().Key()).Elem()
+			key.SetString(string(k))
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeValue(elemData, elem, depth+1, strict); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elem)
+		}
+		if err := r.done(); err != nil {
+			return err
+		}
+		v.Set(m)
+	case reflect.Struct:
+		return decodeFields(data, v, depth+1, strict)
+	default:
+		return fmt.Errorf("unsupported data type %s", v.Type())
+	}
+	return nil
+}
+
+// typeDescriptor describes the shape of a type on the wire,
+// e.g. "int64", "[]string", "map[string]int32" or "*MountRequest"
+func typeDescriptor(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + typeDescriptor(t.Elem())
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "[]byte"
+		}
+		return "[]" + typeDescriptor(t.Elem())
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), typeDescriptor(t.Elem()))
+	case reflect.Map:
+		return fmt.Sprintf("map[%s]%s", typeDescriptor(t.Key()), typeDescriptor(t.Elem()))
+	case reflect.Struct:
+		if t.Name() == "" {
+			return "struct"
+		}
+		return t.Name()
+	default:
+		return t.Kind().String()
+	}
+}
+
+func encodeString(w io.Writer, s string) {
+	buf := []byte(s)
 	lenbuf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(lenbuf, uint32(buf.Len()))
+	binary.LittleEndian.PutUint32(lenbuf, uint32(len(buf)))
 	w.Write(lenbuf[:4])
-	w.Write(buf.Bytes())
+	w.Write(buf)
 }
 
 func encodeByteSlice(w io.Writer, b []byte) {
@@ -234,7 +589,7 @@ func encodeByteSlice(w io.Writer, b []byte) {
 	w.Write(b)
 }
 
-func findCustomType(typeName string) interface{} {
+func findCustomType(typeName string) *customType {
 	if _, ok := customTypes[typeName]; !ok {
 		return nil
 	}
@@ -0,0 +1,144 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"distributed-file-system/pkg/golang/metrics"
+)
+
+// RegisterMetrics registers the metrics shared by every server and client of the process
+func RegisterMetrics(reg *metrics.Registry) {
+	reg.NewCounterFunc("rpc_corrupted_messages_total", "Messages dropped because their checksum did not match.",
+		func() float64 { return float64(CorruptedMessages()) })
+	reg.NewCounterFunc("rpc_rejected_messages_total", "Messages dropped because they failed authentication.",
+		func() float64 { return float64(RejectedMessages()) })
+}
+
+// serverMetrics counts what happens to the requests of a server
+type serverMetrics struct {
+	latency    *metrics.Histogram // labels: method
+	errors     *metrics.Counter   // labels: method
+	duplicates *metrics.Counter   // labels: method
+	throttled  *metrics.Counter   // labels: method
+	dropped    *metrics.Counter   // labels: reason
+}
+
+// Instrument registers the metrics of the server. It should be called before the server accepts requests.
+func (server *Server) Instrument(reg *metrics.Registry) {
+	m := &serverMetrics{
+		latency: reg.NewHistogram("rpc_server_request_duration_seconds", "Time taken to serve a request, by method.",
+			metrics.DefaultBuckets, "method"),
+		errors:     reg.NewCounter("rpc_server_request_errors_total", "Requests that failed, by method.", "method"),
+		duplicates: reg.NewCounter("rpc_server_duplicate_requests_total", "Retransmitted requests answered from the reply cache, by method.", "method"),
+		throttled:  reg.NewCounter("rpc_server_throttled_requests_total", "Requests rejected for exceeding the limits of the server, by method.", "method"),
+		dropped:    reg.NewCounter("rpc_server_dropped_messages_total", "Messages the server dropped, by reason.", "reason"),
+	}
+	reg.NewCollector("rpc_server_method_calls_total", "Calls of each registered method.", "counter", []string{"method"}, server.methodCalls)
+	server.metrics.Store(m)
+	server.Use(m.intercept)
+}
+
+// methodCalls collects the number of calls of every method
+func (server *Server) methodCalls() []metrics.Sample {
+	var samples []metrics.Sample
+	server.serviceMap.Range(func(key, value interface{}) bool {
+		svc := value.(*service)
+		for name, m := range svc.method {
+			samples = append(samples, metrics.Sample{Value: float64(m.NumCalls()), LabelValues: []string{svc.name + "." + name}})
+		}
+		return true
+	})
+	return samples
+}
+
+func (m *serverMetrics) intercept(ctx context.Context, addr net.Addr, h *Header, args, reply interface{}, handler ServerHandler) error {
+	start := time.Now()
+	err := handler(ctx, addr, h, args, reply)
+	m.latency.Observe(time.Since(start).Seconds(), h.ServiceMethod)
+	if err != nil {
+		m.errors.Inc(h.ServiceMethod)
+	}
+	return err
+}
+
+// the following methods do nothing on a server that is not instrumented
+
+func (m *serverMetrics) duplicate(serviceMethod string) {
+	if m != nil {
+		m.duplicates.Inc(serviceMethod)
+	}
+}
+
+func (m *serverMetrics) throttle(serviceMethod string) {
+	if m != nil {
+		m.throttled.Inc(serviceMethod)
+	}
+}
+
+func (m *serverMetrics) drop(reason string) {
+	if m != nil {
+		m.dropped.Inc(reason)
+	}
+}
+
+// clientMetrics counts what happens to the calls of a client
+type clientMetrics struct {
+	calls           *metrics.Counter   // labels: method
+	latency         *metrics.Histogram // labels: method
+	errors          *metrics.Counter   // labels: method
+	retransmissions *metrics.Counter   // labels: method
+	dropped         *metrics.Counter   // labels: reason
+}
+
+// Instrument registers the metrics of the client. It should be called before the client makes calls.
+func (client *Client) Instrument(reg *metrics.Registry) {
+	m := &clientMetrics{
+		calls: reg.NewCounter("rpc_client_calls_total", "Calls made, by method.", "method"),
+		latency: reg.NewHistogram("rpc_client_call_duration_seconds", "Time taken by a call to complete, retransmissions included, by method.",
+			metrics.DefaultBuckets, "method"),
+		errors:          reg.NewCounter("rpc_client_call_errors_total", "Calls that failed, by method.", "method"),
+		retransmissions: reg.NewCounter("rpc_client_retransmissions_total", "Requests sent again for lack of a reply, by method.", "method"),
+		dropped:         reg.NewCounter("rpc_client_dropped_messages_total", "Messages the client dropped, by reason.", "reason"),
+	}
+	reg.NewGaugeFunc("rpc_client_pending_calls", "Calls waiting for their reply.", client.pendingCalls)
+	reg.NewGaugeFunc("rpc_client_retransmission_timeout_seconds", "Retransmission timeout measured for the server.",
+		func() float64 { return client.RTO().Seconds() })
+	client.metrics.Store(m)
+	client.Use(m.intercept)
+}
+
+func (client *Client) pendingCalls() float64 {
+	var n int
+	client.pending.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return float64(n)
+}
+
+func (m *clientMetrics) intercept(ctx context.Context, h *Header, args, reply interface{}, invoker ClientInvoker) error {
+	start := time.Now()
+	m.calls.Inc(h.ServiceMethod)
+	err := invoker(ctx, h, args, reply)
+	m.latency.Observe(time.Since(start).Seconds(), h.ServiceMethod)
+	if err != nil {
+		m.errors.Inc(h.ServiceMethod)
+	}
+	return err
+}
+
+// the following methods do nothing on a client that is not instrumented
+
+func (m *clientMetrics) retransmission(serviceMethod string) {
+	if m != nil {
+		m.retransmissions.Inc(serviceMethod)
+	}
+}
+
+func (m *clientMetrics) drop(reason string) {
+	if m != nil {
+		m.dropped.Inc(reason)
+	}
+}
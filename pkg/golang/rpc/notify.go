@@ -0,0 +1,129 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"distributed-file-system/pkg/golang/trace"
+)
+
+// serveNotification runs the method of a one-way notification, which is never answered.
+// The copies of a notification are dropped, unless its method is idempotent or duplicated requests are not filtered.
+func (server *Server) serveNotification(addr net.Addr, req *request) {
+	// the client is not waiting for an answer, so there is no one to tell to slow down
+	if _, ok := server.admit(addr, req); !ok {
+		server.logger.PrintfContext(req.ctx, "[INFO] rpc server: dropping notification %s from %s over the limits", req.h.ServiceMethod, addr)
+		server.metrics.Load().throttle(req.h.ServiceMethod)
+		return
+	}
+	var id string
+	if req.cacheable() {
+		server.trackSession(addr, req.h.Session)
+		id = requestId(addr, req.h)
+		if _, seen := server.notified.LoadOrStore(id, time.Now()); seen {
+			server.logger.PrintfContext(req.ctx, "[INFO] rpc server: duplicated notification %s, dropping it.", id)
+			server.metrics.Load().duplicate(req.h.ServiceMethod)
+			return
+		}
+	}
+	release, ok := server.acquire(req)
+	if !ok {
+		server.logger.PrintfContext(req.ctx, "[INFO] rpc server: dropping notification %s from %s over the concurrency cap", req.h.ServiceMethod, addr)
+		server.metrics.Load().throttle(req.h.ServiceMethod)
+		if id != "" {
+			server.notified.Delete(id) // a later copy may run it
+		}
+		return
+	}
+	defer release()
+	if err := server.call(addr, req); err != nil {
+		server.logger.PrintfContext(req.ctx, "[ERROR] rpc server: notification %s from %s failed: %v", req.h.ServiceMethod, addr, err)
+	}
+}
+
+// Notify sends a one-way notification: the server runs the method and sends no response, so Notify
+// returns as soon as the request is sent, with an error only if it could not be sent at all.
+// Notifications are not acknowledged, so lost ones are not retransmitted; to make up for losses the
+// request is sent attempts times, spaced out like the retransmissions of a call, and the server runs
+// the method once whatever the number of copies it receives. The notification is a span of the trace carried by ctx.
+func (client *Client) Notify(ctx context.Context, serviceMethod string, args interface{}, attempts int) error {
+	ctx, span := trace.StartSpan(ctx, serviceMethod, trace.KindClient)
+	client.mu.Lock()
+	interceptors, exporter := client.interceptors, client.exporter
+	client.mu.Unlock()
+	invoker := func(ctx context.Context, h *Header, args, _ interface{}) error {
+		return client.notify(ctx, h, args, attempts)
+	}
+	h := Header{ServiceMethod: serviceMethod, TraceId: span.TraceId, SpanId: span.SpanId, Notify: true}
+	err := chainClient(interceptors, invoker)(ctx, &h, args, nil)
+	span.End(exporter, err)
+	return err
+}
+
+// notify sends the first copy of a notification and schedules the others
+func (client *Client) notify(ctx context.Context, h *Header, args interface{}, attempts int) error {
+	client.mu.Lock()
+	if client.closing || client.shutdown {
+		client.mu.Unlock()
+		return ErrShutdown
+	}
+	header := *h
+	header.Seq = client.seq // the copies share the sequence number, so that the server tells them apart from new notifications
+	client.seq++
+	client.mu.Unlock()
+
+	// notifications wait for the handshake like calls, servers that predate notifications answer them like calls
+	select {
+	case <-client.ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := client.sendNotification(ctx, &header, args); err != nil {
+		return err
+	}
+	if attempts <= 1 {
+		return nil
+	}
+	policy := client.retryPolicyFor(header.ServiceMethod)
+	initial := client.initialBackoff(policy)
+	go func() {
+		for attempt := 1; attempt < attempts; attempt++ {
+			select {
+			case <-time.After(policy.backoff(initial, uint64(attempt))):
+			case <-ctx.Done():
+				return
+			}
+			if client.isClosing() {
+				return
+			}
+			client.metrics.Load().retransmission(header.ServiceMethod)
+			if err := client.sendNotification(ctx, &header, args); err != nil {
+				client.logger.PrintfContext(ctx, "[ERROR] rpc client: error sending notification %s seq %d again: %v", header.ServiceMethod, header.Seq, err)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (client *Client) sendNotification(ctx context.Context, h *Header, args interface{}) error {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+
+	header := *h
+	header.Version = uint16(client.version.Load())
+	header.Session = client.session
+	data, err := EncodeFrame(client.codec, &header, args)
+	if err != nil {
+		return err
+	}
+
+	// simulate packet loss
+	if !simulated(client.transport) && lost(ClientSideNetworkPacketLossProbability) {
+		client.logger.PrintfContext(ctx, "[INFO] rpc client: notification seq %d is sent but lost.", header.Seq)
+		client.metrics.Load().drop("simulated_loss")
+		return nil
+	}
+	return client.transport.WriteMessage(data, client.remote)
+}
@@ -0,0 +1,207 @@
+package rpc
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// default setting
+var (
+	ThrottleRetryAfter time.Duration = 50 * time.Millisecond // wait time suggested to the clients rejected for exceeding the concurrency cap
+)
+
+// RateLimit is a token bucket: requests are admitted at Rate per second on average,
+// with bursts of up to Burst requests. A zero Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ThrottledError is the error of a call the server kept rejecting for exceeding its limits
+type ThrottledError struct {
+	RetryAfter time.Duration // wait time suggested by the server in its last rejection
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("rpc client: throttled by the server, retry after %v", e.RetryAfter)
+}
+
+// ThrottledRequest is the body of the responses to the requests rejected for exceeding the limits of the server
+type ThrottledRequest struct {
+	Error      string
+	RetryAfter int64 // in nanoseconds
+}
+
+func init() {
+	RegisterType(ThrottledRequest{})
+}
+
+// throttledRequest returns the body of a throttled response, whichever way the codec decoded it
+func throttledRequest(body interface{}) (*ThrottledRequest, bool) {
+	switch t := body.(type) {
+	case *ThrottledRequest:
+		return t, true
+	case ThrottledRequest:
+		return &t, true
+	}
+	return nil, false
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token if there is one, otherwise it returns the time until there is one
+func (b *tokenBucket) take(limit RateLimit, now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	burst := float64(max(limit.Burst, 1))
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled, in which case it is as good as a new one
+func (b *tokenBucket) full(limit RateLimit, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(max(limit.Burst, 1))
+}
+
+// limits holds the rate limits of a server and the buckets of its clients
+type limits struct {
+	mu            sync.RWMutex         // protect following
+	client        RateLimit            // limit of every client, all methods together
+	methods       map[string]RateLimit // limit of every client for a single method, key: "<service>.<method>"
+	maxConcurrent int                  // cap on the requests executing at once, 0 means no cap
+	executing     int
+	buckets       sync.Map // key: bucketKey, value: *tokenBucket
+}
+
+type bucketKey struct {
+	client string
+	method string // empty for the bucket of all the methods
+}
+
+// SetClientRateLimit limits the requests of each client, whatever their methods.
+// Clients are told apart by the key they authenticate with, or else by their address.
+func (server *Server) SetClientRateLimit(limit RateLimit) {
+	server.limits.mu.Lock()
+	defer server.limits.mu.Unlock()
+	server.limits.client = limit
+}
+
+// SetMethodRateLimit limits the requests of each client for a single "Service.Method"
+func (server *Server) SetMethodRateLimit(serviceMethod string, limit RateLimit) {
+	server.limits.mu.Lock()
+	defer server.limits.mu.Unlock()
+	if server.limits.methods == nil {
+		server.limits.methods = make(map[string]RateLimit)
+	}
+	server.limits.methods[serviceMethod] = limit
+}
+
+// SetMaxConcurrentRequests caps the number of requests executing at once over every transport,
+// requests arriving over the cap are throttled. 0 removes the cap.
+func (server *Server) SetMaxConcurrentRequests(n int) {
+	server.limits.mu.Lock()
+	defer server.limits.mu.Unlock()
+	server.limits.maxConcurrent = n
+}
+
+// clientId identifies the client a request comes from for rate limiting
+func clientId(addr net.Addr) string {
+	if a, ok := addr.(*AuthAddr); ok {
+		return a.KeyId
+	}
+	return addr.String()
+}
+
+// admit checks the request against the rate limits of the server, which retransmissions count against too.
+// When it is not admitted, retryAfter tells the client when to try again.
+func (server *Server) admit(addr net.Addr, req *request) (retryAfter time.Duration, ok bool) {
+	if req.svc.rcvr.Interface() == server {
+		return 0, true // the built-in methods are cheap and needed to talk to the server at all
+	}
+	l := &server.limits
+	l.mu.RLock()
+	client, method := l.client, l.methods[req.h.ServiceMethod]
+	l.mu.RUnlock()
+	now := time.Now()
+	id := clientId(addr)
+	if method.Rate > 0 {
+		if ok, wait := l.bucket(bucketKey{id, req.h.ServiceMethod}).take(method, now); !ok {
+			return wait, false
+		}
+	}
+	if client.Rate > 0 {
+		if ok, wait := l.bucket(bucketKey{client: id}).take(client, now); !ok {
+			return wait, false
+		}
+	}
+	return 0, true
+}
+
+// acquire checks the request against the cap on the requests executing at once. Only the requests
+// about to run their method take a slot, those answered from the reply cache never execute.
+// When it is acquired, release must be called once the request has executed.
+func (server *Server) acquire(req *request) (release func(), ok bool) {
+	if req.svc.rcvr.Interface() == server {
+		return func() {}, true
+	}
+	l := &server.limits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxConcurrent > 0 && l.executing >= l.maxConcurrent {
+		return nil, false
+	}
+	l.executing++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.executing--
+	}, true
+}
+
+func (l *limits) bucket(key bucketKey) *tokenBucket {
+	v, _ := l.buckets.LoadOrStore(key, &tokenBucket{})
+	return v.(*tokenBucket)
+}
+
+// prune drops the buckets that have refilled, so that clients that are gone do not hold memory
+func (l *limits) prune() {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	now := time.Now()
+	l.buckets.Range(func(key, value interface{}) bool {
+		limit := l.client
+		if method := key.(bucketKey).method; method != "" {
+			limit = l.methods[method]
+		}
+		if limit.Rate <= 0 || value.(*tokenBucket).full(limit, now) {
+			l.buckets.Delete(key)
+		}
+		return true
+	})
+}
+
+// throttle tells the client to send the request again after retryAfter
+func (server *Server) throttle(transport Transport, addr net.Addr, req *request, retryAfter time.Duration) {
+	server.logger.PrintfContext(req.ctx, "[INFO] rpc server: throttling %s from %s, retry after %v", req.h.ServiceMethod, addr, retryAfter)
+	server.metrics.Load().throttle(req.h.ServiceMethod)
+	req.h.Error = fmt.Sprintf("rpc server: %s throttled, retry after %v", req.h.ServiceMethod, retryAfter)
+	server.sendResponse(transport, addr, req.codec, req.h, &ThrottledRequest{Error: req.h.Error, RetryAfter: int64(retryAfter)})
+}
@@ -0,0 +1,126 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MaxDecodeDepth bounds how deeply nested values may be, so that a crafted
+// message can not exhaust the stack of the decoding goroutine
+const MaxDecodeDepth = 32
+
+// errors returned when decoding malformed messages
+var (
+	ErrTruncated     = errors.New("rpc codec: message is truncated")
+	ErrTrailingData  = errors.New("rpc codec: unexpected data after the end of the message")
+	ErrInvalidLength = errors.New("rpc codec: invalid value length")
+	ErrTooDeep       = errors.New("rpc codec: value is nested too deeply")
+	ErrChecksum      = errors.New("rpc codec: checksum mismatch, the message is corrupted")
+)
+
+// UnknownTypeError is returned when the body carries a type that has not been registered
+type UnknownTypeError struct {
+	Name string
+}
+
+func (e *UnknownTypeError) Error() string {
+	return fmt.Sprintf("rpc codec: unable to find custom type %q", e.Name)
+}
+
+// UnknownFieldError is returned when the body carries a field that the type does not have
+type UnknownFieldError struct {
+	Type  string
+	Field string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("rpc codec: unknown field %q in %s", e.Field, e.Type)
+}
+
+// TypeMismatchError is returned when the wire type of a field differs from the local one
+type TypeMismatchError struct {
+	Field string
+	Got   string // type found on the wire
+	Want  string // type of the local field
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("rpc codec: field %s: type mismatch, got %s, expecting %s", e.Field, e.Got, e.Want)
+}
+
+// labReader reads a LabCodec message, checking every length
+// against the remaining data before slicing it
+type labReader struct {
+	data []byte
+	off  int
+}
+
+func newLabReader(data []byte) *labReader {
+	return &labReader{data: data}
+}
+
+func (r *labReader) remaining() int { return len(r.data) - r.off }
+
+func (r *labReader) next(n uint64) ([]byte, error) {
+	if n > uint64(r.remaining()) {
+		return nil, ErrTruncated
+	}
+	b := r.data[r.off : r.off+int(n)]
+	r.off += int(n)
+	return b, nil
+}
+
+func (r *labReader) uint16() (uint16, error) {
+	b, err := r.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+func (r *labReader) uint32() (uint32, error) {
+	b, err := r.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (r *labReader) uint64() (uint64, error) {
+	b, err := r.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// chunk reads a 4 bytes length prefix followed by that many bytes
+func (r *labReader) chunk() ([]byte, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	return r.next(uint64(n))
+}
+
+// count reads the number of elements of a collection, each of which
+// takes at least minSize bytes, and rejects counts the data can not hold
+func (r *labReader) count(minSize int) (int, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return 0, err
+	}
+	if uint64(n)*uint64(minSize) > uint64(r.remaining()) {
+		return 0, ErrTruncated
+	}
+	return int(n), nil
+}
+
+// done makes sure that all data has been consumed
+func (r *labReader) done() error {
+	if r.remaining() != 0 {
+		return ErrTrailingData
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"distributed-file-system/pkg/golang/logger"
+)
+
+// default setting
+var (
+	ReplyLogCompactionThreshold int = 1000 // least number of records in the log before it is compacted
+)
+
+// replyLog persists the reply cache of a server as an append-only file,
+// so that a restarted server still recognizes retransmitted requests.
+// Every record is [record length][request id][timestamp][reply body],
+// the reply being encoded with LabCodec.
+type replyLog struct {
+	mu      sync.Mutex // protect following
+	path    string
+	file    *os.File
+	records int // number of records in the file, including the stale ones
+	logger  *logger.Logger
+}
+
+// openReplyLog loads the unexpired replies of the log at path into cache,
+// compacts the log and opens it for appending
+func openReplyLog(path string, cache *sync.Map, logger *logger.Logger) (*replyLog, error) {
+	l := &replyLog{path: path, logger: logger}
+	if err := l.load(cache); err != nil {
+		return nil, err
+	}
+	if err := l.compact(cache); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *replyLog) load(cache *sync.Map) error {
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	loaded := 0
+	for {
+		id, c, err := readReplyRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// most likely the server crashed in the middle of appending the last record
+			l.logger.Printf("[ERROR] rpc server: reply log %s: dropping the rest of the log: %v", l.path, err)
+			break
+		}
+		if time.Since(c.timestamp) > CacheValidityPeriod {
+			continue
+		}
+		cache.Store(id, c)
+		loaded++
+	}
+	l.logger.Printf("[INFO] rpc server: reply log %s: %d cached replies loaded", l.path, loaded)
+	return nil
+}
+
+func readReplyRecord(r io.Reader) (string, *cachedResponse, error) {
+	data, err := readFrame(r)
+	if err == io.ErrUnexpectedEOF {
+		return "", nil, ErrTruncated
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	lr := newLabReader(data)
+	id, err := lr.chunk()
+	if err != nil {
+		return "", nil, err
+	}
+	timestamp, err := lr.uint64()
+	if err != nil {
+		return "", nil, err
+	}
+	body, err := lr.chunk()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := lr.done(); err != nil {
+		return "", nil, err
+	}
+	reply, err := new(LabCodec).DecodeBody(body)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(id), &cachedResponse{time.Unix(0, int64(timestamp)), reflect.ValueOf(reply)}, nil
+}
+
+func encodeReplyRecord(id string, c *cachedResponse) ([]byte, error) {
+	body, err := new(LabCodec).EncodeBody(c.replyv.Interface())
+	if err != nil {
+		return nil, err
+	}
+	var record bytes.Buffer
+	encodeString(&record, id)
+	record.Write(binary.LittleEndian.AppendUint64(nil, uint64(c.timestamp.UnixNano())))
+	record.Write(body)
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(record.Len())), record.Bytes()...), nil
+}
+
+// append writes the reply to the disk before it is sent to the client
+func (l *replyLog) append(id string, c *cachedResponse) error {
+	record, err := encodeReplyRecord(id, c)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return ErrShutdown
+	}
+	if _, err := l.file.Write(record); err != nil {
+		return err
+	}
+	l.records++
+	return l.file.Sync()
+}
+
+// compact rewrites the log with the unexpired replies of the cache only
+func (l *replyLog) compact(cache *sync.Map) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tmp := l.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	records := 0
+	cache.Range(func(key, value interface{}) bool {
+		c := value.(*cachedResponse)
+		if time.Since(c.timestamp) > CacheValidityPeriod {
+			return true
+		}
+		var record []byte
+		if record, err = encodeReplyRecord(key.(string), c); err != nil {
+			return false
+		}
+		if _, err = w.Write(record); err != nil {
+			return false
+		}
+		records++
+		return true
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("rpc server: compacting reply log %s: %v", l.path, err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	if l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	l.records = records
+	return nil
+}
+
+func (l *replyLog) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.records
+}
+
+func (l *replyLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// EnableReplyLog makes the reply cache durable by logging it to the file at path.
+// Unexpired replies logged by a previous run of the server are loaded first,
+// so that retransmissions of requests it had executed are not executed again.
+// It must be called before the server starts serving.
+func (server *Server) EnableReplyLog(path string) error {
+	l, err := openReplyLog(path, &server.processed, server.logger)
+	if err != nil {
+		return err
+	}
+	server.replyLog = l
+	return nil
+}
+
+// logReply persists a cached reply if the reply log is enabled
+func (server *Server) logReply(id string, c *cachedResponse) {
+	if server.replyLog == nil {
+		return
+	}
+	if err := server.replyLog.append(id, c); err != nil {
+		server.logger.Printf("[ERROR] rpc server: reply log: %v", err)
+		return
+	}
+	records := server.replyLog.size()
+	if records < ReplyLogCompactionThreshold {
+		return
+	}
+	live := 0
+	server.processed.Range(func(key, value interface{}) bool {
+		live++
+		return true
+	})
+	// compact once most of the records are stale
+	if records > 2*live {
+		if err := server.replyLog.compact(&server.processed); err != nil {
+			server.logger.Printf("[ERROR] rpc server: %v", err)
+		}
+	}
+}
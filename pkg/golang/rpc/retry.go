@@ -0,0 +1,139 @@
+package rpc
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides when and how often a call is retransmitted
+type RetryPolicy struct {
+	MaxAttempts    uint64        // total number of transmissions of a call, math.MaxUint64 retries until success
+	InitialBackoff time.Duration // wait time before the first retransmission
+	MaxBackoff     time.Duration // upper bound of the wait time, 0 means unbounded
+	Multiplier     float64       // growth factor of the wait time after each retransmission
+	Jitter         float64       // fraction of the wait time that is randomized, e.g. 0.2 means ±20%
+	Adaptive       bool          // replace InitialBackoff with the measured RTO once there is one
+}
+
+// DefaultRetryPolicy starts retransmitting after the RTO measured for the server,
+// or after Timeout until there is a measurement, backs off exponentially
+// up to 8 times Timeout and gives up after RetryLimit attempts.
+// It reads the package level settings, so they must be set before dialing.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    RetryLimit,
+		InitialBackoff: Timeout,
+		MaxBackoff:     8 * Timeout,
+		Multiplier:     2,
+		Jitter:         0.1,
+		Adaptive:       true,
+	}
+}
+
+// backoff returns the wait time after the given number of transmissions,
+// starting from initial. A measured initial wait time larger than MaxBackoff raises the bound.
+func (p RetryPolicy) backoff(initial time.Duration, attempts uint64) time.Duration {
+	b := float64(initial)
+	if attempts > 1 && p.Multiplier > 1 {
+		b *= math.Pow(p.Multiplier, float64(attempts-1))
+	}
+	if limit := max(p.MaxBackoff, initial); p.MaxBackoff > 0 && b > float64(limit) {
+		b = float64(limit)
+	}
+	if p.Jitter > 0 {
+		b += b * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(b)
+}
+
+// SetRetryPolicy sets the retry policy of the calls made after it,
+// except for the methods that have a policy of their own
+func (client *Client) SetRetryPolicy(policy RetryPolicy) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.retryPolicy = policy
+}
+
+// SetMethodRetryPolicy overrides the retry policy for a single "Service.Method"
+func (client *Client) SetMethodRetryPolicy(serviceMethod string, policy RetryPolicy) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.methodRetryPolicies[serviceMethod] = policy
+}
+
+func (client *Client) retryPolicyFor(serviceMethod string) RetryPolicy {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if policy, ok := client.methodRetryPolicies[serviceMethod]; ok {
+		return policy
+	}
+	return client.retryPolicy
+}
+
+// scheduleRetry arms the timer that retransmits the call
+// if no reply has arrived once its backoff has elapsed
+func (client *Client) scheduleRetry(call *Call) {
+	client.armRetry(call, client.backoff(call))
+}
+
+// backoff returns the wait time of the call before its next retransmission
+func (client *Client) backoff(call *Call) time.Duration {
+	return call.policy.backoff(client.initialBackoff(call.policy), call.Attempts.Load())
+}
+
+// initialBackoff returns the wait time before the first retransmission under the policy
+func (client *Client) initialBackoff(policy RetryPolicy) time.Duration {
+	if rto, ok := client.rtt.rto(); ok && policy.Adaptive {
+		return rto
+	}
+	return policy.InitialBackoff
+}
+
+func (client *Client) armRetry(call *Call, wait time.Duration) {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+	if call.timer != nil {
+		call.timer.Stop()
+	}
+	call.timer = time.AfterFunc(wait, func() { client.retry(call.Seq) })
+}
+
+// retry retransmits a call that is still waiting for its reply
+func (client *Client) retry(seq uint64) {
+	v, ok := client.pending.Load(seq)
+	if !ok {
+		return // the call has completed in the meantime
+	}
+	call := v.(*Call)
+	if call.Attempts.Load() >= call.policy.MaxAttempts {
+		if call := client.removeCall(seq); call != nil {
+			call.Error = fmt.Errorf("rpc client packet %d lost due to poor internet connection", seq)
+			call.done()
+		}
+		return
+	}
+	client.metrics.Load().retransmission(call.ServiceMethod)
+	client.send(seq, call)
+}
+
+// backOff handles a response telling that the server throttled the call: the call is retransmitted
+// as its retry policy says, but not before retryAfter. The call fails with a ThrottledError
+// once it has used up its attempts.
+func (client *Client) backOff(seq uint64, retryAfter time.Duration) {
+	v, ok := client.pending.Load(seq)
+	if !ok {
+		return
+	}
+	call := v.(*Call)
+	client.logger.PrintfContext(call.ctx, "[INFO] rpc client: %s seq %d throttled by the server, retrying after %v", call.ServiceMethod, seq, retryAfter)
+	if call.Attempts.Load() >= call.policy.MaxAttempts {
+		if call := client.removeCall(seq); call != nil {
+			call.Error = &ThrottledError{RetryAfter: retryAfter}
+			call.done()
+		}
+		return
+	}
+	client.armRetry(call, max(retryAfter, client.backoff(call)))
+}
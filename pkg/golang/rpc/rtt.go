@@ -0,0 +1,136 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// default setting
+var (
+	MinRetransmissionTimeout time.Duration = 5 * time.Millisecond // lower bound of the measured RTO
+	MaxRetransmissionTimeout time.Duration = 10 * time.Second     // upper bound of the measured RTO
+	PingSamples              int           = 3                    // number of pings sent to seed the estimate of a new client
+)
+
+// rttEstimator keeps a smoothed round trip time and its variance
+// and derives the retransmission timeout from them, as TCP does (RFC 6298)
+type rttEstimator struct {
+	mu        sync.Mutex
+	measured  bool          // at least one sample has been taken
+	srtt      time.Duration // smoothed round trip time
+	rttvar    time.Duration // round trip time variation
+	backedOff time.Duration // timeout kept since the last calls were retransmitted, 0 once a sample is taken
+}
+
+// estimates are shared by all clients talking to the same server address
+var rttEstimators sync.Map // key: server address, value: *rttEstimator
+
+func rttEstimatorFor(addr string) *rttEstimator {
+	v, _ := rttEstimators.LoadOrStore(addr, &rttEstimator{})
+	return v.(*rttEstimator)
+}
+
+func (e *rttEstimator) sample(rtt time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.backedOff = 0
+	if !e.measured {
+		e.measured = true
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		return
+	}
+	delta := e.srtt - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+	e.rttvar = (3*e.rttvar + delta) / 4
+	e.srtt = (7*e.srtt + rtt) / 8
+}
+
+// backOff doubles the timeout after a call was retransmitted, initial being the timeout the call started with.
+// The doubled timeout is kept until a call is answered without being retransmitted, which gives a sample again:
+// otherwise, on a network slower than the timeout, every call would be retransmitted and none of them sampled.
+func (e *rttEstimator) backOff(initial time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.backedOff = min(2*max(e.backedOff, initial), MaxRetransmissionTimeout)
+}
+
+// rto returns the retransmission timeout, false if nothing has been measured yet
+func (e *rttEstimator) rto() (time.Duration, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.measured && e.backedOff == 0 {
+		return 0, false
+	}
+	rto := e.backedOff
+	if e.measured {
+		rto = max(rto, e.srtt+4*e.rttvar)
+	}
+	return min(max(rto, MinRetransmissionTimeout), MaxRetransmissionTimeout), true
+}
+
+// RTO returns the retransmission timeout currently derived for the server,
+// or the initial backoff of the default retry policy if no round trip has been measured yet
+func (client *Client) RTO() time.Duration {
+	if rto, ok := client.rtt.rto(); ok {
+		return rto
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.retryPolicy.InitialBackoff
+}
+
+// observe feeds the round trip time of a completed call into the estimate.
+// Following Karn's algorithm, retransmitted calls are not sampled since
+// it is unknown which of the transmissions the reply belongs to, the timeout is backed off instead.
+func (client *Client) observe(call *Call) {
+	if call.Attempts.Load() != 1 {
+		if call.policy.Adaptive {
+			client.rtt.backOff(client.initialBackoff(call.policy))
+		}
+		return
+	}
+	call.mu.Lock()
+	rtt := time.Since(call.LastTryTimestamp)
+	call.mu.Unlock()
+	client.rtt.sample(rtt)
+}
+
+type PingRequest struct{}
+
+type PingResponse struct{}
+
+func init() {
+	RegisterType(PingRequest{})
+	RegisterType(PingResponse{})
+}
+
+// Ping does nothing, it lets clients measure the round trip time
+func (server *Server) Ping(req PingRequest, resp *PingResponse) error {
+	return nil
+}
+
+// Ping calls Server.Ping and returns the round trip time
+func (client *Client) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	var reply PingResponse
+	if err := client.CallContext(ctx, "Server.Ping", &PingRequest{}, &reply); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// seedRTT pings a freshly dialed server so that the first calls
+// already use a measured retransmission timeout
+func (client *Client) seedRTT() {
+	for i := 0; i < PingSamples; i++ {
+		if _, err := client.Ping(context.Background()); err != nil {
+			client.logger.Printf("[INFO] rpc client: ping %s failed: %v", client.remote, err)
+			return
+		}
+	}
+	client.logger.Printf("[INFO] rpc client: retransmission timeout for %s is %v", client.remote, client.RTO())
+}
@@ -1,13 +1,16 @@
 package rpc
 
 import (
+	"context"
 	"distributed-file-system/pkg/golang/logger"
+	"distributed-file-system/pkg/golang/trace"
 	"fmt"
 	"math/rand"
 	"net"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,33 +19,61 @@ var (
 	FilterDuplicatedRequest                bool          = true
 	CacheValidityPeriod                    time.Duration = 3 * time.Minute
 	ServerSideNetworkPacketLossProbability int           = 50
+	ServerWorkers                          int           = 16          // requests served at the same time by each Accept
+	ServerQueueSize                        int           = 1024        // requests waiting for a worker before further ones are dropped
+	CacheCleanUpInterval                   time.Duration = time.Second // how often expired replies are dropped from the cache
 	randomNumberGenerator                                = rand.New(rand.NewSource(50))
 )
 
+var lossMu sync.Mutex // randomNumberGenerator is shared by the clients and servers of the process
+
+// lost draws whether a message is lost to the simulated network, probability being in percent
+func lost(probability int) bool {
+	lossMu.Lock()
+	defer lossMu.Unlock()
+	return randomNumberGenerator.Intn(100) < probability
+}
+
 // Server represents an RPC Server.
 type Server struct {
-	receiving  sync.Mutex // guard for receiving
-	sending    sync.Mutex // guard for sending
-	mu         sync.Mutex
-	cc         Codec
-	serviceMap sync.Map // to store the registered service
-	processed  sync.Map // processed message store
-	close      chan struct{}
-	logger     *logger.Logger
+	sending      sync.Mutex // guard for writing to the transport
+	mu           sync.Mutex // protect interceptors
+	serviceMap   sync.Map   // to store the registered service
+	processed    sync.Map   // processed message store
+	notified     sync.Map   // notifications served, key: request id, value: time.Time served at
+	inflight     sync.Map   // requests being served, key: request id, value: *inflightRequest
+	sessions     sync.Map   // latest session seen from each client address
+	peers        sync.Map   // clients calling the peers back over the transports of the server, key: peerKey, value: *Client
+	rebound      sync.Map   // latest connection of each session, key: session, value: *peer
+	replyLog     *replyLog  // durable copy of processed, nil unless enabled
+	interceptors []ServerInterceptor
+	exporter     trace.Exporter // exports the spans of the requests, nil unless set
+	limits       limits
+	metrics      atomic.Pointer[serverMetrics] // nil unless instrumented
+	close        chan struct{}
+	closeOnce    sync.Once
+	logger       *logger.Logger
 }
 
 // NewServer returns a new Server.
 func NewServer(logger *logger.Logger) *Server {
-	codecFunc := NewCodecFuncMap[DefaultCodecType]
 	s := &Server{
-		cc:     codecFunc(),
 		close:  make(chan struct{}),
 		logger: logger,
 	}
+	// the server serves its own built-in methods, e.g. Server.Handshake
+	if err := s.Register(s); err != nil {
+		panic(fmt.Sprintf("rpc server: register error: %v", err))
+	}
 	go s.backgroundCleanUp()
 	return s
 }
 
+// IdempotentMethods lists the built-in methods of the server, which all can safely run again
+func (server *Server) IdempotentMethods() []string {
+	return []string{"Handshake", "Ping"}
+}
+
 // Register publishes in the server the set of methods of the
 func (server *Server) Register(rcvr interface{}) error {
 	s, err := newService(rcvr)
@@ -75,65 +106,177 @@ func (server *Server) findService(serviceMethod string) (svc *service, mtype *me
 	return
 }
 
-// Accept accepts connections on the listener and serves requests
-// for each incoming connection.
-func (server *Server) Accept(conn *net.UDPConn) {
+// message is a message waiting for a worker
+type message struct {
+	addr net.Addr
+	data []byte
+}
+
+// Accept accepts messages on the transport and serves them with a pool of
+// ServerWorkers goroutines. Messages arriving while ServerQueueSize messages
+// are waiting are dropped, the clients retransmit them like lost messages.
+func (server *Server) Accept(transport Transport) {
+	queue := make(chan message, ServerQueueSize)
+	defer close(queue)
+	for i := 0; i < ServerWorkers; i++ {
+		go func() {
+			for m := range queue {
+				server.ServeConn(transport, m.addr, m.data)
+			}
+		}()
+	}
 	for {
 		select {
 		case <-server.close:
 			server.logger.Printf("[INFO] rpc server: closing connection...")
 			return
 		default:
-			buf := make([]byte, MaxBufferSize)
-			n, addr, err := conn.ReadFromUDP(buf)
+			data, addr, err := transport.ReadMessage()
 			if err != nil {
-				server.logger.Printf("[ERROR] rpc server: read udp error: %V", err)
+				server.logger.Printf("[ERROR] rpc server: read error: %v", err)
 				return
 			}
-			go server.ServeConn(conn, addr, buf[:n])
+			if isResponse(data) {
+				// the responses of the peers the server calls back skip the queue, the workers may all be waiting for them
+				server.serveResponse(transport, addr, data)
+				continue
+			}
+			select {
+			case queue <- message{addr: addr, data: data}:
+			default:
+				server.logger.Printf("[ERROR] rpc server: too many pending requests, dropping message from %s", addr)
+				server.metrics.Load().drop("queue_full")
+			}
 		}
 	}
 }
 
-// ServeConn runs the server on a single connection.
-// ServeConn blocks, serving the connection until the client hangs up.
-func (server *Server) ServeConn(conn *net.UDPConn, addr *net.UDPAddr, data []byte) {
+// ServeConn serves a single request received from addr
+// and writes the response back over the transport.
+func (server *Server) ServeConn(transport Transport, addr net.Addr, data []byte) {
 
 	req, err := server.readRequest(data)
 	if err != nil {
 		if req == nil {
+			server.metrics.Load().drop("undecodable")
 			return // it's not possible to recover, so close the connection
 		}
 		req.h.Error = err.Error()
-		server.sendResponse(conn, addr, req.h, invalidRequest)
+		server.sendResponse(transport, addr, req.codec, req.h, &InvalidRequest{Error: req.h.Error})
+		return
+	}
+	if req.h.Response {
+		server.serveResponse(transport, addr, data)
+		return
+	}
+	if req.batch != nil {
+		server.serveBatch(transport, addr, req)
+		return
+	}
+	req.ctx = server.withPeer(req.ctx, transport, addr, req.h)
+	if req.h.Notify {
+		server.serveNotification(addr, req)
 		return
 	}
-
-	server.mu.Lock()
-	defer server.mu.Unlock()
 
 	// log.Printf("rpc server: packet seq %d from %s has been received\n", req.h.Seq)
+	// retransmissions count against the rate limits too, a client flooding the server has to slow down whatever it sends
+	if retryAfter, ok := server.admit(addr, req); !ok {
+		server.throttle(transport, addr, req, retryAfter)
+		return
+	}
+	if !req.cacheable() {
+		release, ok := server.acquire(req)
+		if !ok {
+			server.throttle(transport, addr, req, ThrottleRetryAfter)
+			return
+		}
+		defer release()
+		server.handleRequest(transport, addr, req)
+		return
+	}
 	// check for request duplication
-	if FilterDuplicatedRequest {
-		id := fmt.Sprintf("%s-%d", addr.String(), req.h.Seq)
-		v, ok := server.processed.Load(id)
-		if ok {
-			// exists
-			server.logger.Printf("[INFO] rpc server: duplicated request %s, sending from cached result.\n", id)
-			c := v.(*cachedResponse)
-			server.sendResponse(conn, addr, req.h, c.replyv.Interface())
+	server.trackSession(addr, req.h.Session)
+	id := requestId(addr, req.h)
+	if server.replyFromCache(transport, addr, req, id) {
+		return
+	}
+	// a retransmission of a request that is still being served is answered with the outcome
+	// of the original once it is served, instead of running the method again
+	f := &inflightRequest{done: make(chan struct{})}
+	if v, loaded := server.inflight.LoadOrStore(id, f); loaded {
+		v.(*inflightRequest).await(transport, addr, req)
+		return
+	}
+	var respond responder // answers the retransmissions, which are dropped if the method panics
+	defer func() {
+		server.inflight.Delete(id)
+		f.finish(respond)
+	}()
+	// the original may have completed between the lookup and LoadOrStore
+	if server.replyFromCache(transport, addr, req, id) {
+		respond = func(transport Transport, addr net.Addr, req *request) {
+			server.replyFromCache(transport, addr, req, id)
+		}
+		return
+	}
+	release, ok := server.acquire(req)
+	if !ok {
+		respond = func(transport Transport, addr net.Addr, req *request) {
+			server.throttle(transport, addr, req, ThrottleRetryAfter)
+		}
+		respond(transport, addr, req)
+		return
+	}
+	defer release()
+	reply, err := server.handleRequest(transport, addr, req)
+	respond = func(transport Transport, addr net.Addr, req *request) {
+		server.logger.PrintfContext(req.ctx, "[INFO] rpc server: duplicated request %s, sending the outcome of the request in progress.\n", id)
+		server.metrics.Load().duplicate(req.h.ServiceMethod)
+		if err != nil {
+			req.h.Error = err.Error()
+			server.sendResponse(transport, addr, req.codec, req.h, &InvalidRequest{Error: req.h.Error})
 			return
 		}
+		server.sendResponse(transport, addr, req.codec, req.h, reply)
 	}
-	server.handleRequest(conn, addr, req)
+}
+
+// replyFromCache answers a retransmitted request with the cached reply, false if there is none
+func (server *Server) replyFromCache(transport Transport, addr net.Addr, req *request, id string) bool {
+	v, ok := server.processed.Load(id)
+	if !ok {
+		return false
+	}
+	server.logger.PrintfContext(req.ctx, "[INFO] rpc server: duplicated request %s, sending from cached result.\n", id)
+	server.metrics.Load().duplicate(req.h.ServiceMethod)
+	c := v.(*cachedResponse)
+	server.sendResponse(transport, addr, req.codec, req.h, c.replyv.Interface())
+	return true
 }
 
 func (server *Server) Shutdown() {
-	server.close <- struct{}{}
+	server.closeOnce.Do(func() {
+		close(server.close)
+		if server.replyLog != nil {
+			server.replyLog.close()
+		}
+		server.peers.Range(func(key, value interface{}) bool {
+			value.(*Client).Close()
+			return true
+		})
+	})
+}
+
+// InvalidRequest is the body of the responses carrying an error. Every codec
+// needs a registered type with an exported field to encode and decode the body.
+type InvalidRequest struct {
+	Error string
 }
 
-// invalidRequest is a placeholder for response argv when error occurs
-var invalidRequest = struct{}{}
+func init() {
+	RegisterType(InvalidRequest{})
+}
 
 // request stores all information of a call
 type request struct {
@@ -141,6 +284,106 @@ type request struct {
 	argv, replyv reflect.Value // argv and replyv of request
 	mtype        *methodType   // type of request
 	svc          *service
+	codec        Type            // codec the request is encoded with, the response uses the same
+	ctx          context.Context // carries the trace of the client
+	batch        *BatchRequest   // requests of a batch message, nil for any other request
+}
+
+// requestId identifies a request for deduplication. Requests of clients that
+// send their session are keyed on it, since the sequence numbers of a client
+// restart from 1 whenever it is restarted, possibly on the same address.
+func requestId(addr net.Addr, h *Header) string {
+	if h.Session != 0 {
+		return fmt.Sprintf("%x-%d", h.Session, h.Seq)
+	}
+	return fmt.Sprintf("%s-%d", addr.String(), h.Seq)
+}
+
+// trackSession drops the cached replies of the previous incarnation
+// of the client at addr once a new incarnation shows up
+func (server *Server) trackSession(addr net.Addr, session uint64) {
+	if session == 0 {
+		return
+	}
+	v, loaded := server.sessions.Swap(addr.String(), session)
+	if !loaded || v.(uint64) == session {
+		return
+	}
+	server.logger.Printf("[INFO] rpc server: client %s restarted, dropping the replies cached for its previous session %x", addr, v)
+	prefixes := []string{fmt.Sprintf("%x-", v), addr.String() + "-"}
+	for _, m := range []*sync.Map{&server.processed, &server.notified} {
+		m.Range(func(key, value interface{}) bool {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(key.(string), prefix) {
+					m.Delete(key)
+				}
+			}
+			return true
+		})
+	}
+}
+
+// cacheable reports whether the reply is cached to filter out retransmissions of the request.
+// Idempotent methods can simply run again, so their replies are never cached.
+func (req *request) cacheable() bool {
+	return FilterDuplicatedRequest && !req.mtype.Idempotent
+}
+
+// inflightRequest is a request being served. Its retransmissions arriving meanwhile wait on it
+// without holding a worker, the worker serving the original answers them all once it is served.
+// A retransmission in a batch is the exception, see await.
+type inflightRequest struct {
+	done       chan struct{} // closed once the request is served
+	mu         sync.Mutex    // protect following
+	served     bool
+	respond    responder // answers a retransmission with the outcome of the request, nil to drop it
+	duplicates []duplicate
+}
+
+// responder answers a request
+type responder func(transport Transport, addr net.Addr, req *request)
+
+// duplicate is a retransmission waiting for the outcome of the in-flight request
+type duplicate struct {
+	transport Transport
+	addr      net.Addr
+	req       *request
+}
+
+// await answers the retransmission once the request is served, right away if it already is.
+// The response to a retransmission in a batch must be written before the batch response is packed,
+// so the batch waits for the request to be served instead of leaving the answer to the original.
+func (f *inflightRequest) await(transport Transport, addr net.Addr, req *request) {
+	if _, batched := transport.(*batchCollector); batched {
+		<-f.done
+	}
+	f.mu.Lock()
+	if !f.served {
+		f.duplicates = append(f.duplicates, duplicate{transport, addr, req})
+		f.mu.Unlock()
+		return
+	}
+	respond := f.respond
+	f.mu.Unlock()
+	if respond != nil {
+		respond(transport, addr, req)
+	}
+}
+
+// finish records how to answer the retransmissions and answers those that have been waiting
+func (f *inflightRequest) finish(respond responder) {
+	f.mu.Lock()
+	f.served, f.respond = true, respond
+	duplicates := f.duplicates
+	f.duplicates = nil
+	f.mu.Unlock()
+	close(f.done)
+	if respond == nil {
+		return
+	}
+	for _, d := range duplicates {
+		respond(d.transport, d.addr, d.req)
+	}
 }
 
 type cachedResponse struct {
@@ -149,23 +392,52 @@ type cachedResponse struct {
 }
 
 func (server *Server) readRequest(data []byte) (*request, error) {
-	server.receiving.Lock()
-	defer server.receiving.Unlock()
 	var m Message
-	err := server.cc.Decode(data, &m)
+	codec, err := DecodeFrame(data, &m)
 	if err != nil {
 		server.logger.Printf("[] server readRequest: decode error: %v", err)
 		return nil, err
 	}
 
-	req := &request{h: &m.Header}
+	req := &request{h: &m.Header, codec: codec, ctx: requestContext(&m.Header)}
+	if m.Header.Response {
+		// a response of a peer to a call of the server, it is never answered, not even with an error
+		return req, nil
+	}
+	if err := checkVersion(req.h); err != nil {
+		return req, err
+	}
+	if m.Header.ServiceMethod == batchMethod {
+		batch, ok := batchRequest(m.Body)
+		if !ok {
+			return req, fmt.Errorf("rpc server: invalid batch body %T", m.Body)
+		}
+		req.batch = batch
+		return req, nil
+	}
 	req.svc, req.mtype, err = server.findService(m.Header.ServiceMethod)
 	if err != nil {
 		return req, err
 	}
 
+	if req.mtype.Notify && !m.Header.Notify {
+		return req, fmt.Errorf("rpc server: %s only serves notifications", m.Header.ServiceMethod)
+	}
+	if m.Body == nil {
+		return req, fmt.Errorf("rpc server: missing argument for %s", m.Header.ServiceMethod)
+	}
+	argType := req.mtype.ArgType
+	if argType.Kind() == reflect.Ptr {
+		argType = argType.Elem()
+	}
+	if bodyType := reflect.Indirect(reflect.ValueOf(m.Body)).Type(); bodyType != argType {
+		return req, fmt.Errorf("rpc server: invalid argument type %s for %s, expecting %s", bodyType, m.Header.ServiceMethod, argType)
+	}
+
 	req.argv = req.mtype.newArgv()
-	req.replyv = req.mtype.newReplyv()
+	if !req.mtype.Notify {
+		req.replyv = req.mtype.newReplyv()
+	}
 	// make sure that argvi is a pointer, ReadBody need a pointer as parameter
 	argvi := req.argv.Interface()
 	if req.argv.Type().Kind() != reflect.Ptr {
@@ -175,47 +447,63 @@ func (server *Server) readRequest(data []byte) (*request, error) {
 	return req, nil
 }
 
-func (server *Server) handleRequest(conn *net.UDPConn, addr *net.UDPAddr, req *request) {
-	err := req.svc.call(req.mtype, req.argv, req.replyv)
+// handleRequest runs the method of the request, sends the response and returns the reply
+func (server *Server) handleRequest(transport Transport, addr net.Addr, req *request) (interface{}, error) {
+	err := server.call(addr, req)
 	if err != nil {
 		req.h.Error = err.Error()
-		server.sendResponse(conn, addr, req.h, invalidRequest)
-		return
+		server.sendResponse(transport, addr, req.codec, req.h, &InvalidRequest{Error: req.h.Error})
+		return nil, err
 	}
 	// store the request result
-	id := fmt.Sprintf("%s-%d", addr.String(), req.h.Seq)
-	server.processed.Store(id, &cachedResponse{time.Now(), req.replyv})
-	server.sendResponse(conn, addr, req.h, req.replyv.Interface())
+	if req.cacheable() {
+		id := requestId(addr, req.h)
+		c := &cachedResponse{time.Now(), req.replyv}
+		server.processed.Store(id, c)
+		server.logReply(id, c)
+	}
+	reply := req.replyv.Interface()
+	server.sendResponse(transport, addr, req.codec, req.h, reply)
+	return reply, nil
 }
 
-func (server *Server) sendResponse(conn *net.UDPConn, addr *net.UDPAddr, h *Header, body interface{}) {
-	server.sending.Lock()
-	defer server.sending.Unlock()
-	data, err := server.cc.Encode(h, body)
+func (server *Server) sendResponse(transport Transport, addr net.Addr, codec Type, h *Header, body interface{}) {
+	h.Response = true
+	data, err := EncodeFrame(codec, h, body)
 	if err != nil {
-		server.logger.Printf("[ERROR] rpc server: encode response error: %v", err)
+		server.logger.PrintfContext(requestContext(h), "[ERROR] rpc server: encode response error: %v", err)
 		return
 	}
+	server.writeResponse(transport, addr, h, data)
+}
 
-	// simulate packet loss
-	if randomNumberGenerator.Intn(100) < ServerSideNetworkPacketLossProbability {
-		server.logger.Printf("[INFO] rpc server: packet %s is sent but lost.", fmt.Sprintf("%s-%d", addr.String(), h.Seq))
+// writeResponse writes an encoded response over the transport
+func (server *Server) writeResponse(transport Transport, addr net.Addr, h *Header, data []byte) {
+	// simulate packet loss, the responses to the requests of a batch are lost together with the batch response
+	if _, batched := transport.(*batchCollector); !batched && !simulated(transport) && lost(ServerSideNetworkPacketLossProbability) {
+		server.logger.PrintfContext(requestContext(h), "[INFO] rpc server: packet %s is sent but lost.", fmt.Sprintf("%s-%d", addr.String(), h.Seq))
+		server.metrics.Load().drop("simulated_loss")
 		return
 	}
 
-	_, err = conn.WriteToUDP(data, addr)
+	server.sending.Lock()
+	err := transport.WriteMessage(data, addr)
+	server.sending.Unlock()
 	if err != nil {
-		server.logger.Printf("[ERROR] rpc server: write response error: %v", err)
+		server.logger.PrintfContext(requestContext(h), "[ERROR] rpc server: write response error: %v", err)
+		server.metrics.Load().drop("write_error")
 		return
 	}
 }
 
 func (server *Server) backgroundCleanUp() {
+	ticker := time.NewTicker(CacheCleanUpInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-server.close:
 			return
-		default:
+		case <-ticker.C:
 			server.processed.Range(func(key, value interface{}) bool {
 				c := value.(*cachedResponse)
 				if time.Since(c.timestamp) > CacheValidityPeriod {
@@ -223,6 +511,14 @@ func (server *Server) backgroundCleanUp() {
 				}
 				return true
 			})
+			server.notified.Range(func(key, value interface{}) bool {
+				if time.Since(value.(time.Time)) > CacheValidityPeriod {
+					server.notified.Delete(key)
+				}
+				return true
+			})
+			server.limits.prune()
+			server.evictIdlePeers()
 		}
 	}
 }
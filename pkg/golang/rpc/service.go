@@ -2,28 +2,54 @@ package rpc
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"fmt"
 	"go/ast"
 	"reflect"
+	"sync/atomic"
 )
 
-var customTypes map[string]interface{}
-
-func init() {
-	customTypes = make(map[string]interface{}, 0)
+// customType is a message type known to the codec
+type customType struct {
+	typ     reflect.Type
+	version uint16 // schema version, bumped whenever fields are added or removed
 }
 
+// initialized here rather than in init, so that the init functions
+// of the other files of the package can register their types
+var customTypes = make(map[string]*customType)
+
+// RegisterType registers a message type with schema version 1
 func RegisterType(any interface{}) {
+	RegisterVersionedType(any, 1)
+}
+
+// RegisterVersionedType registers a message type with the given schema version.
+// The version should be bumped whenever fields are added to or removed from the type.
+// A peer decoding a message of another version skips the fields it does not know
+// and leaves the fields missing from the message at their zero value.
+func RegisterVersionedType(any interface{}, version uint16) {
 	gob.Register(any)
-	customTypes[reflect.TypeOf(any).Name()] = any
+	customTypes[reflect.TypeOf(any).Name()] = &customType{
+		typ:     reflect.TypeOf(any),
+		version: version,
+	}
 }
 
 // defines the methods that are registered at the RPC Server side
 type methodType struct {
-	method    reflect.Method // the pointer to the method
-	ArgType   reflect.Type   // the arguement type
-	ReplyType reflect.Type   // the reply type
+	method     reflect.Method // the pointer to the method
+	ArgType    reflect.Type   // the arguement type
+	ReplyType  reflect.Type   // the reply type, nil for notification handlers
+	Idempotent bool           // running the method more than once has the same effect as running it once
+	Context    bool           // the method takes a context.Context before the argument
+	Notify     bool           // the method takes no reply, it only serves one-way notifications
+	numCalls   uint64
+}
+
+func (m *methodType) NumCalls() uint64 {
+	return atomic.LoadUint64(&m.numCalls)
 }
 
 func (m *methodType) newArgv() reflect.Value {
@@ -56,6 +82,13 @@ type service struct {
 	method map[string]*methodType // map of the services that the object is registering
 }
 
+// IdempotentService is implemented by services whose methods listed by IdempotentMethods
+// can safely run more than once. The server does not cache the replies of these methods,
+// the replies of every other method are cached so that it runs at most once.
+type IdempotentService interface {
+	IdempotentMethods() []string
+}
+
 func newService(rcvr interface{}) (*service, error) {
 	s := new(service)
 	s.rcvr = reflect.ValueOf(rcvr)
@@ -65,25 +98,70 @@ func newService(rcvr interface{}) (*service, error) {
 		return nil, fmt.Errorf("rpc server: %s is not a valid service name", s.name)
 	}
 	s.registerMethods()
+	if svc, ok := rcvr.(IdempotentService); ok {
+		for _, name := range svc.IdempotentMethods() {
+			m, ok := s.method[name]
+			if !ok {
+				return nil, fmt.Errorf("rpc server: %s.%s is declared idempotent but is not a method of the service", s.name, name)
+			}
+			m.Idempotent = true
+		}
+	}
 	return s, nil
 }
 
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// registerMethods registers the methods of the form
+// func (t *T) Method(args A, reply *R) error, or
+// func (t *T) Method(ctx context.Context, args A, reply *R) error for methods that
+// make calls of their own, ctx carrying the trace of the request to them.
+// Methods of the form func (t *T) Method(args A) error, with or without the context,
+// serve one-way notifications only; A must be a struct so that setters are not mistaken for them.
+// Methods taking a reply serve both calls and notifications, the reply to a notification being dropped.
 func (s *service) registerMethods() {
 	s.method = make(map[string]*methodType)
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
 		mType := method.Type
-		if mType.NumIn() != 3 || mType.NumOut() != 1 { // only 2 parameters and 1 error return value are allowed
+		if mType.NumOut() != 1 { // only 1 error return value is allowed
 			continue
 		}
-		argType, replyType := mType.In(1), mType.In(2)
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
-			continue
+		withContext := mType.NumIn() > 2 && mType.In(1) == contextType
+		params := mType.NumIn() - 1 // after the receiver and the optional context
+		if withContext {
+			params--
 		}
-		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+		switch params {
+		case 1:
+			argType := mType.In(mType.NumIn() - 1)
+			structType := argType
+			if structType.Kind() == reflect.Ptr {
+				structType = structType.Elem()
+			}
+			if mType.Out(0) != errorType || !isExportedOrBuiltinType(argType) || structType.Kind() != reflect.Struct {
+				continue
+			}
+			s.method[method.Name] = &methodType{
+				method:  method,
+				ArgType: argType,
+				Context: withContext,
+				Notify:  true,
+			}
+		case 2:
+			argType, replyType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
+			if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+				continue
+			}
+			s.method[method.Name] = &methodType{
+				method:    method,
+				ArgType:   argType,
+				ReplyType: replyType,
+				Context:   withContext,
+			}
 		}
 		// log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
@@ -94,9 +172,18 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+func (s *service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) error {
+	atomic.AddUint64(&m.numCalls, 1)
 	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	in := []reflect.Value{s.rcvr}
+	if m.Context {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	in = append(in, argv)
+	if !m.Notify {
+		in = append(in, replyv)
+	}
+	returnValues := f.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
@@ -0,0 +1,392 @@
+package rpc
+
+import (
+	"container/heap"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const SimNetwork = "sim"
+
+// default setting
+var (
+	SimQueueSize     int           = 1024                  // messages an endpoint holds before the network drops further ones
+	SimReorderWindow time.Duration = 10 * time.Millisecond // time a reordered message waits, besides the delay and jitter of its link, for a later one to overtake it
+)
+
+// LinkConfig describes the faults of the link from one endpoint to another
+type LinkConfig struct {
+	Loss      float64       // probability that a message is dropped
+	Duplicate float64       // probability that a message is delivered twice
+	Reorder   float64       // probability that a message is held back behind the messages sent after it
+	Delay     time.Duration // time every message takes to be delivered
+	Jitter    time.Duration // random extra delay, up to Jitter
+}
+
+type simAddr string
+
+func (a simAddr) Network() string { return SimNetwork }
+func (a simAddr) String() string  { return string(a) }
+
+type simRule struct {
+	from, to string // endpoint addresses, "*" matches any endpoint
+	config   LinkConfig
+}
+
+func (r *simRule) match(from, to string) bool {
+	return (r.from == "*" || r.from == from) && (r.to == "*" || r.to == to)
+}
+
+// simLink keeps the random source of a link, so that the faults of a link
+// only depend on the seed and on the messages sent over that link
+type simLink struct {
+	rng     *rand.Rand
+	held    []byte // message held back to be delivered after the next one
+	heldSeq uint64 // counts the held messages, so that a flush does not deliver a later one
+}
+
+// simEvent is a delivery, or the flush of a held message, due at a given time
+type simEvent struct {
+	at  time.Time
+	seq uint64 // events due at the same time run in the order they were scheduled
+	run func()
+}
+
+// simEvents is a min-heap of events ordered by due time
+type simEvents []*simEvent
+
+func (e simEvents) Len() int { return len(e) }
+func (e simEvents) Less(i, j int) bool {
+	if e[i].at.Equal(e[j].at) {
+		return e[i].seq < e[j].seq
+	}
+	return e[i].at.Before(e[j].at)
+}
+func (e simEvents) Swap(i, j int)       { e[i], e[j] = e[j], e[i] }
+func (e *simEvents) Push(x interface{}) { *e = append(*e, x.(*simEvent)) }
+func (e *simEvents) Pop() interface{} {
+	old := *e
+	ev := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return ev
+}
+
+// SimNet is a seeded, in-process network for fault injection. Its endpoints
+// implement Transport, so servers and clients run over it unchanged, and the faults of
+// every link are controlled programmatically. Runs sending the same messages over
+// the same links reproduce the same losses, duplications and reorderings: the faults
+// are drawn from the random source of the link, never from the loss probabilities of the
+// package, and a single scheduler delivers the messages in the order they are due.
+// Addresses with the "sim://" scheme are served by the network set with SetSimNet.
+type SimNet struct {
+	mu         sync.Mutex // protect following
+	seed       int64
+	endpoints  map[string]*simTransport
+	links      map[string]*simLink // key: "<from>-><to>"
+	rules      []simRule           // the last matching rule applies
+	partitions []simRule
+	ephemeral  int // number of endpoints created by Dial
+	events     simEvents
+	eventSeq   uint64
+	wake       chan struct{} // tells the scheduler that an earlier event may be due
+	close      chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewSimNet creates a network with perfect links
+func NewSimNet(seed int64) *SimNet {
+	n := &SimNet{
+		seed:      seed,
+		endpoints: make(map[string]*simTransport),
+		links:     make(map[string]*simLink),
+		wake:      make(chan struct{}, 1),
+		close:     make(chan struct{}),
+	}
+	go n.schedule()
+	return n
+}
+
+var simNet atomic.Pointer[SimNet]
+
+// SetSimNet makes the network serve the addresses with the "sim://" scheme, nil removes it
+func SetSimNet(n *SimNet) {
+	simNet.Store(n)
+}
+
+// Close stops delivering messages, those in flight are lost
+func (n *SimNet) Close() {
+	n.closeOnce.Do(func() { close(n.close) })
+}
+
+// SetLink sets the faults of the link from one endpoint to another, "*" matches any endpoint
+func (n *SimNet) SetLink(from, to string, config LinkConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rules = append(n.rules, simRule{from: from, to: to, config: config})
+}
+
+// Partition drops every message between a and b, in both directions, until Heal is called.
+// "*" matches any endpoint, so Partition(addr, "*") isolates addr.
+func (n *SimNet) Partition(a, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitions = append(n.partitions, simRule{from: a, to: b}, simRule{from: b, to: a})
+}
+
+// Heal removes every partition
+func (n *SimNet) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitions = nil
+}
+
+// Listen creates the endpoint at addr
+func (n *SimNet) Listen(addr string) (Transport, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.listen(addr)
+}
+
+func (n *SimNet) listen(addr string) (*simTransport, error) {
+	if _, ok := n.endpoints[addr]; ok {
+		return nil, fmt.Errorf("rpc transport: sim address %s already in use", addr)
+	}
+	t := &simTransport{
+		net:      n,
+		addr:     simAddr(addr),
+		incoming: make(chan tcpMessage, SimQueueSize),
+		closed:   make(chan struct{}),
+	}
+	n.endpoints[addr] = t
+	return t, nil
+}
+
+// Dial creates an endpoint with a fresh address to talk to the endpoint at addr
+func (n *SimNet) Dial(addr string) (Transport, net.Addr, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ephemeral++
+	t, err := n.listen(fmt.Sprintf("ephemeral-%d", n.ephemeral))
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, simAddr(addr), nil
+}
+
+func (n *SimNet) link(from, to string) *simLink {
+	key := from + "->" + to
+	l, ok := n.links[key]
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		l = &simLink{rng: rand.New(rand.NewSource(n.seed ^ int64(h.Sum64())))}
+		n.links[key] = l
+	}
+	return l
+}
+
+func (n *SimNet) config(from, to string) LinkConfig {
+	var config LinkConfig
+	for i := range n.rules {
+		if n.rules[i].match(from, to) {
+			config = n.rules[i].config
+		}
+	}
+	return config
+}
+
+func (n *SimNet) partitioned(from, to string) bool {
+	for i := range n.partitions {
+		if n.partitions[i].match(from, to) {
+			return true
+		}
+	}
+	return false
+}
+
+// send decides the fate of a message and schedules its deliveries
+func (n *SimNet) send(data []byte, from, to string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.partitioned(from, to) {
+		return
+	}
+	config := n.config(from, to)
+	l := n.link(from, to)
+	// draw every random number whatever the config, so that changing
+	// one kind of fault does not change the pattern of the others
+	lost := l.rng.Float64() < config.Loss
+	duplicated := l.rng.Float64() < config.Duplicate
+	reordered := l.rng.Float64() < config.Reorder
+	jitter := time.Duration(l.rng.Int63n(int64(config.Jitter) + 1))
+	if lost {
+		return
+	}
+	msg := append([]byte(nil), data...)
+	if reordered && l.held == nil {
+		l.held = msg
+		l.heldSeq++
+		// a held message is delivered on its own if no message follows it, it is reordered, not lost
+		seq := l.heldSeq
+		n.after(config.Delay+config.Jitter+SimReorderWindow, func() { n.flush(l, seq, from, to) })
+		return
+	}
+	batch := [][]byte{msg}
+	if duplicated {
+		batch = append(batch, msg)
+	}
+	if l.held != nil {
+		batch = append(batch, l.held)
+		l.held = nil
+	}
+	n.deliver(batch, from, to, config.Delay+jitter)
+}
+
+// flush delivers the message held back on the link, unless it has been delivered since
+func (n *SimNet) flush(l *simLink, seq uint64, from, to string) {
+	if l.held == nil || l.heldSeq != seq {
+		return
+	}
+	batch := [][]byte{l.held}
+	l.held = nil
+	n.deliver(batch, from, to, 0) // it has waited for longer than the delay of the link already
+}
+
+func (n *SimNet) deliver(batch [][]byte, from, to string, delay time.Duration) {
+	// the endpoint is looked up on delivery, so that the messages to an endpoint closed meanwhile are lost
+	n.after(delay, func() {
+		t, ok := n.endpoints[to]
+		if !ok {
+			return // nobody listens on the address, the messages are lost
+		}
+		for _, data := range batch {
+			t.push(tcpMessage{data: data, addr: simAddr(from)})
+		}
+	})
+}
+
+// after schedules run to be called by the scheduler, with n.mu held, once delay has passed
+func (n *SimNet) after(delay time.Duration, run func()) {
+	n.eventSeq++
+	heap.Push(&n.events, &simEvent{at: time.Now().Add(delay), seq: n.eventSeq, run: run})
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// schedule runs the events in the order they are due, one at a time
+func (n *SimNet) schedule() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		n.mu.Lock()
+		now := time.Now()
+		for len(n.events) > 0 && !n.events[0].at.After(now) {
+			heap.Pop(&n.events).(*simEvent).run()
+		}
+		wait := time.Hour
+		if len(n.events) > 0 {
+			wait = n.events[0].at.Sub(now)
+		}
+		n.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-n.close:
+			return
+		case <-n.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+func (n *SimNet) remove(t *simTransport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.endpoints[string(t.addr)] == t {
+		delete(n.endpoints, string(t.addr))
+	}
+}
+
+// simTransport is an endpoint of a SimNet
+type simTransport struct {
+	net      *SimNet
+	addr     simAddr
+	incoming chan tcpMessage
+	closed   chan struct{}
+	once     sync.Once
+}
+
+var _ Transport = (*simTransport)(nil)
+
+func (t *simTransport) push(m tcpMessage) {
+	select {
+	case <-t.closed:
+	case t.incoming <- m:
+	default:
+		// the queue is full, the message is dropped
+	}
+}
+
+func (t *simTransport) ReadMessage() ([]byte, net.Addr, error) {
+	select {
+	case m := <-t.incoming:
+		return m.data, m.addr, nil
+	case <-t.closed:
+		return nil, nil, net.ErrClosed
+	}
+}
+
+func (t *simTransport) WriteMessage(data []byte, addr net.Addr) error {
+	select {
+	case <-t.closed:
+		return net.ErrClosed
+	default:
+	}
+	if len(data) > MaxMessageSize {
+		return fmt.Errorf("rpc transport: message of %d bytes exceeds the limit of %d bytes", len(data), MaxMessageSize)
+	}
+	t.net.send(data, string(t.addr), addr.String())
+	return nil
+}
+
+func (t *simTransport) LocalAddr() net.Addr { return t.addr }
+
+func (t *simTransport) Close() error {
+	t.once.Do(func() {
+		close(t.closed)
+		t.net.remove(t)
+	})
+	return nil
+}
+
+// simulated reports whether the messages of the transport go through a SimNet,
+// whose links rather than the loss probabilities of the package decide which ones are lost
+func simulated(t Transport) bool {
+	for {
+		switch w := t.(type) {
+		case *simTransport:
+			return true
+		case *authTransport:
+			t = w.Transport
+		case *peerTransport:
+			t = w.Transport
+		case *batchCollector:
+			t = w.Transport
+		default:
+			return false
+		}
+	}
+}
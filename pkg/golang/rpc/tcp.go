@@ -0,0 +1,337 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"distributed-file-system/pkg/golang/logger"
+)
+
+// default setting
+var (
+	DialTimeout       time.Duration = 5 * time.Second        // timeout for establishing a tcp connection
+	ReconnectInterval time.Duration = 500 * time.Millisecond // wait time between two reconnect attempts
+)
+
+// tcpConn is a stream connection carrying length-prefixed messages
+type tcpConn struct {
+	net.Conn
+	writing sync.Mutex // guard for writing a complete frame
+}
+
+// writeFrame writes a 4 bytes little endian length prefix followed by the message
+func (c *tcpConn) writeFrame(data []byte) error {
+	if len(data) > MaxMessageSize {
+		return fmt.Errorf("rpc transport: message of %d bytes exceeds the limit of %d bytes", len(data), MaxMessageSize)
+	}
+	buf := make([]byte, 4+len(data))
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(data)))
+	copy(buf[4:], data)
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	_, err := c.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	lenbuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, lenbuf); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(lenbuf)
+	if n > MaxMessageSize {
+		return nil, fmt.Errorf("rpc transport: frame of %d bytes exceeds the limit of %d bytes", n, MaxMessageSize)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+type tcpMessage struct {
+	data []byte
+	addr net.Addr
+}
+
+// tcpListenerTransport accepts stream connections and serves the messages
+// of all of them. Replies go back over the connection the request came from.
+type tcpListenerTransport struct {
+	listener net.Listener
+	incoming chan tcpMessage
+	mu       sync.Mutex
+	conns    map[string]*tcpConn // key: remote address
+	closed   chan struct{}
+	once     sync.Once
+	logger   *logger.Logger
+}
+
+var _ Transport = (*tcpListenerTransport)(nil)
+
+func listenTCP(address string, logger *logger.Logger) (*tcpListenerTransport, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	t := &tcpListenerTransport{
+		listener: l,
+		incoming: make(chan tcpMessage),
+		conns:    make(map[string]*tcpConn),
+		closed:   make(chan struct{}),
+		logger:   logger,
+	}
+	go t.accept()
+	return t, nil
+}
+
+func (t *tcpListenerTransport) accept() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.closed:
+				return
+			default:
+			}
+			t.logger.Printf("[ERROR] rpc transport: accept error: %v", err)
+			continue
+		}
+		c := &tcpConn{Conn: conn}
+		t.mu.Lock()
+		t.conns[conn.RemoteAddr().String()] = c
+		t.mu.Unlock()
+		go t.serve(c)
+	}
+}
+
+func (t *tcpListenerTransport) serve(c *tcpConn) {
+	defer t.remove(c)
+	for {
+		data, err := readFrame(c)
+		if err != nil {
+			if err != io.EOF {
+				t.logger.Printf("[ERROR] rpc transport: read error from %s: %v", c.RemoteAddr(), err)
+			}
+			return
+		}
+		select {
+		case t.incoming <- tcpMessage{data: data, addr: c.RemoteAddr()}:
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+func (t *tcpListenerTransport) remove(c *tcpConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := c.RemoteAddr().String()
+	if t.conns[key] == c {
+		delete(t.conns, key)
+	}
+	c.Close()
+}
+
+func (t *tcpListenerTransport) ReadMessage() ([]byte, net.Addr, error) {
+	select {
+	case m := <-t.incoming:
+		return m.data, m.addr, nil
+	case <-t.closed:
+		return nil, nil, net.ErrClosed
+	}
+}
+
+func (t *tcpListenerTransport) WriteMessage(data []byte, addr net.Addr) error {
+	t.mu.Lock()
+	c, ok := t.conns[addr.String()]
+	t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("rpc transport: no connection to %s", addr)
+	}
+	if err := c.writeFrame(data); err != nil {
+		t.remove(c)
+		return err
+	}
+	return nil
+}
+
+func (t *tcpListenerTransport) LocalAddr() net.Addr { return t.listener.Addr() }
+
+func (t *tcpListenerTransport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	t.mu.Lock()
+	for _, c := range t.conns {
+		c.Close()
+	}
+	t.mu.Unlock()
+	return t.listener.Close()
+}
+
+// tcpDialTransport keeps a single connection to the server which is reused
+// by every call and is re-established whenever it breaks.
+type tcpDialTransport struct {
+	address     string
+	mu          sync.Mutex // protect following
+	conn        *tcpConn
+	closing     bool
+	dialed      bool   // a connection has been established before
+	reconnected func() // called once a broken connection is replaced, nil if none
+	logger      *logger.Logger
+}
+
+var _ Transport = (*tcpDialTransport)(nil)
+
+func dialTCP(address string, logger *logger.Logger) (*tcpDialTransport, net.Addr, error) {
+	t := &tcpDialTransport{
+		address: address,
+		logger:  logger,
+	}
+	c, err := t.connection()
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, c.RemoteAddr(), nil
+}
+
+// dialedTCP returns the tcp connection the transport goes over, if it dials one
+func dialedTCP(t Transport) (*tcpDialTransport, bool) {
+	for {
+		switch w := t.(type) {
+		case *tcpDialTransport:
+			return w, true
+		case *authTransport:
+			t = w.Transport
+		default:
+			return nil, false
+		}
+	}
+}
+
+// onReconnect sets the function called whenever a broken connection is replaced by a new one
+func (t *tcpDialTransport) onReconnect(f func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reconnected = f
+}
+
+// connection returns the current connection, dialing a new one if there is none.
+// The lock is not held while dialing, so that writers do not queue up behind an unreachable server.
+func (t *tcpDialTransport) connection() (*tcpConn, error) {
+	t.mu.Lock()
+	if t.closing {
+		t.mu.Unlock()
+		return nil, ErrShutdown
+	}
+	if t.conn != nil {
+		defer t.mu.Unlock()
+		return t.conn, nil
+	}
+	t.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", t.address, DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	if t.closing {
+		t.mu.Unlock()
+		conn.Close()
+		return nil, ErrShutdown
+	}
+	if t.conn != nil {
+		// another caller reconnected meanwhile
+		defer t.mu.Unlock()
+		conn.Close()
+		return t.conn, nil
+	}
+	t.conn = &tcpConn{Conn: conn}
+	c, reconnected := t.conn, t.dialed
+	t.dialed = true
+	f := t.reconnected
+	t.mu.Unlock()
+	if reconnected && f != nil {
+		t.logger.Printf("[INFO] rpc transport: reconnected to %s from %s", t.address, conn.LocalAddr())
+		f()
+	}
+	return c, nil
+}
+
+// reset drops a broken connection so that the next use reconnects
+func (t *tcpDialTransport) reset(c *tcpConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == c {
+		t.conn = nil
+	}
+	c.Close()
+}
+
+func (t *tcpDialTransport) isClosing() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closing
+}
+
+func (t *tcpDialTransport) ReadMessage() ([]byte, net.Addr, error) {
+	for {
+		c, err := t.connection()
+		if err == ErrShutdown {
+			return nil, nil, err
+		}
+		if err != nil {
+			t.logger.Printf("[ERROR] rpc transport: reconnecting to %s: %v", t.address, err)
+			time.Sleep(ReconnectInterval)
+			continue
+		}
+		data, err := readFrame(c)
+		if err == nil {
+			return data, c.RemoteAddr(), nil
+		}
+		if t.isClosing() {
+			return nil, nil, ErrShutdown
+		}
+		t.logger.Printf("[INFO] rpc transport: connection to %s is broken: %v", t.address, err)
+		t.reset(c)
+	}
+}
+
+// WriteMessage writes over the current connection, reconnecting once if it turns out to be broken
+func (t *tcpDialTransport) WriteMessage(data []byte, _ net.Addr) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var c *tcpConn
+		c, err = t.connection()
+		if err != nil {
+			return err
+		}
+		if err = c.writeFrame(data); err == nil {
+			return nil
+		}
+		t.logger.Printf("[INFO] rpc transport: write to %s failed, reconnecting: %v", t.address, err)
+		t.reset(c)
+	}
+	return err
+}
+
+func (t *tcpDialTransport) LocalAddr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		return nil
+	}
+	return t.conn.LocalAddr()
+}
+
+func (t *tcpDialTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closing = true
+	if t.conn != nil {
+		return t.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"distributed-file-system/pkg/golang/logger"
+	"distributed-file-system/pkg/golang/rpc"
+)
+
+// fuzz feeds valid, mutated and random messages into rpc.Server.ServeConn,
+// which decodes them through Server.readRequest, and records every input
+// that makes the server panic into the corpus directory.
+//
+//	go run pkg/golang/rpc/test/fuzz.go -corpus pkg/golang/rpc/test/corpus -n 200000
+
+type Inner struct {
+	Name  string
+	Sizes []int32
+}
+
+type Args struct {
+	Id      string
+	Count   int64
+	Ratio   float64
+	Data    []byte
+	Flags   map[string]bool
+	Nested  *Inner
+	Entries []Inner
+	Sum     [4]byte
+}
+
+type Reply struct {
+	Ok bool
+}
+
+type Echo struct{}
+
+func (e *Echo) Call(args Args, reply *Reply) error {
+	reply.Ok = true
+	return nil
+}
+
+// discard is a transport that drops every response
+type discard struct{}
+
+func (discard) ReadMessage() ([]byte, net.Addr, error)        { select {} }
+func (discard) WriteMessage(data []byte, addr net.Addr) error { return nil }
+func (discard) LocalAddr() net.Addr                           { return nil }
+func (discard) Close() error                                  { return nil }
+
+func seeds() [][]byte {
+	cc := rpc.NewLabCodec()
+	bodies := []interface{}{
+		&Args{},
+		&Args{Id: "1", Count: -1, Ratio: 0.5, Data: []byte("data"), Flags: map[string]bool{"a": true}},
+		&Args{Nested: &Inner{Name: "n", Sizes: []int32{1, 2, 3}}, Entries: []Inner{{Name: "e"}, {Sizes: []int32{4}}}},
+		&Reply{Ok: true},
+		Args{Id: "2", Sum: [4]byte{1, 2, 3, 4}}, // by value, so that the array is not addressable
+	}
+	var inputs [][]byte
+	for i, body := range bodies {
+		data, err := cc.Encode(&rpc.Header{ServiceMethod: "Echo.Call", Seq: uint64(i + 1)}, body)
+		if err != nil {
+			panic(err)
+		}
+		inputs = append(inputs, data)
+	}
+	for _, t := range []rpc.Type{rpc.LabType, rpc.GobType, rpc.JSONType} {
+		data, err := rpc.EncodeFrame(t, &rpc.Header{ServiceMethod: "Echo.Call", Version: rpc.ProtocolVersion}, bodies[2])
+		if err != nil {
+			panic(err)
+		}
+		inputs = append(inputs, data)
+	}
+	// a batch carrying two of the frames above
+	batch, err := rpc.EncodeFrame(rpc.LabType, &rpc.Header{ServiceMethod: "Server.Batch", Version: rpc.ProtocolVersion},
+		&rpc.BatchRequest{Requests: inputs[len(inputs)-3 : len(inputs)-1]})
+	if err != nil {
+		panic(err)
+	}
+	// a response, which the server hands over to the client calling the peer back
+	response, err := rpc.EncodeFrame(rpc.LabType, &rpc.Header{ServiceMethod: "Echo.Call", Seq: 1, Version: rpc.ProtocolVersion, Response: true}, bodies[3])
+	if err != nil {
+		panic(err)
+	}
+	return append(inputs, batch, response)
+}
+
+func mutate(rnd *rand.Rand, data []byte) []byte {
+	b := append([]byte{}, data...)
+	switch rnd.Intn(6) {
+	case 0: // flip some bytes
+		for i := 0; i < 1+rnd.Intn(4) && len(b) > 0; i++ {
+			b[rnd.Intn(len(b))] ^= byte(1 + rnd.Intn(255))
+		}
+	case 1: // truncate
+		if len(b) > 0 {
+			b = b[:rnd.Intn(len(b))]
+		}
+	case 2: // append garbage
+		for i := 0; i < 1+rnd.Intn(16); i++ {
+			b = append(b, byte(rnd.Intn(256)))
+		}
+	case 3: // overwrite a length prefix candidate with an extreme value
+		if len(b) >= 4 {
+			i := rnd.Intn(len(b) - 3)
+			for j, v := range []byte{0xff, 0xff, 0xff, byte(rnd.Intn(256))} {
+				b[i+j] = v
+			}
+		}
+	case 4: // small change to a length prefix candidate
+		if len(b) > 0 {
+			i := rnd.Intn(len(b))
+			b[i] = byte(int(b[i]) + rnd.Intn(5) - 2)
+		}
+	default: // random data
+		b = make([]byte, rnd.Intn(64))
+		rnd.Read(b)
+	}
+	return b
+}
+
+// serve reports whether handling the input panicked
+func serve(server *rpc.Server, data []byte) (panicked interface{}) {
+	defer func() {
+		panicked = recover()
+	}()
+	server.ServeConn(discard{}, &net.UDPAddr{}, data)
+	return nil
+}
+
+func main() {
+	n := flag.Int("n", 100000, "number of inputs to try")
+	seed := flag.Int64("seed", 1, "seed of the mutations")
+	corpus := flag.String("corpus", "pkg/golang/rpc/test/corpus", "directory of the corpus")
+	gen := flag.Bool("gen", false, "write the seed inputs into the corpus directory and exit")
+	flag.Parse()
+
+	rpc.RegisterType(Args{})
+	rpc.RegisterType(Reply{})
+	rpc.ServerSideNetworkPacketLossProbability = 0
+	server := rpc.NewServer(logger.NewLogger(os.DevNull))
+	if err := server.Register(&Echo{}); err != nil {
+		panic(err)
+	}
+
+	inputs := seeds()
+	if *gen {
+		for i, data := range inputs {
+			if err := os.WriteFile(filepath.Join(*corpus, fmt.Sprintf("seed-%d", i)), data, 0644); err != nil {
+				panic(err)
+			}
+		}
+		return
+	}
+	entries, _ := os.ReadDir(*corpus)
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(*corpus, e.Name()))
+		if err != nil {
+			continue
+		}
+		inputs = append(inputs, data)
+	}
+
+	rnd := rand.New(rand.NewSource(*seed))
+	crashes := 0
+	for i := 0; i < *n; i++ {
+		var data []byte
+		if i < len(inputs) {
+			data = inputs[i]
+		} else {
+			data = mutate(rnd, inputs[rnd.Intn(len(inputs))])
+		}
+		if p := serve(server, data); p != nil {
+			crashes++
+			sum := sha1.Sum(data)
+			name := "crash-" + hex.EncodeToString(sum[:8])
+			fmt.Printf("input %s panics: %v\n", name, strings.SplitN(fmt.Sprint(p), "\n", 2)[0])
+			os.WriteFile(filepath.Join(*corpus, name), data, 0644)
+			continue
+		}
+		if i%5 == 0 && len(inputs) < 1000 {
+			inputs = append(inputs, data) // keep some survivors to mutate further
+		}
+	}
+	fmt.Printf("%d inputs, %d panics\n", *n, crashes)
+	if crashes > 0 {
+		os.Exit(1)
+	}
+}
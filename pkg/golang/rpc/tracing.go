@@ -0,0 +1,33 @@
+package rpc
+
+import (
+	"context"
+
+	"distributed-file-system/pkg/golang/trace"
+)
+
+// SetSpanExporter exports a span for every request the server serves
+func (server *Server) SetSpanExporter(e trace.Exporter) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.exporter = e
+}
+
+func (server *Server) spanExporter() trace.Exporter {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.exporter
+}
+
+// SetSpanExporter exports a span for every call the client makes
+func (client *Client) SetSpanExporter(e trace.Exporter) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.exporter = e
+}
+
+// requestContext carries the span of the call at the client, so that the log lines
+// of the request and the span of the server join the trace of the client
+func requestContext(h *Header) context.Context {
+	return trace.NewContext(context.Background(), trace.SpanContext{TraceId: h.TraceId, SpanId: h.SpanId})
+}
@@ -0,0 +1,85 @@
+package rpc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"distributed-file-system/pkg/golang/logger"
+)
+
+// Transport is a message oriented connection which rpc clients and servers
+// exchange encoded messages over. A message written by WriteMessage is delivered
+// as a whole by ReadMessage at the other side, whatever the underlying network is.
+type Transport interface {
+	// ReadMessage blocks until a whole message arrives and returns it together with the address of its sender
+	ReadMessage() ([]byte, net.Addr, error)
+	// WriteMessage sends a whole message to addr
+	WriteMessage(data []byte, addr net.Addr) error
+	LocalAddr() net.Addr
+	Close() error
+}
+
+const (
+	UDPNetwork = "udp"
+	TCPNetwork = "tcp"
+)
+
+var errNoSimNet = fmt.Errorf("rpc transport: no simulated network, call SetSimNet first")
+
+// ParseAddr splits an address of the form "<network>://<host>:<port>" into its
+// network and host:port parts. Addresses without a scheme default to udp.
+func ParseAddr(addr string) (network, address string, err error) {
+	network, address, found := strings.Cut(addr, "://")
+	if !found {
+		return UDPNetwork, addr, nil
+	}
+	switch network {
+	case UDPNetwork, TCPNetwork, SimNetwork:
+		return network, address, nil
+	default:
+		return "", "", fmt.Errorf("rpc transport: unsupported network %q in address %s", network, addr)
+	}
+}
+
+// Listen announces on the given address and returns the transport
+// a Server accepts requests from
+func Listen(addr string, logger *logger.Logger) (Transport, error) {
+	network, address, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case TCPNetwork:
+		return listenTCP(address, logger)
+	case SimNetwork:
+		n := simNet.Load()
+		if n == nil {
+			return nil, errNoSimNet
+		}
+		return n.Listen(address)
+	default:
+		return listenUDP(address, logger)
+	}
+}
+
+// DialTransport connects to the server at the given address and returns the transport
+// together with the resolved server address
+func DialTransport(addr string, logger *logger.Logger) (Transport, net.Addr, error) {
+	network, address, err := ParseAddr(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch network {
+	case TCPNetwork:
+		return dialTCP(address, logger)
+	case SimNetwork:
+		n := simNet.Load()
+		if n == nil {
+			return nil, nil, errNoSimNet
+		}
+		return n.Dial(address)
+	default:
+		return dialUDP(address, logger)
+	}
+}
@@ -0,0 +1,102 @@
+package rpc
+
+import (
+	"net"
+
+	"distributed-file-system/pkg/golang/logger"
+)
+
+// udpTransport sends every message as one or more datagrams,
+// splitting the ones larger than MaxBufferSize into fragments.
+type udpTransport struct {
+	conn   *net.UDPConn
+	frag   *fragmenter
+	logger *logger.Logger
+}
+
+var _ Transport = (*udpTransport)(nil)
+
+func newUDPTransport(conn *net.UDPConn, logger *logger.Logger) *udpTransport {
+	return &udpTransport{
+		conn:   conn,
+		frag:   newFragmenter(logger),
+		logger: logger,
+	}
+}
+
+func listenUDP(address string, logger *logger.Logger) (*udpTransport, error) {
+	s, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", s)
+	if err != nil {
+		return nil, err
+	}
+	return newUDPTransport(conn, logger), nil
+}
+
+func dialUDP(address string, logger *logger.Logger) (*udpTransport, net.Addr, error) {
+	s, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newUDPTransport(conn, logger), s, nil
+}
+
+func (t *udpTransport) ReadMessage() ([]byte, net.Addr, error) {
+	for {
+		buf := make([]byte, MaxBufferSize)
+		n, addr, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := t.frag.receive(buf[:n], addr.String(), func(b []byte) error {
+			return t.write(b, addr)
+		})
+		if err != nil {
+			t.logger.Printf("[ERROR] rpc transport: error reassembling the message from %s: %v", addr, err)
+			continue
+		}
+		if data == nil {
+			continue // waiting for the rest of the fragments
+		}
+		return data, addr, nil
+	}
+}
+
+func (t *udpTransport) WriteMessage(data []byte, addr net.Addr) error {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		var err error
+		if udpAddr, err = net.ResolveUDPAddr("udp", addr.String()); err != nil {
+			return err
+		}
+	}
+	return t.frag.send(data, func(b []byte) error {
+		return t.write(b, udpAddr)
+	})
+}
+
+// write sends a single datagram
+func (t *udpTransport) write(b []byte, addr *net.UDPAddr) error {
+	var err error
+	if t.conn.RemoteAddr() != nil {
+		// a dialed socket can only talk to its peer
+		_, err = t.conn.Write(b)
+	} else {
+		_, err = t.conn.WriteToUDP(b, addr)
+	}
+	return err
+}
+
+func (t *udpTransport) LocalAddr() net.Addr { return t.conn.LocalAddr() }
+
+func (t *udpTransport) Close() error {
+	t.frag.shutdown()
+	return t.conn.Close()
+}
@@ -0,0 +1,86 @@
+package rpc
+
+import "fmt"
+
+// protocol versions spoken by this build.
+// Version 1 is the original wire format which carries no version information at all,
+// version 2 adds the protocol version to the header and the schema version to the body,
+// version 3 tags every frame with the codec it is encoded with,
+// version 4 ends LabCodec messages with a checksum,
+// version 5 carries the trace context in LabCodec headers,
+// version 6 packs several calls into a single batch message,
+// version 7 marks one-way notifications in LabCodec headers,
+// version 8 marks responses, so that a server can call a client back over the connection of the client.
+const (
+	MinProtocolVersion uint16 = 1
+	ProtocolVersion    uint16 = 8
+)
+
+type HandshakeRequest struct {
+	MinVersion uint16 // lowest protocol version the client speaks
+	MaxVersion uint16 // highest protocol version the client speaks
+}
+
+type HandshakeResponse struct {
+	Version uint16 // protocol version the client should use from now on
+}
+
+func init() {
+	RegisterType(HandshakeRequest{})
+	RegisterType(HandshakeResponse{})
+}
+
+// Handshake picks the highest protocol version spoken by both the client and the server
+func (server *Server) Handshake(req HandshakeRequest, resp *HandshakeResponse) error {
+	version := min(req.MaxVersion, ProtocolVersion)
+	if version < max(req.MinVersion, MinProtocolVersion) {
+		return fmt.Errorf("rpc server: no common protocol version, server speaks %d to %d, client speaks %d to %d",
+			MinProtocolVersion, ProtocolVersion, req.MinVersion, req.MaxVersion)
+	}
+	resp.Version = version
+	return nil
+}
+
+const handshakeMethod = "Server.Handshake"
+
+func checkVersion(h *Header) error {
+	if h.Version < MinProtocolVersion || h.Version > ProtocolVersion {
+		return fmt.Errorf("rpc server: unsupported protocol version %d", h.Version)
+	}
+	return nil
+}
+
+// handshake negotiates the protocol version with the server.
+// Requests are held back until it completes. With servers that predate
+// the handshake, the client speaks MinProtocolVersion which every server understands.
+func (client *Client) handshake() {
+	args := &HandshakeRequest{MinVersion: MinProtocolVersion, MaxVersion: ProtocolVersion}
+	var reply HandshakeResponse
+	err := client.Call(handshakeMethod, args, &reply)
+	if err != nil {
+		client.logger.Printf("[INFO] rpc client: handshake with %s failed, speaking protocol version %d: %v", client.remote, MinProtocolVersion, err)
+		close(client.ready)
+		return
+	}
+	client.version.Store(uint32(reply.Version))
+	client.logger.Printf("[INFO] rpc client: speaking protocol version %d with %s", reply.Version, client.remote)
+	close(client.ready)
+	client.seedRTT()
+}
+
+// rehandshake negotiates the protocol version again over a new connection to the server,
+// which may have been restarted with another version meanwhile
+func (client *Client) rehandshake() {
+	if client.isClosing() {
+		return
+	}
+	<-client.ready
+	args := &HandshakeRequest{MinVersion: MinProtocolVersion, MaxVersion: ProtocolVersion}
+	var reply HandshakeResponse
+	if err := client.Call(handshakeMethod, args, &reply); err != nil {
+		client.logger.Printf("[INFO] rpc client: handshake with %s over the new connection failed: %v", client.remote, err)
+		return
+	}
+	client.version.Store(uint32(reply.Version))
+	client.logger.Printf("[INFO] rpc client: speaking protocol version %d with %s over the new connection", reply.Version, client.remote)
+}
@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Cache struct {
 	mu sync.Mutex
 	sync.Map
+	hits   atomic.Uint64 // lookups served from the cache
+	misses atomic.Uint64 // lookups that had to go to the server
 }
 
 func NewCache() *Cache {
@@ -36,6 +39,21 @@ func (c *Cache) Get(key string) (*Entry, error) {
 	return v.(*Entry), nil
 }
 
+// Lookup is Get for the reads that go to the server on a miss, it counts the hits and misses
+func (c *Cache) Lookup(key string) (*Entry, error) {
+	e, err := c.Get(key)
+	if err != nil {
+		c.misses.Add(1)
+	} else {
+		c.hits.Add(1)
+	}
+	return e, err
+}
+
+func (c *Cache) Hits() uint64 { return c.hits.Load() }
+
+func (c *Cache) Misses() uint64 { return c.misses.Load() }
+
 type Entry struct {
 	dirty         bool
 	lastValidated time.Time // time when the cache entry was last validated
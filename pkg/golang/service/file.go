@@ -5,6 +5,8 @@ import (
 	"path/filepath"
 	fp "path/filepath"
 	"strings"
+
+	"distributed-file-system/pkg/golang/rpc"
 )
 
 type Volume struct {
@@ -112,13 +114,13 @@ func print(rootpath string, fd *FileDescriptor) {
 }
 
 // recursively performs subscription
-func Subscribe(root *FileDescriptor, clientId, clientAddr string) {
+func Subscribe(root *FileDescriptor, clientId, clientAddr string, peer *rpc.PeerRef) {
 	if root == nil {
 		return
 	}
-	root.subscription.Subscribe(clientId, clientAddr)
+	root.subscription.Subscribe(clientId, clientAddr, peer)
 	for _, cfd := range root.Children {
-		Subscribe(cfd, clientId, clientAddr)
+		Subscribe(cfd, clientId, clientAddr, peer)
 	}
 }
 
@@ -2,15 +2,19 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"os"
 	fp "path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"distributed-file-system/pkg/golang/logger"
+	"distributed-file-system/pkg/golang/metrics"
 	"distributed-file-system/pkg/golang/rpc"
+	"distributed-file-system/pkg/golang/trace"
 )
 
 var (
@@ -23,18 +27,33 @@ type FileClient struct {
 	addr      string
 	rpcClient *rpc.Client
 	rpcServer *rpc.Server
-	stop      chan struct{}
+	stop      chan struct{} // stops a poller
+	done      chan struct{} // closed on shutdown, stops every poller
+	doneOnce  sync.Once
+	mu        sync.RWMutex       // protect volumes, the file index trees in them and the callback promises of their files
 	volumes   map[string]*Volume // file index for mounted files
 	cache     *Cache
+	keyring   *rpc.Keyring        // holds the key of the client, nil if messages are not authenticated
+	encrypt   bool                // encrypt the messages with the key
+	metrics   net.Listener        // serves the metrics, nil unless enabled
+	exporter  *trace.JSONExporter // exporter of the spans, nil unless spans are exported
 	logger    *logger.Logger
 }
 
 func NewFileClient(id, addr, serverAddr string) *FileClient {
+	return NewFileClientWithKey(id, addr, serverAddr, nil, false)
+}
+
+// NewFileClientWithKey creates a client that signs its requests with the key it shares with the server,
+// and only accepts the callbacks the server signs with the same key. With encrypt set, the messages
+// are encrypted with the key as well. A nil key turns authentication and encryption off.
+func NewFileClientWithKey(id, addr, serverAddr string, key []byte, encrypt bool) *FileClient {
 	logger := logger.NewLogger(fmt.Sprintf("./client%s.log", id))
 	fc := &FileClient{
 		id:        id,
 		addr:      addr,
 		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
 		volumes:   make(map[string]*Volume),
 		cache:     NewCache(),
 		logger:    logger,
@@ -43,45 +62,124 @@ func NewFileClient(id, addr, serverAddr string) *FileClient {
 	if err := fc.rpcServer.Register(fc); err != nil {
 		panic(fmt.Sprintf("file client rpc register error: %v", err))
 	}
-	rpcClient, err := rpc.Dial(serverAddr, logger)
+	var rpcClient *rpc.Client
+	var err error
+	if key != nil {
+		fc.keyring = rpc.NewKeyring()
+		fc.keyring.Add(id, key)
+		fc.encrypt = encrypt
+		if encrypt {
+			rpcClient, err = rpc.DialSecure(serverAddr, id, key, logger)
+		} else {
+			rpcClient, err = rpc.DialWithKey(serverAddr, id, key, logger)
+		}
+	} else {
+		rpcClient, err = rpc.Dial(serverAddr, logger)
+	}
 	if err != nil {
 		panic(fmt.Sprintf("file client rpc dial error: %v", err))
 	}
+	// the server calls the client back over the connection of the client
+	rpcClient.Serve(fc.rpcServer)
 	fc.rpcClient = rpcClient
 	return fc
 }
 
+// Run serves a callback endpoint at the address of the client, for the servers that predate calling
+// the client back over its connection. Like the server address, it may carry a scheme to choose the transport.
+// Clients without an address are only called back over their connection, and Run returns at once.
 func (fc *FileClient) Run() {
-	s, err := net.ResolveUDPAddr("udp", fc.addr)
-	if err != nil {
-		panic(fmt.Sprintf("client error resolving udp address: %v", err))
+	if fc.addr == "" {
+		return
 	}
-	conn, err := net.ListenUDP("udp", s)
+	transport, err := rpc.Listen(fc.addr, fc.logger)
 	if err != nil {
 		panic(fmt.Sprintf("network error: %v", err))
 	}
-	fc.logger.Printf("INFO [file client %s]: listening on %s", fc.id, conn.LocalAddr().String())
-	fc.rpcServer.Accept(conn)
+	if fc.keyring != nil && fc.encrypt {
+		transport = rpc.NewSecureTransport(transport, fc.keyring, "", fc.logger)
+	} else if fc.keyring != nil {
+		transport = rpc.NewAuthTransport(transport, fc.keyring, "", fc.logger)
+	}
+	fc.logger.Printf("INFO [file client %s]: listening on %s", fc.id, transport.LocalAddr().String())
+	fc.rpcServer.Accept(transport)
+}
+
+// SetCodec chooses the codec of the requests sent to the file server,
+// e.g. rpc.JSONType to make the traffic readable while debugging
+func (fc *FileClient) SetCodec(t rpc.Type) error {
+	return fc.rpcClient.SetCodec(t)
+}
+
+// ServeMetrics serves the metrics of the client in the Prometheus text format at http://<addr>/metrics
+func (fc *FileClient) ServeMetrics(addr string) error {
+	reg := metrics.NewRegistry()
+	rpc.RegisterMetrics(reg)
+	fc.rpcClient.Instrument(reg)
+	fc.rpcServer.Instrument(reg)
+	reg.NewCounterFunc("file_client_cache_hits_total", "Reads served from the cache.",
+		func() float64 { return float64(fc.cache.Hits()) })
+	reg.NewCounterFunc("file_client_cache_misses_total", "Reads that had to fetch the file from the server.",
+		func() float64 { return float64(fc.cache.Misses()) })
+	l, err := reg.Serve(addr)
+	if err != nil {
+		return err
+	}
+	fc.metrics = l
+	fc.logger.Printf("INFO [file client %s]: serving metrics on %s", fc.id, l.Addr().String())
+	return nil
+}
+
+// ExportSpans appends the spans of the user actions, and of the calls they make and the callbacks
+// the client serves, to the file at path as JSON lines. The spans of the same action share a trace id
+// with the spans the server and the other clients record for it.
+func (fc *FileClient) ExportSpans(path string) error {
+	e, err := trace.OpenJSONExporter(path, "file client "+fc.id)
+	if err != nil {
+		return err
+	}
+	fc.exporter = e
+	fc.rpcClient.SetSpanExporter(e)
+	fc.rpcServer.SetSpanExporter(e)
+	return nil
+}
+
+// spanExporter returns the exporter of the spans, a nil interface unless spans are exported
+func (fc *FileClient) spanExporter() trace.Exporter {
+	if fc.exporter == nil {
+		return nil
+	}
+	return fc.exporter
+}
+
+// startSpan starts the span of a user action, the calls it makes join its trace
+func (fc *FileClient) startSpan(ctx context.Context, name string) (context.Context, func(error)) {
+	ctx, span := trace.StartSpan(ctx, name, trace.KindInternal)
+	return ctx, func(err error) { span.End(fc.spanExporter(), err) }
 }
 
 // user facing method
 // recurisively mount the `src` directory on the server side to the `target` location at the client side with specified file system type
-func (fc *FileClient) Mount(src, target string, fstype FileSystemType) error {
+// like every user facing method, it gives up waiting for the server once ctx is done
+func (fc *FileClient) Mount(ctx context.Context, src, target string, fstype FileSystemType) (err error) {
+	ctx, end := fc.startSpan(ctx, "FileClient.Mount")
+	defer func() { end(err) }()
 	args := &MountRequest{FilePath: src}
 	args.ClientId = fc.id
 	args.ClientAddr = fc.addr
 	args.FileSystemType = string(fstype)
 	var reply MountResponse
-	if err := fc.rpcClient.Call("FileServer.Mount", args, &reply); err != nil {
+	if err := fc.rpcClient.CallContext(ctx, "FileServer.Mount", args, &reply); err != nil {
 		return fmt.Errorf("[file client %s]: call FileServer.Mount error: %v", fc.id, err)
 	}
-	fc.logger.Printf("INFO [file client %s]: %s is mounted at %v", fc.id, src, target)
 	root := NewFileDescriptor(reply.IsDir, reply.FilePath, uint64(reply.Size))
-	childrenPaths := strings.Split(reply.ChildrenPaths, ":")
-	for _, cp := range childrenPaths {
-		fc.mountRecursive(root, cp, fstype)
+	if err := fc.mountTree(ctx, root, childPaths(&reply), fstype); err != nil {
+		return fmt.Errorf("[file client %s]: call FileServer.Mount error: %v", fc.id, err)
 	}
+	fc.logger.PrintfContext(ctx, "INFO [file client %s]: %s is mounted at %v", fc.id, src, target)
+	fc.mu.Lock()
 	fc.volumes[target] = NewVolume(root, fstype)
+	fc.mu.Unlock()
 
 	// NFS requires polling at the client side
 	if fstype == SunNetworkFileSystemType {
@@ -94,30 +192,69 @@ func (fc *FileClient) Mount(src, target string, fstype FileSystemType) error {
 	return nil
 }
 
-func (fc *FileClient) mountRecursive(root *FileDescriptor, filepath string, fstype FileSystemType) {
-	if root == nil || filepath == "" {
-		return
-	}
-	args := &MountRequest{FilePath: filepath}
-	if fstype == AndrewFileSystemType {
-		args.ClientId = fc.id
-		args.ClientAddr = fc.addr
-	}
-	var reply MountResponse
-	_ = fc.rpcClient.Call("FileServer.Mount", args, &reply)
-	fd := NewFileDescriptor(reply.IsDir, reply.FilePath, uint64(reply.Size))
-	root.Children = append(root.Children, fd)
-	childrenPaths := strings.Split(reply.ChildrenPaths, ":")
+// mountTree mounts the descendants of root one level at a time,
+// the files and directories of a level are mounted in a single batch of calls
+func (fc *FileClient) mountTree(ctx context.Context, root *FileDescriptor, childrenPaths []string, fstype FileSystemType) error {
+	type entry struct {
+		parent   *FileDescriptor
+		filepath string
+	}
+	var level []entry
 	for _, cp := range childrenPaths {
-		fc.mountRecursive(fd, cp, fstype)
+		level = append(level, entry{root, cp})
+	}
+	for len(level) > 0 {
+		batch := fc.rpcClient.NewBatch(ctx)
+		calls := make([]*rpc.Call, 0, len(level))
+		replies := make([]MountResponse, len(level))
+		var mounted []entry
+		for _, e := range level {
+			if e.filepath == "" {
+				continue
+			}
+			args := &MountRequest{FilePath: e.filepath}
+			if fstype == AndrewFileSystemType {
+				args.ClientId = fc.id
+				args.ClientAddr = fc.addr
+			}
+			calls = append(calls, batch.Add("FileServer.Mount", args, &replies[len(calls)]))
+			mounted = append(mounted, e)
+		}
+		batch.Do()
+		var next []entry
+		for i, call := range calls {
+			if call.Error != nil {
+				return call.Error
+			}
+			reply := replies[i]
+			fd := NewFileDescriptor(reply.IsDir, reply.FilePath, uint64(reply.Size))
+			mounted[i].parent.Children = append(mounted[i].parent.Children, fd)
+			for _, cp := range childPaths(&reply) {
+				next = append(next, entry{fd, cp})
+			}
+		}
+		level = next
+	}
+	return nil
+}
+
+// childPaths returns the children of a mounted file, servers that predate ChildPaths only send ChildrenPaths
+func childPaths(reply *MountResponse) []string {
+	if len(reply.ChildPaths) > 0 {
+		return reply.ChildPaths
 	}
+	return strings.Split(reply.ChildrenPaths, ":")
 }
 
 func (fc *FileClient) monitor(src, target string) error {
 	<-time.After(time.Duration(Duration) * time.Second)
-	fc.stop <- struct{}{}
+	// stop a poller if there is one, a volume mounted the andrew filesystem way has none
+	select {
+	case fc.stop <- struct{}{}:
+	default:
+	}
 	fc.logger.Printf("INFO [file client %s]: timeout, unmounting file: %s", fc.id, target)
-	return fc.unmount(src, target)
+	return fc.unmount(context.Background(), src, target)
 }
 
 func (fc *FileClient) poll() {
@@ -126,6 +263,8 @@ func (fc *FileClient) poll() {
 		select {
 		case <-fc.stop:
 			return
+		case <-fc.done:
+			return
 		default:
 			// check for all cached(open) file
 			now := time.Now()
@@ -137,11 +276,14 @@ func (fc *FileClient) poll() {
 				}
 				getArgs := &GetAttributeRequest{ClientId: fc.id, FilePath: filepath}
 				var getReply GetAttributeResponse
-				if err := fc.rpcClient.Call("FileServer.GetAttribute", getArgs, &getReply); err != nil {
+				if err := fc.rpcClient.CallContext(context.Background(), "FileServer.GetAttribute", getArgs, &getReply); err != nil {
 					fc.logger.Printf("ERROR [file client %s]: call FileServer.GetAttribute error: %v", fc.id, err)
 					return true
 				}
 				_, fd, _ := fc.find(filepath)
+				if fd == nil {
+					return true // unmounted meanwhile
+				}
 				lastModifiedAtServer := getReply.LastModified
 				if lastModifiedAtServer == fd.LastModified {
 					// no change at the server, update the lastValidated timestamp
@@ -151,7 +293,7 @@ func (fc *FileClient) poll() {
 				// invalidated the entry
 				readArgs := &ReadRequest{FilePath: fd.Filepath}
 				var readReply ReadResponse
-				if err := fc.rpcClient.Call("FileServer.Read", readArgs, &readReply); err != nil {
+				if err := fc.rpcClient.CallContext(context.Background(), "FileServer.Read", readArgs, &readReply); err != nil {
 					fc.logger.Printf("ERROR [file client %s]: call FileServer.Read error: %v", fc.id, err)
 					return true
 				}
@@ -167,38 +309,45 @@ func (fc *FileClient) poll() {
 
 // user facing method
 // ummoun the specified `target` file path
-func (fc *FileClient) unmount(src, target string) error {
+func (fc *FileClient) unmount(ctx context.Context, src, target string) error {
 	args := &UnmountRequest{FilePath: src, ClientId: fc.id}
 	var reply UnmountResponse
-	if err := fc.rpcClient.Call("FileServer.Unmount", args, &reply); err != nil {
+	if err := fc.rpcClient.CallContext(ctx, "FileServer.Unmount", args, &reply); err != nil {
 		return fmt.Errorf("[file client %s]: call FileServer.Unmount error: %v", fc.id, err)
 	}
+	fc.mu.Lock()
 	delete(fc.volumes, target)
+	fc.mu.Unlock()
 	fc.ListAllFiles()
 	return nil
 }
 
 // user facing method
 // creates a file with a relative file name on the server side
-func (fc *FileClient) Create(localPath string) (*FileDescriptor, error) {
-	mountPoint, err := fc.checkMountingPoint(localPath)
+func (fc *FileClient) Create(ctx context.Context, localPath string) (_ *FileDescriptor, err error) {
+	ctx, end := fc.startSpan(ctx, "FileClient.Create")
+	defer func() { end(err) }()
+	mountPoint, v, err := fc.checkMountingPoint(localPath)
 	if err != nil {
 		return nil, fmt.Errorf("[file client %s]: %v", fc.id, err)
 	}
-	v := fc.volumes[mountPoint]
 	filepathSuffix := strings.TrimPrefix(localPath, mountPoint)
+	fc.mu.RLock()
 	fd := Search(v.root, filepathSuffix)
+	fc.mu.RUnlock()
 	// create a file descriptor only when the file does not exist
 	if fd == nil {
 		args := &CreateRequest{FilePath: fp.Join(v.root.Filepath, filepathSuffix), ClientId: fc.id}
 		var reply CreateResponse
-		if err := fc.rpcClient.Call("FileServer.Create", args, &reply); err != nil {
+		if err := fc.rpcClient.CallContext(ctx, "FileServer.Create", args, &reply); err != nil {
 			return nil, fmt.Errorf("[file client %s]: call FileServer.Create error: %v", fc.id, err)
 		}
 
 		fd := NewFileDescriptor(false, fp.Join(v.root.Filepath, filepathSuffix), 0)
 		fd.LastModified = reply.LastModified
+		fc.mu.Lock()
 		AddToTree(v.root, fd)
+		fc.mu.Unlock()
 		return fd, nil
 	} else {
 		fc.cache.Set(fd.Filepath, []byte{})
@@ -206,37 +355,45 @@ func (fc *FileClient) Create(localPath string) (*FileDescriptor, error) {
 	return fd, nil
 }
 
-func (fc *FileClient) checkMountingPoint(file string) (string, error) {
-	for mountPoint := range fc.volumes {
+// checkMountingPoint returns the mount point of the file and its volume
+func (fc *FileClient) checkMountingPoint(file string) (string, *Volume, error) {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	for mountPoint, v := range fc.volumes {
 		if strings.HasPrefix(file, mountPoint) {
-			return mountPoint, nil
+			return mountPoint, v, nil
 		}
 	}
-	return "", os.ErrNotExist
+	return "", nil, os.ErrNotExist
 }
 
 // user facing method
 // allows user to open a file path
-func (fc *FileClient) Open(localPath string) (*FileDescriptor, error) {
-	mountPoint, err := fc.checkMountingPoint(localPath)
+func (fc *FileClient) Open(ctx context.Context, localPath string) (_ *FileDescriptor, err error) {
+	ctx, end := fc.startSpan(ctx, "FileClient.Open")
+	defer func() { end(err) }()
+	mountPoint, v, err := fc.checkMountingPoint(localPath)
 	if err != nil {
 		return nil, err
 	}
-	v := fc.volumes[mountPoint]
 	filepath := strings.TrimPrefix(localPath, mountPoint)
+	fc.mu.RLock()
 	fd := Search(v.root, filepath)
+	fc.mu.RUnlock()
 	if fd == nil {
 		return nil, fmt.Errorf("unable to find file %s", localPath)
 	}
 	// always read the whole file from the server
 	args := &ReadRequest{FilePath: fd.Filepath}
 	var reply ReadResponse
-	if err := fc.rpcClient.Call("FileServer.Read", args, &reply); err != nil {
+	if err := fc.rpcClient.CallContext(ctx, "FileServer.Read", args, &reply); err != nil {
 		return nil, fmt.Errorf("call FileServer.Read error: %v", err)
 	}
 	fc.cache.Set(fd.Filepath, reply.Data)
 	if v.fstype == AndrewFileSystemType {
+		fc.mu.Lock()
 		fd.CallbackPromise = NewCallbackPromise()
+		fc.mu.Unlock()
 	}
 	return fd, nil
 }
@@ -245,7 +402,9 @@ func (fc *FileClient) Open(localPath string) (*FileDescriptor, error) {
 // Idempotent Read Operation:
 // stateless read operation, does not change the seeker position of the file descriptor both at the server and client side
 // Note: provIded file must be a single file not a directory
-func (fc *FileClient) ReadAt(fd *FileDescriptor, offset, n int) ([]byte, error) {
+func (fc *FileClient) ReadAt(ctx context.Context, fd *FileDescriptor, offset, n int) (_ []byte, err error) {
+	ctx, end := fc.startSpan(ctx, "FileClient.ReadAt")
+	defer func() { end(err) }()
 	if fd == nil {
 		return nil, fmt.Errorf("invalid read operation, file descriptor is null")
 	}
@@ -253,11 +412,11 @@ func (fc *FileClient) ReadAt(fd *FileDescriptor, offset, n int) ([]byte, error)
 		return nil, fmt.Errorf("invalid read operation, current file is a directory")
 	}
 	// check cache
-	if _, err := fc.cache.Get(fd.Filepath); err != nil {
+	if _, err := fc.cache.Lookup(fd.Filepath); err != nil {
 		// not cached
 		args := &ReadRequest{FilePath: fd.Filepath}
 		var reply ReadResponse
-		if err := fc.rpcClient.Call("FileServer.Read", args, &reply); err != nil {
+		if err := fc.rpcClient.CallContext(ctx, "FileServer.Read", args, &reply); err != nil {
 			return nil, fmt.Errorf("call FileServer.Read error: %v", err)
 		}
 		fc.cache.Set(fd.Filepath, reply.Data)
@@ -273,7 +432,9 @@ func (fc *FileClient) ReadAt(fd *FileDescriptor, offset, n int) ([]byte, error)
 // user facing method
 // Non-Idempotent Read: read from last seek position recorded at server side
 // Note: provided file must be a single file not a directory
-func (fc *FileClient) Read(fd *FileDescriptor, n int) ([]byte, error) {
+func (fc *FileClient) Read(ctx context.Context, fd *FileDescriptor, n int) (_ []byte, err error) {
+	ctx, end := fc.startSpan(ctx, "FileClient.Read")
+	defer func() { end(err) }()
 	if fd == nil {
 		return nil, fmt.Errorf("invalid read operation, filedescriptor is null")
 	}
@@ -281,11 +442,11 @@ func (fc *FileClient) Read(fd *FileDescriptor, n int) ([]byte, error) {
 		return nil, fmt.Errorf("invalid read operation, current file is a directory")
 	}
 	// check cache
-	if _, err := fc.cache.Get(fd.Filepath); err != nil {
+	if _, err := fc.cache.Lookup(fd.Filepath); err != nil {
 		// not cached
 		args := &ReadRequest{FilePath: fd.Filepath}
 		var reply ReadResponse
-		if err := fc.rpcClient.Call("FileServer.Read", args, &reply); err != nil {
+		if err := fc.rpcClient.CallContext(ctx, "FileServer.Read", args, &reply); err != nil {
 			return nil, fmt.Errorf("call FileServer.Read error: %v", err)
 		}
 		fc.cache.Set(fd.Filepath, reply.Data)
@@ -294,7 +455,7 @@ func (fc *FileClient) Read(fd *FileDescriptor, n int) ([]byte, error) {
 	cached, _ := fc.cache.Get(fd.Filepath)
 	args := &UpdateAttributeRequest{ClientId: fc.id, FilePath: fd.Filepath, FileSeekerIncrement: int64(n)}
 	var reply UpdateAttributeResponse
-	if err := fc.rpcClient.Call("FileServer.UpdateAttribute", args, &reply); err != nil {
+	if err := fc.rpcClient.CallContext(ctx, "FileServer.UpdateAttribute", args, &reply); err != nil {
 		return nil, fmt.Errorf("call FileServer.UpdateAttribute error: %v", err)
 	}
 	// update last read end position
@@ -306,7 +467,9 @@ func (fc *FileClient) Read(fd *FileDescriptor, n int) ([]byte, error) {
 
 // user facing method
 // Nonidempotent write operation at the given file descriptor location
-func (fc *FileClient) Write(fd *FileDescriptor, offset int, data []byte) (int, error) {
+func (fc *FileClient) Write(ctx context.Context, fd *FileDescriptor, offset int, data []byte) (_ int, err error) {
+	ctx, end := fc.startSpan(ctx, "FileClient.Write")
+	defer func() { end(err) }()
 	if fd == nil {
 		return 0, fmt.Errorf("invalid write operation, filedescriptor is null")
 	}
@@ -315,11 +478,11 @@ func (fc *FileClient) Write(fd *FileDescriptor, offset int, data []byte) (int, e
 	}
 	// update cached content
 	// check cache
-	if _, err := fc.cache.Get(fd.Filepath); err != nil {
+	if _, err := fc.cache.Lookup(fd.Filepath); err != nil {
 		// not cached
 		args := &ReadRequest{FilePath: fd.Filepath}
 		var reply ReadResponse
-		if err := fc.rpcClient.Call("FileServer.Read", args, &reply); err != nil {
+		if err := fc.rpcClient.CallContext(ctx, "FileServer.Read", args, &reply); err != nil {
 			return 0, fmt.Errorf("call FileServer.Read error: %v", err)
 		}
 		fc.cache.Set(fd.Filepath, reply.Data)
@@ -343,8 +506,8 @@ func (fc *FileClient) Write(fd *FileDescriptor, offset int, data []byte) (int, e
 			// evict cache to server as soon as possible
 			args := &WriteRequest{ClientId: fc.id, FilePath: fd.Filepath, Data: cached.Bytes()}
 			var reply WriteResponse
-			if err := fc.rpcClient.Call("FileServer.Write", args, &reply); err != nil {
-				fc.logger.Printf("ERROR [file client %s] call FileServer.Write error: %v", fc.id, err)
+			if err := fc.rpcClient.CallContext(ctx, "FileServer.Write", args, &reply); err != nil {
+				fc.logger.PrintfContext(ctx, "ERROR [file client %s] call FileServer.Write error: %v", fc.id, err)
 				return 0, err
 			} else {
 				cached.dirty = false
@@ -356,7 +519,9 @@ func (fc *FileClient) Write(fd *FileDescriptor, offset int, data []byte) (int, e
 
 // user facing method
 // close the file descriptor
-func (fc *FileClient) Close(fd *FileDescriptor) {
+func (fc *FileClient) Close(ctx context.Context, fd *FileDescriptor) {
+	ctx, end := fc.startSpan(ctx, "FileClient.Close")
+	defer end(nil)
 	if fd == nil {
 		return
 	}
@@ -380,8 +545,8 @@ func (fc *FileClient) Close(fd *FileDescriptor) {
 	// evict cache to server
 	args := &WriteRequest{ClientId: fc.id, FilePath: fd.Filepath, Data: cached.Bytes()}
 	var reply WriteResponse
-	if err := fc.rpcClient.Call("FileServer.Write", args, &reply); err != nil {
-		fc.logger.Printf("ERROR [file client %s] call FileServer.Write error: %v", fc.id, err)
+	if err := fc.rpcClient.CallContext(ctx, "FileServer.Write", args, &reply); err != nil {
+		fc.logger.PrintfContext(ctx, "ERROR [file client %s] call FileServer.Write error: %v", fc.id, err)
 		return
 	}
 	cached.dirty = false
@@ -390,6 +555,8 @@ func (fc *FileClient) Close(fd *FileDescriptor) {
 // user facing method
 // to display all the mounted files
 func (fc *FileClient) ListAllFiles() {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
 	fmt.Printf("[file client %s] local file tree:\n", fc.id)
 	for root, v := range fc.volumes {
 		PrintTree(root, v.root)
@@ -399,30 +566,44 @@ func (fc *FileClient) ListAllFiles() {
 // user facing method
 // to display all files under a given directory, essentially a `ls` command
 func (fc *FileClient) ListFiles(path string) {
-	mountPoint, err := fc.checkMountingPoint(path)
+	_, v, err := fc.checkMountingPoint(path)
 	if err != nil {
 		fc.logger.Printf("ERROR [file client %s]: %v", fc.id, err)
 		return
 	}
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
 	fmt.Printf("[file client %s] local file tree:\n", fc.id)
-	v := fc.volumes[mountPoint]
 	PrintTree(path, v.root)
 }
 
 // server facing method i.e. rpc
-// an endpoint to allow server to update the callback promise
-func (fc *FileClient) UpdateCallbackPromise(req UpdateCallbackPromiseRequest, resp *UpdateCallbackPromiseResponse) error {
-	fc.logger.Printf("INFO [file client %s] FileClient.UpdateCallbackPromise is called", fc.id)
-	_, fd, _ := fc.find(req.FilePath)
-	if fd == nil || fd.CallbackPromise == nil {
+// an endpoint to allow server to update the callback promise, served as a notification the server does not wait for,
+// or as a call for the servers that predate notifications, which wait for the response
+func (fc *FileClient) UpdateCallbackPromise(ctx context.Context, req UpdateCallbackPromiseRequest, resp *UpdateCallbackPromiseResponse) error {
+	fc.logger.PrintfContext(ctx, "INFO [file client %s] FileClient.UpdateCallbackPromise is called", fc.id)
+	fc.mu.RLock()
+	var promise *CallbackPromise
+	if _, fd, _ := fc.findLocked(req.FilePath); fd != nil {
+		promise = fd.CallbackPromise
+	}
+	fc.mu.RUnlock()
+	if promise == nil {
 		return nil
 	}
-	fd.CallbackPromise.Set(req.IsValidOrCanceled)
-	fc.logger.Printf("INFO [file client %s]: content in %s has updated\n", fc.id, req.FilePath)
+	promise.Set(req.IsValidOrCanceled)
+	fc.logger.PrintfContext(ctx, "INFO [file client %s]: content in %s has updated\n", fc.id, req.FilePath)
 	return nil
 }
 
 func (fc *FileClient) find(filepath string) (*Volume, *FileDescriptor, error) {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.findLocked(filepath)
+}
+
+// findLocked is find with fc.mu held
+func (fc *FileClient) findLocked(filepath string) (*Volume, *FileDescriptor, error) {
 	for _, v := range fc.volumes {
 		found := Search(v.root, filepath)
 		if found != nil {
@@ -432,7 +613,16 @@ func (fc *FileClient) find(filepath string) (*Volume, *FileDescriptor, error) {
 	return nil, nil, os.ErrNotExist
 }
 
+// Shutdown stops the pollers, closes the connection to the server and stops serving the callbacks,
+// then stops serving the metrics and closes the file the spans are exported to
 func (fc *FileClient) Shutdown() {
-	fc.stop <- struct{}{}
+	fc.doneOnce.Do(func() { close(fc.done) })
+	fc.rpcClient.Close()
 	fc.rpcServer.Shutdown()
+	if fc.metrics != nil {
+		fc.metrics.Close()
+	}
+	if fc.exporter != nil {
+		fc.exporter.Close()
+	}
 }
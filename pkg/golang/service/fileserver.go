@@ -1,23 +1,38 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"distributed-file-system/pkg/golang/logger"
+	"distributed-file-system/pkg/golang/metrics"
 	"distributed-file-system/pkg/golang/rpc"
+	"distributed-file-system/pkg/golang/trace"
 )
 
+var ErrUnauthorized = errors.New("file server: request not signed with the key of its client")
+
+// FileServer serves the requests of the clients concurrently, mu keeps the requests
+// that change the file index trees or the exported files from running alongside any other
 type FileServer struct {
 	addr              string
 	rpcServer         *rpc.Server
+	mu                sync.RWMutex               // protect the file index trees and the exported files
 	exportedRootPaths []string                   // top level directory path that the server is exporting
 	fileIndexTrees    map[string]*FileDescriptor // key: exported root path, value: fd, each fd must be independent of other
+	keyring           *rpc.Keyring               // shared keys of the clients, nil if messages are not authenticated
+	encrypt           bool                       // encrypt the messages with the keys of the keyring
+	callbackPool      *CallbackPool              // clients calling back the subscribers that can not be called back over their connection
+	callbacks         *metrics.Counter           // callbacks to the clients by outcome, nil unless metrics are served
+	metrics           net.Listener               // serves the metrics, nil unless enabled
+	exporter          *trace.JSONExporter        // exporter of the spans, nil unless spans are exported
 	logger            *logger.Logger
 }
 
@@ -44,13 +59,15 @@ func (fs *FileServer) find(file string) (string, string, error) {
 	return root, path, nil
 }
 
-func (fs *FileServer) Mount(req MountRequest, resp *MountResponse) error {
-	fs.logger.Printf("INFO [file server] FileServer.Mount is called")
+func (fs *FileServer) Mount(ctx context.Context, req MountRequest, resp *MountResponse) error {
+	fs.logger.PrintfContext(ctx, "INFO [file server] FileServer.Mount is called")
 	// every filepath is found through root + path for security
 	rootpath, path, err := fs.find(req.FilePath)
 	if err != nil {
 		return fmt.Errorf("file server: %v", err)
 	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	rootfd := fs.fileIndexTrees[rootpath]
 	fd := Search(rootfd, path)
 	if fd == nil {
@@ -60,28 +77,40 @@ func (fs *FileServer) Mount(req MountRequest, resp *MountResponse) error {
 		// the client operates in an andrew filesystem way
 		// server records the client and sent back a callback promise
 		// the callback promise is initialized as valid
-		Subscribe(fd, req.ClientId, req.ClientAddr)
+		// the client is called back over its own connection, or at its address if it predates it
+		peer, err := rpc.PeerOf(ctx)
+		if err != nil {
+			fs.logger.PrintfContext(ctx, "INFO [file server] client %s can not be called back over its connection, using its address %q: %v", req.ClientId, req.ClientAddr, err)
+		}
+		Subscribe(fd, req.ClientId, req.ClientAddr, peer)
 		resp.CallbackPromise = true
 	}
 	resp.IsDir = fd.IsDir
 	resp.FilePath = fd.Filepath
 	resp.Size = int64(fd.Size)
-	childrenPaths := ""
 	for _, cfd := range fd.Children {
-		childrenPaths = fmt.Sprintf("%s:%s", childrenPaths, cfd.Filepath)
+		resp.ChildPaths = append(resp.ChildPaths, cfd.Filepath)
+		resp.ChildrenPaths = fmt.Sprintf("%s:%s", resp.ChildrenPaths, cfd.Filepath)
 	}
-	resp.ChildrenPaths = childrenPaths
 	resp.LastModified = fd.LastModified
 	return nil
 }
 
+// IdempotentMethods lists the methods that can safely run again when a request is retransmitted,
+// the server caches the replies of the others to run them at most once
+func (fs *FileServer) IdempotentMethods() []string {
+	return []string{"Mount", "Unmount", "GetAttribute", "Read"}
+}
+
 // unmount will unsubscribe the requested client from the list
-func (fs *FileServer) Unmount(req UnmountRequest, resp *UnmountResponse) error {
-	fs.logger.Printf("INFO [file server] FileServer.Unmount is called")
+func (fs *FileServer) Unmount(ctx context.Context, req UnmountRequest, resp *UnmountResponse) error {
+	fs.logger.PrintfContext(ctx, "INFO [file server] FileServer.Unmount is called")
 	root, path, err := fs.find(req.FilePath)
 	if err != nil {
 		return fmt.Errorf("file server: %v", err)
 	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	rootfd := fs.fileIndexTrees[root]
 	fd := Search(rootfd, path)
 	Unsubscribe(fd, req.ClientId)
@@ -89,12 +118,14 @@ func (fs *FileServer) Unmount(req UnmountRequest, resp *UnmountResponse) error {
 	return nil
 }
 
-func (fs *FileServer) GetAttribute(req GetAttributeRequest, resp *GetAttributeResponse) error {
-	fs.logger.Printf("INFO [file server] FileServer.GetAttribute is called")
+func (fs *FileServer) GetAttribute(ctx context.Context, req GetAttributeRequest, resp *GetAttributeResponse) error {
+	fs.logger.PrintfContext(ctx, "INFO [file server] FileServer.GetAttribute is called")
 	root, path, err := fs.find(req.FilePath)
 	if err != nil {
 		return fmt.Errorf("file server: %v", err)
 	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	rootfd := fs.fileIndexTrees[root]
 	fd := Search(rootfd, path)
 	resp.IsDir = fd.IsDir
@@ -105,12 +136,14 @@ func (fs *FileServer) GetAttribute(req GetAttributeRequest, resp *GetAttributeRe
 }
 
 // updates the seeker position of the file descriptor
-func (fs *FileServer) UpdateAttribute(req UpdateAttributeRequest, resp *UpdateAttributeResponse) error {
-	fs.logger.Printf("INFO [file server] FileServer.UpdateAttribute is called")
+func (fs *FileServer) UpdateAttribute(ctx context.Context, req UpdateAttributeRequest, resp *UpdateAttributeResponse) error {
+	fs.logger.PrintfContext(ctx, "INFO [file server] FileServer.UpdateAttribute is called")
 	root, path, err := fs.find(req.FilePath)
 	if err != nil {
 		return fmt.Errorf("file server: %v", err)
 	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 	rootfd := fs.fileIndexTrees[root]
 	fd := Search(rootfd, path)
 	incr := uint64(req.FileSeekerIncrement)
@@ -127,60 +160,74 @@ func (fs *FileServer) UpdateAttribute(req UpdateAttributeRequest, resp *UpdateAt
 }
 
 // idempotent operation
-func (fs *FileServer) Create(req CreateRequest, resp *CreateResponse) error {
-	fs.logger.Printf("INFO [file server] FileServer.Create is called")
+func (fs *FileServer) Create(ctx context.Context, req CreateRequest, resp *CreateResponse) error {
+	fs.logger.PrintfContext(ctx, "INFO [file server] FileServer.Create is called")
 	parentDir := filepath.Dir(req.FilePath)
 	root, _, err := fs.find(parentDir)
 	if err != nil {
 		return err
 	}
+	fs.mu.Lock()
+	pfd, created, err := fs.create(root, parentDir, req.FilePath)
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if created {
+		// update the registered clients in the background, once the lock is released
+		args := &UpdateCallbackPromiseRequest{
+			FilePath:          pfd.Filepath,
+			IsValidOrCanceled: false,
+		}
+		pfd.subscription.Broadcast(ctx, req.ClientId, args, fs.countCallbacks) // tell everyone who listens on the parent directory that there is a change to the parent directory
+		resp.IsSuccess = true
+	}
+	return nil
+}
+
+// create creates the file, or truncates it if it already exists, and returns the
+// file descriptor of its parent directory and whether the file is new. fs.mu must be held.
+func (fs *FileServer) create(root, parentDir, filePath string) (*FileDescriptor, bool, error) {
 	// check if the parent directory exists
 	if _, err := os.Stat(filepath.Join(root, parentDir)); errors.Is(err, os.ErrNotExist) {
-		return fmt.Errorf("file server: dir %s does not exist", parentDir)
+		return nil, false, fmt.Errorf("file server: dir %s does not exist", parentDir)
 	}
 	rootfd := fs.fileIndexTrees[root]
 	pfd := Search(rootfd, parentDir)
 	if pfd == nil {
-		return fmt.Errorf("file server: parent dir %s does not exist", parentDir)
+		return nil, false, fmt.Errorf("file server: parent dir %s does not exist", parentDir)
 	}
 	// check if the file exists
-	localPath := filepath.Join(root, req.FilePath)
+	localPath := filepath.Join(root, filePath)
 	if _, err := os.Stat(localPath); errors.Is(err, os.ErrNotExist) {
 		_, err = os.Create(localPath)
 		if err != nil {
-			return fmt.Errorf("file server: create error %v", err)
+			return nil, false, fmt.Errorf("file server: create error %v", err)
 		}
-		fd := NewFileDescriptor(false, req.FilePath, 0)
-		fd.subscription = NewSubscription(fs.logger)
+		fd := NewFileDescriptor(false, filePath, 0)
+		fd.subscription = NewSubscription(fs.callbackPool.Get, fs.logger)
 		fd.LastModified = time.Now().Unix()
 		// add to tree
 		pfd.AddChild(fd)
-		// update the registered client
-		args := &UpdateCallbackPromiseRequest{
-			FilePath:          pfd.Filepath,
-			IsValidOrCanceled: false,
-		}
-		pfd.subscription.Broadcast(req.ClientId, args) // tell everyone who listens on the parent directory that there is a change to the parent directory
-		resp.IsSuccess = true
-	} else {
-		// overwrite the file if it already exists
-		_, err = os.Create(localPath)
-		if err != nil {
-			return fmt.Errorf("file server: create error %v", err)
-		}
+		return pfd, true, nil
 	}
-
-	return nil
+	// overwrite the file if it already exists
+	if _, err := os.Create(localPath); err != nil {
+		return nil, false, fmt.Errorf("file server: create error %v", err)
+	}
+	return pfd, false, nil
 }
 
 // Read operation sends the entire file content to the client
-func (fs *FileServer) Read(req ReadRequest, resp *ReadResponse) error {
-	fs.logger.Printf("INFO [file server] FileServer.Read is called")
+func (fs *FileServer) Read(ctx context.Context, req ReadRequest, resp *ReadResponse) error {
+	fs.logger.PrintfContext(ctx, "INFO [file server] FileServer.Read is called")
 	root, _, err := fs.find(req.FilePath)
 	if err != nil {
 		return err
 	}
 	localPath := filepath.Join(root, req.FilePath)
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	if _, err := os.Stat(localPath); os.IsNotExist(err) {
 		return fmt.Errorf("file server: open error: %v", err)
 	}
@@ -193,34 +240,45 @@ func (fs *FileServer) Read(req ReadRequest, resp *ReadResponse) error {
 }
 
 // Write operation writes the byte data to the specified file
-func (fs *FileServer) Write(req WriteRequest, resp *WriteResponse) error {
-	fs.logger.Printf("INFO [file server] FileServer.Write is called")
+func (fs *FileServer) Write(ctx context.Context, req WriteRequest, resp *WriteResponse) error {
+	fs.logger.PrintfContext(ctx, "INFO [file server] FileServer.Write is called")
 	root, _, err := fs.find(req.FilePath)
 	if err != nil {
 		return err
 	}
-	localPath := filepath.Join(root, req.FilePath)
-	// overwrites the original data
-	f, err := os.Create(localPath)
-	if err != nil {
-		return fmt.Errorf("file server: %v", err)
-	}
-	defer f.Close()
-	_, err = f.Write(req.Data)
+	fs.mu.Lock()
+	fd, err := fs.write(root, req.FilePath, req.Data)
+	fs.mu.Unlock()
 	if err != nil {
-		return fmt.Errorf("file server: write error %v", err)
+		return err
 	}
-	fd := Search(fs.fileIndexTrees[root], req.FilePath)
-	fd.LastModified = time.Now().Unix()
 	// if the client choose not to register here, no update would be seen at the client side
 	args := &UpdateCallbackPromiseRequest{
 		FilePath:          req.FilePath,
 		IsValidOrCanceled: false,
 	}
-	fd.subscription.Broadcast(req.ClientId, args)
+	fd.subscription.Broadcast(ctx, req.ClientId, args, fs.countCallbacks)
 	return nil
 }
 
+// write overwrites the file with data and returns its file descriptor. fs.mu must be held.
+func (fs *FileServer) write(root, filePath string, data []byte) (*FileDescriptor, error) {
+	localPath := filepath.Join(root, filePath)
+	// overwrites the original data
+	f, err := os.Create(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("file server: %v", err)
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	if err != nil {
+		return nil, fmt.Errorf("file server: write error %v", err)
+	}
+	fd := Search(fs.fileIndexTrees[root], filePath)
+	fd.LastModified = time.Now().Unix()
+	return fd, nil
+}
+
 func NewFileServer(addr string) *FileServer {
 	exportedRootPaths := os.Getenv("EXPORT_ROOT_PATHS")
 	paths := strings.Split(exportedRootPaths, ":")
@@ -232,6 +290,7 @@ func NewFileServer(addr string) *FileServer {
 		logger:            logger,
 		rpcServer:         rpc.NewServer(logger),
 	}
+	fs.callbackPool = NewCallbackPool(fs.dial, logger)
 	for _, path := range paths {
 		fs.fileIndexTrees[path] = fs.buildFileIndexTree(path)
 	}
@@ -241,13 +300,134 @@ func NewFileServer(addr string) *FileServer {
 	return fs
 }
 
+// SetKeyring makes the server accept only the messages signed with the key of a client,
+// and sign the callbacks to a client with its key. With encrypt set, the messages
+// are encrypted with the same keys as well. It must be called before Run.
+func (fs *FileServer) SetKeyring(keyring *rpc.Keyring, encrypt bool) {
+	fs.keyring = keyring
+	fs.encrypt = encrypt
+}
+
+// secure authenticates, and optionally encrypts, the messages of the transport
+func (fs *FileServer) secure(transport rpc.Transport, keyId string) rpc.Transport {
+	if fs.encrypt {
+		return rpc.NewSecureTransport(transport, fs.keyring, keyId, fs.logger)
+	}
+	return rpc.NewAuthTransport(transport, fs.keyring, keyId, fs.logger)
+}
+
+// authorize rejects the requests of a client made on behalf of another one, i.e. whose ClientId
+// is not the id of the key the request is signed with, so that no client can subscribe, unsubscribe
+// or write in the name of another
+func (fs *FileServer) authorize(ctx context.Context, addr net.Addr, h *rpc.Header, args, reply interface{}, next rpc.ServerHandler) error {
+	var clientId string
+	switch req := args.(type) {
+	case *MountRequest:
+		clientId = req.ClientId
+	case *UnmountRequest:
+		clientId = req.ClientId
+	case *CreateRequest:
+		clientId = req.ClientId
+	case *RemoveRequest:
+		clientId = req.ClientId
+	case *WriteRequest:
+		clientId = req.ClientId
+	case *GetAttributeRequest:
+		clientId = req.ClientId
+	case *UpdateAttributeRequest:
+		clientId = req.ClientId
+	default:
+		return next(ctx, addr, h, args, reply)
+	}
+	if a, ok := addr.(*rpc.AuthAddr); !ok || a.KeyId != clientId {
+		fs.logger.PrintfContext(ctx, "ERROR [file server] rejecting %s of client %q from %s, not signed with its key", h.ServiceMethod, clientId, addr)
+		return ErrUnauthorized
+	}
+	return next(ctx, addr, h, args, reply)
+}
+
+// dial connects to the callback endpoint of a subscriber that can not be called back over its connection
+func (fs *FileServer) dial(member *Subscriber) (*rpc.Client, error) {
+	transport, remote, err := rpc.DialTransport(member.Addr, fs.logger)
+	if err != nil {
+		return nil, err
+	}
+	if fs.keyring != nil {
+		transport = fs.secure(transport, member.Id)
+	}
+	client := rpc.NewClient(transport, remote, fs.logger)
+	if fs.exporter != nil {
+		client.SetSpanExporter(fs.exporter)
+	}
+	return client, nil
+}
+
+// SetClientRateLimit limits the requests of each client, clients exceeding it are throttled
+func (fs *FileServer) SetClientRateLimit(limit rpc.RateLimit) {
+	fs.rpcServer.SetClientRateLimit(limit)
+}
+
+// SetMethodRateLimit limits the requests of each client for a single method, e.g. "Write"
+func (fs *FileServer) SetMethodRateLimit(method string, limit rpc.RateLimit) {
+	fs.rpcServer.SetMethodRateLimit("FileServer."+method, limit)
+}
+
+// SetMaxConcurrentRequests caps the number of requests executing at once, 0 removes the cap
+func (fs *FileServer) SetMaxConcurrentRequests(n int) {
+	fs.rpcServer.SetMaxConcurrentRequests(n)
+}
+
+// EnableReplyLog keeps the replies to the clients in the file at path,
+// so that requests are still executed at most once after the server restarts
+func (fs *FileServer) EnableReplyLog(path string) error {
+	return fs.rpcServer.EnableReplyLog(path)
+}
+
+// ServeMetrics serves the metrics of the server in the Prometheus text format at http://<addr>/metrics.
+// It must be called before Run.
+func (fs *FileServer) ServeMetrics(addr string) error {
+	reg := metrics.NewRegistry()
+	rpc.RegisterMetrics(reg)
+	fs.rpcServer.Instrument(reg)
+	fs.callbacks = reg.NewCounter("file_server_callbacks_total", "Callbacks sent to the clients to cancel their callback promises, by outcome.", "outcome")
+	reg.NewGaugeFunc("file_server_callback_clients", "Clients kept to call back the clients that can not be called back over their connection.",
+		func() float64 { return float64(fs.callbackPool.Len()) })
+	l, err := reg.Serve(addr)
+	if err != nil {
+		return err
+	}
+	fs.metrics = l
+	fs.logger.Printf("INFO [file server]: serving metrics on %s", l.Addr().String())
+	return nil
+}
+
+// ExportSpans appends the spans of the requests the server serves, and of the callbacks
+// it sends, to the file at path as JSON lines. It must be called before Run.
+func (fs *FileServer) ExportSpans(path string) error {
+	e, err := trace.OpenJSONExporter(path, "file server")
+	if err != nil {
+		return err
+	}
+	fs.exporter = e
+	fs.rpcServer.SetSpanExporter(e)
+	return nil
+}
+
+func (fs *FileServer) countCallbacks(sent, failed int) {
+	if fs.callbacks == nil {
+		return
+	}
+	fs.callbacks.Add(float64(sent), "sent")
+	fs.callbacks.Add(float64(failed), "failed")
+}
+
 func (fs *FileServer) buildFileIndexTree(entry string) *FileDescriptor {
 	if entry == "" {
 		panic("no exported directories")
 	}
 	info, _ := os.Stat(entry)
 	root := NewFileDescriptor(info.IsDir(), "", uint64(info.Size()))
-	root.subscription = NewSubscription(fs.logger)
+	root.subscription = NewSubscription(fs.callbackPool.Get, fs.logger)
 	parents := make(map[string]*FileDescriptor)
 	parents[entry] = root
 	err := filepath.Walk(entry, func(currentPath string, info os.FileInfo, err error) error {
@@ -256,7 +436,7 @@ func (fs *FileServer) buildFileIndexTree(entry string) *FileDescriptor {
 		}
 		pfd := parents[filepath.Dir(currentPath)]
 		cfd := NewFileDescriptor(info.IsDir(), strings.TrimPrefix(currentPath, entry), uint64(info.Size()))
-		cfd.subscription = NewSubscription(fs.logger)
+		cfd.subscription = NewSubscription(fs.callbackPool.Get, fs.logger)
 		pfd.AddChild(cfd)
 		if _, ok := parents[currentPath]; !ok {
 			parents[currentPath] = cfd
@@ -270,15 +450,30 @@ func (fs *FileServer) buildFileIndexTree(entry string) *FileDescriptor {
 	return root
 }
 
+// Run serves the file server at its address.
+// The address scheme chooses the transport, e.g. "tcp://:8080"; udp is used by default.
 func (fs *FileServer) Run() {
-	s, err := net.ResolveUDPAddr("udp", fs.addr)
-	if err != nil {
-		panic(fmt.Sprintf("server error resolving udp address: %v", err))
-	}
-	conn, err := net.ListenUDP("udp", s)
+	transport, err := rpc.Listen(fs.addr, fs.logger)
 	if err != nil {
 		panic(fmt.Sprintf("network error: %v", err))
 	}
-	fs.logger.Printf("INFO [file server]: listening on %s", conn.LocalAddr().String())
-	fs.rpcServer.Accept(conn)
+	if fs.keyring != nil {
+		transport = fs.secure(transport, "")
+		fs.rpcServer.Use(fs.authorize)
+	}
+	fs.logger.Printf("INFO [file server]: listening on %s", transport.LocalAddr().String())
+	fs.rpcServer.Accept(transport)
+}
+
+// Shutdown stops serving the requests and the metrics, closes the clients the callbacks are sent with
+// and the file the spans are exported to
+func (fs *FileServer) Shutdown() {
+	fs.rpcServer.Shutdown()
+	fs.callbackPool.Close()
+	if fs.metrics != nil {
+		fs.metrics.Close()
+	}
+	if fs.exporter != nil {
+		fs.exporter.Close()
+	}
 }
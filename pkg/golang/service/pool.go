@@ -0,0 +1,142 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"distributed-file-system/pkg/golang/logger"
+	"distributed-file-system/pkg/golang/rpc"
+)
+
+// default setting
+var (
+	CallbackIdleTimeout     time.Duration = 5 * time.Minute  // callback clients left unused this long are closed
+	CallbackCleanUpInterval time.Duration = 30 * time.Second // how often idle callback clients are looked for
+)
+
+var ErrPoolClosed = errors.New("callback pool: closed")
+
+// CallbackPool keeps a client per subscriber to send the callbacks over, so that broadcasts reuse
+// the clients instead of dialing new ones every time. Clients left unused for CallbackIdleTimeout
+// are closed, and dialed again on the next callback. The subscribers called back over their own
+// connection are sent the callbacks over it, the rpc server owns these clients and replaces
+// the ones it has closed, e.g. for being idle.
+type CallbackPool struct {
+	mu      sync.Mutex               // protect following
+	clients map[string]*pooledClient // key: subscriber id
+	closed  bool
+	dial    DialFunc // connects to the callback endpoint of a subscriber
+	stop    chan struct{}
+	logger  *logger.Logger
+}
+
+type pooledClient struct {
+	*rpc.Client
+	addr     string // callback endpoint the client is connected to
+	lastUsed time.Time
+}
+
+func NewCallbackPool(dial DialFunc, logger *logger.Logger) *CallbackPool {
+	p := &CallbackPool{
+		clients: make(map[string]*pooledClient),
+		dial:    dial,
+		stop:    make(chan struct{}),
+		logger:  logger,
+	}
+	go p.backgroundCleanUp()
+	return p
+}
+
+// Get returns the client of the subscriber, dialing it on first use or once the subscriber has moved
+// to another address. It is the DialFunc of the subscriptions sharing the pool.
+func (p *CallbackPool) Get(member *Subscriber) (*rpc.Client, error) {
+	if member.Peer != nil {
+		client, err := member.Peer.Client()
+		if err == nil || member.Addr == "" {
+			return client, err
+		}
+		p.logger.Printf("INFO [file server] %s can not be called back over its connection, dialing %s: %v", member.Id, member.Addr, err)
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	if c, ok := p.clients[member.Id]; ok && c.addr == member.Addr {
+		c.lastUsed = time.Now()
+		p.mu.Unlock()
+		return c.Client, nil
+	}
+	p.mu.Unlock()
+	// dial without holding the lock, a subscriber that can not be reached must not hold back the others
+	client, err := p.dial(member)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		client.Close()
+		return nil, ErrPoolClosed
+	}
+	if c, ok := p.clients[member.Id]; ok && c.addr == member.Addr {
+		// another broadcast has dialed the subscriber in the meantime
+		client.Close()
+		c.lastUsed = time.Now()
+		return c.Client, nil
+	} else if ok {
+		c.Close()
+	}
+	p.clients[member.Id] = &pooledClient{Client: client, addr: member.Addr, lastUsed: time.Now()}
+	return client, nil
+}
+
+// Len returns the number of clients in the pool
+func (p *CallbackPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.clients)
+}
+
+// Close closes every client of the pool, the callbacks sent afterwards fail with ErrPoolClosed
+func (p *CallbackPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrPoolClosed
+	}
+	p.closed = true
+	close(p.stop)
+	for id, c := range p.clients {
+		c.Close()
+		delete(p.clients, id)
+	}
+	return nil
+}
+
+func (p *CallbackPool) backgroundCleanUp() {
+	ticker := time.NewTicker(CallbackCleanUpInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.evictIdle()
+		}
+	}
+}
+
+// evictIdle closes the clients left unused for CallbackIdleTimeout
+func (p *CallbackPool) evictIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, c := range p.clients {
+		if time.Since(c.lastUsed) > CallbackIdleTimeout {
+			p.logger.Printf("INFO [file server] closing the idle callback client of %s at %s", id, c.addr)
+			c.Close()
+			delete(p.clients, id)
+		}
+	}
+}
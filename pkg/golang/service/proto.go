@@ -7,17 +7,18 @@ import (
 type MountRequest struct {
 	FileSystemType string // indicating client's mount file system type, i.e. Andrew File System or Sun Network File System
 	ClientId       string // indicating which client
-	ClientAddr     string // the client network address
+	ClientAddr     string // callback endpoint of the client for servers that can not call it back over its connection, may be empty
 	FilePath       string // the file path that the client is going to mount
 }
 
 type MountResponse struct {
-	IsDir           bool   //indicating if the requested file path is a directory
-	FilePath        string // the relative file path at the client side
-	Size            int64  // the size of the file
-	ChildrenPaths   string // list of children of the requested file path, concatenated into a string
-	LastModified    int64  // last modification time at the server side
-	CallbackPromise bool   // callback promise used in Andrew File System; true means this callback promise is valid
+	IsDir           bool     //indicating if the requested file path is a directory
+	FilePath        string   // the relative file path at the client side
+	Size            int64    // the size of the file
+	ChildrenPaths   string   // children of the requested file path joined with ":", for the clients that predate ChildPaths
+	LastModified    int64    // last modification time at the server side
+	CallbackPromise bool     // callback promise used in Andrew File System; true means this callback promise is valid
+	ChildPaths      []string // list of children of the requested file path, since schema version 2
 }
 
 type UnmountRequest struct {
@@ -102,7 +103,7 @@ type UpdateAttributeResponse struct {
 
 func init() {
 	rpc.RegisterType(MountRequest{})
-	rpc.RegisterType(MountResponse{})
+	rpc.RegisterVersionedType(MountResponse{}, 2) // version 2 adds ChildPaths
 	rpc.RegisterType(UnmountRequest{})
 	rpc.RegisterType(UnmountResponse{})
 	rpc.RegisterType(CreateRequest{})
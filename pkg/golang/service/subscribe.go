@@ -1,13 +1,23 @@
 package service
 
 import (
+	"context"
+	"sync"
+	"sync/atomic"
+
 	"distributed-file-system/pkg/golang/logger"
 	"distributed-file-system/pkg/golang/rpc"
 )
 
-// valid or cancelled
+// default setting
+var (
+	CallbackAttempts int = 3 // times each callback is sent, since the clients do not acknowledge them
+)
+
+// valid or cancelled, set by the callbacks while the client reads it
 type CallbackPromise struct {
-	ValidOrCanceled bool // true if it is valid, false otherwise
+	mu              sync.Mutex // protect ValidOrCanceled
+	ValidOrCanceled bool       // true if it is valid, false otherwise
 }
 
 func NewCallbackPromise() *CallbackPromise {
@@ -16,66 +26,127 @@ func NewCallbackPromise() *CallbackPromise {
 	}
 }
 
-func (cp *CallbackPromise) IsValid() bool { return cp.ValidOrCanceled }
+func (cp *CallbackPromise) IsValid() bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.ValidOrCanceled
+}
 
-func (cp *CallbackPromise) IsCanceled() bool { return !cp.ValidOrCanceled }
+func (cp *CallbackPromise) IsCanceled() bool { return !cp.IsValid() }
 
-func (cp *CallbackPromise) Validate() { cp.ValidOrCanceled = true }
+func (cp *CallbackPromise) Validate() { cp.Set(true) }
 
-func (cp *CallbackPromise) Cancel() { cp.ValidOrCanceled = false }
+func (cp *CallbackPromise) Cancel() { cp.Set(false) }
 
-func (cp *CallbackPromise) Set(value bool) { cp.ValidOrCanceled = value }
+func (cp *CallbackPromise) Set(value bool) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.ValidOrCanceled = value
+}
 
 type Subscription struct {
+	mu      sync.Mutex             // protect Members
 	Members map[string]*Subscriber // key is the clientid
+	dial    DialFunc               // returns the client to call a member back with, usually CallbackPool.Get
 	logger  *logger.Logger         //
 }
 
+// DialFunc returns the client to call a subscriber back with
+type DialFunc func(member *Subscriber) (*rpc.Client, error)
+
 type Subscriber struct {
 	Id   string
-	Addr string
+	Addr string       // callback endpoint of the client, dialed if the client can not be called back over its connection
+	Peer *rpc.PeerRef // calls the client back over its own connection, nil if the client predates it
 }
 
 func (s *Subscriber) UpdateFile(args interface{}) {
 
 }
 
-func NewSubscription(logger *logger.Logger) *Subscription {
+func NewSubscription(dial DialFunc, logger *logger.Logger) *Subscription {
 	return &Subscription{
 		Members: make(map[string]*Subscriber),
+		dial:    dial,
 		logger:  logger,
 	}
 }
 
-func (sub *Subscription) Subscribe(clientId, clientAddr string) {
-	if clientId == "" || clientAddr == "" {
+func (sub *Subscription) Subscribe(clientId, clientAddr string, peer *rpc.PeerRef) {
+	if clientId == "" || (clientAddr == "" && peer == nil) {
 		return
 	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
 	sub.Members[clientId] = &Subscriber{
 		Id:   clientId,
 		Addr: clientAddr,
+		Peer: peer,
 	}
 }
 
 func (sub *Subscription) Unsubscribe(clientId string) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
 	delete(sub.Members, clientId)
 }
 
-// excludeId is the client to be excluded from this update
-func (sub *Subscription) Broadcast(excludeId string, args interface{}) {
-	for id, member := range sub.Members {
+// Broadcast notifies the members of an update in the background and returns at once, without waiting
+// for them. excludeId is the client to be excluded from this update, the callbacks join the trace carried by ctx.
+// The members are notified in parallel, and one that can not be reached does not hold back the others.
+// done, if not nil, is called with the number of callbacks sent and failed once they all are sent.
+func (sub *Subscription) Broadcast(ctx context.Context, excludeId string, args interface{}, done func(sent, failed int)) {
+	ctx = context.WithoutCancel(ctx) // the callbacks outlive the request that triggered them
+	go func() {
+		sent, failed := sub.broadcast(ctx, excludeId, args)
+		if done != nil {
+			done(sent, failed)
+		}
+	}()
+}
+
+func (sub *Subscription) broadcast(ctx context.Context, excludeId string, args interface{}) (int, int) {
+	var wg sync.WaitGroup
+	var sent, failed atomic.Int64
+	for id, member := range sub.members() {
 		if id == excludeId {
 			continue
 		}
-		conn, err := rpc.Dial(member.Addr, sub.logger)
-		if err != nil {
-			sub.logger.Printf("[ERROR] subscriber: rpc dial error: %v", err)
-			return
-		}
-		var reply UpdateCallbackPromiseResponse
-		if err := conn.Call("FileClient.UpdateCallbackPromise", args, &reply); err != nil {
-			sub.logger.Printf("[ERROR] call FileClient.UpdateCallbackPromise error: %v", err)
-			return
-		}
+		wg.Add(1)
+		go func(member *Subscriber) {
+			defer wg.Done()
+			if err := sub.callback(ctx, member, args); err != nil {
+				failed.Add(1)
+				return
+			}
+			sent.Add(1)
+		}(member)
+	}
+	wg.Wait()
+	return int(sent.Load()), int(failed.Load())
+}
+
+// callback notifies a member of an update
+func (sub *Subscription) callback(ctx context.Context, member *Subscriber, args interface{}) error {
+	conn, err := sub.dial(member)
+	if err != nil {
+		sub.logger.PrintfContext(ctx, "[ERROR] subscriber %s: rpc dial error: %v", member.Id, err)
+		return err
+	}
+	if err := conn.Notify(ctx, "FileClient.UpdateCallbackPromise", args, CallbackAttempts); err != nil {
+		sub.logger.PrintfContext(ctx, "[ERROR] subscriber %s: call FileClient.UpdateCallbackPromise error: %v", member.Id, err)
+		return err
+	}
+	return nil
+}
+
+// members returns a copy of the members, so that callbacks are sent without holding the lock
+func (sub *Subscription) members() map[string]*Subscriber {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	members := make(map[string]*Subscriber, len(sub.Members))
+	for id, member := range sub.Members {
+		members[id] = member
 	}
+	return members
 }
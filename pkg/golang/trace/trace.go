@@ -0,0 +1,165 @@
+// Package trace follows a user action across the processes it goes through.
+// Every remote call is a span; spans of the same action share a trace id,
+// and each span points to the span it was started from.
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// span kinds
+const (
+	KindInternal = "internal" // an operation within the process, e.g. a user action
+	KindClient   = "client"   // a remote call, as seen by the caller
+	KindServer   = "server"   // a remote call, as seen by the callee
+)
+
+// SpanContext identifies a span, it is what travels with the remote calls
+type SpanContext struct {
+	TraceId uint64
+	SpanId  uint64
+}
+
+func (sc SpanContext) IsValid() bool { return sc.TraceId != 0 && sc.SpanId != 0 }
+
+func (sc SpanContext) String() string {
+	return fmt.Sprintf("trace=%016x span=%016x", sc.TraceId, sc.SpanId)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the span context
+func NewContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// FromContext returns the span context carried by ctx, if any
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(contextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// newId picks a random non-zero id
+func newId() uint64 {
+	for {
+		if id := rand.Uint64(); id != 0 {
+			return id
+		}
+	}
+}
+
+// Span is an operation being timed
+type Span struct {
+	SpanContext
+	ParentId uint64 // 0 for the root span of a trace
+	Name     string
+	Kind     string
+	Start    time.Time
+}
+
+// StartSpan starts a span as a child of the span carried by ctx, or as the root
+// of a new trace if there is none, and returns a context carrying the new span
+func StartSpan(ctx context.Context, name, kind string) (context.Context, *Span) {
+	s := &Span{Name: name, Kind: kind, Start: time.Now()}
+	s.SpanId = newId()
+	if parent, ok := FromContext(ctx); ok {
+		s.TraceId = parent.TraceId
+		s.ParentId = parent.SpanId
+	} else {
+		s.TraceId = newId()
+	}
+	return NewContext(ctx, s.SpanContext), s
+}
+
+// End ends the span with the outcome of the operation and hands it to the exporter, which may be nil
+func (s *Span) End(e Exporter, err error) {
+	if e == nil {
+		return
+	}
+	r := Record{
+		TraceId:  fmt.Sprintf("%016x", s.TraceId),
+		SpanId:   fmt.Sprintf("%016x", s.SpanId),
+		Name:     s.Name,
+		Kind:     s.Kind,
+		Start:    s.Start,
+		Duration: time.Since(s.Start),
+	}
+	if s.ParentId != 0 {
+		r.ParentId = fmt.Sprintf("%016x", s.ParentId)
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	e.Export(r)
+}
+
+// Record is an ended span as it is exported
+type Record struct {
+	TraceId  string        `json:"trace_id"`
+	SpanId   string        `json:"span_id"`
+	ParentId string        `json:"parent_id,omitempty"`
+	Name     string        `json:"name"`
+	Kind     string        `json:"kind"`
+	Process  string        `json:"process"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Exporter receives the spans once they end
+type Exporter interface {
+	Export(r Record)
+}
+
+// JSONExporter writes each span as a line of JSON. The files of all
+// the processes can be concatenated and grouped by trace id.
+type JSONExporter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	process string // name of the process the spans are recorded in
+}
+
+var _ Exporter = (*JSONExporter)(nil)
+
+func NewJSONExporter(w io.Writer, process string) *JSONExporter {
+	return &JSONExporter{w: w, process: process}
+}
+
+// OpenJSONExporter appends the spans to the file at path
+func OpenJSONExporter(path, process string) (*JSONExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONExporter(f, process), nil
+}
+
+func (e *JSONExporter) Export(r Record) {
+	if r.Process == "" {
+		r.Process = e.process
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Write(append(line, '\n'))
+}
+
+// Close closes the underlying writer if it is a file or anything else that can be closed
+func (e *JSONExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if c, ok := e.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
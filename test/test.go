@@ -1,15 +1,40 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"distributed-file-system/pkg/golang/logger"
 	"distributed-file-system/pkg/golang/rpc"
 	"distributed-file-system/pkg/golang/service"
+	"distributed-file-system/pkg/golang/trace"
 )
 
 var serverAddr string = ":8080"
 var timeFormat string = "2006-01-02 15:04:05"
+var ctx = context.Background()
 
 func SimpleTest() {
 	// rpc.FilterDuplicatedRequest = false
@@ -27,13 +52,13 @@ func SimpleTest() {
 	src := "etc/exports/mockdir1"
 	target := "1"
 	fmt.Printf("Mounting directory from server directory %s to local directory %s...\n", src, target)
-	c1.Mount(src, target, service.AndrewFileSystemType)
+	c1.Mount(ctx, src, target, service.AndrewFileSystemType)
 
 	c1.ListFiles(target)
 
 	newFile := "1/subdir1/testcreate1.txt"
 	fmt.Printf("\nCreating file %s...\n\n", newFile)
-	fd, err := c1.Create(newFile)
+	fd, err := c1.Create(ctx, newFile)
 	if err != nil {
 		fmt.Printf("create error %v", err)
 		return
@@ -44,7 +69,7 @@ func SimpleTest() {
 	txtToWrite := []byte("test create file\nEOF")
 	writeAt := 0
 	fmt.Printf("Writing text to file %s at position %d...\n", newFile, writeAt)
-	n, err := c1.Write(fd, writeAt, txtToWrite)
+	n, err := c1.Write(ctx, fd, writeAt, txtToWrite)
 	if err != nil {
 		fmt.Printf("write error %v", err)
 		return
@@ -53,7 +78,7 @@ func SimpleTest() {
 
 	time.Sleep(5 * time.Second)
 	fmt.Printf("Reading 1/subdir1/testcreate1.txt...\n")
-	data, err := c1.ReadAt(fd, 0, 1000)
+	data, err := c1.ReadAt(ctx, fd, 0, 1000)
 	if err != nil {
 		fmt.Printf("read error %v", err)
 		return
@@ -64,7 +89,7 @@ func SimpleTest() {
 
 	writeAt = 5
 	fmt.Printf("Writing text to file %s at position %d...\n", newFile, writeAt)
-	n, err = c1.Write(fd, writeAt, []byte(fmt.Sprintf("test write file at position %d[whitespace]", writeAt)))
+	n, err = c1.Write(ctx, fd, writeAt, []byte(fmt.Sprintf("test write file at position %d[whitespace]", writeAt)))
 	if err != nil {
 		fmt.Printf("write error %v", err)
 		return
@@ -74,20 +99,20 @@ func SimpleTest() {
 	time.Sleep(5 * time.Second)
 
 	fmt.Printf("Reading 1/subdir1/testcreate1.txt at position %d...\n", writeAt)
-	data, err = c1.ReadAt(fd, writeAt, 1000)
+	data, err = c1.ReadAt(ctx, fd, writeAt, 1000)
 	if err != nil {
 		fmt.Printf("read error %v", err)
 		return
 	}
 	fmt.Printf("%s\n", string(data))
-	c1.Close(fd)
+	c1.Close(ctx, fd)
 }
 
 func senario1(c1, c2 *service.FileClient) {
 	var fdC1, fdC2 *service.FileDescriptor
 	// client 1 opens the file
 	fmt.Printf("[file client 1] Open session on file 1/testfile3.txt\n")
-	fdC1, err := c1.Open("1/testfile3.txt")
+	fdC1, err := c1.Open(ctx, "1/testfile3.txt")
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
@@ -97,20 +122,20 @@ func senario1(c1, c2 *service.FileClient) {
 
 	// client 1 reads the file
 	fmt.Printf("[file client 1] Reading 1/testfile3.txt...\n")
-	data, err := c1.ReadAt(fdC1, 0, 1000) // read all the content
+	data, err := c1.ReadAt(ctx, fdC1, 0, 1000) // read all the content
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
 	}
 	fmt.Printf("%s\n", string(data))
-	c1.Close(fdC1)
+	c1.Close(ctx, fdC1)
 	fmt.Printf("[file client 1] Close session on file 1/testfile3.txt\n")
 
 	time.Sleep(2 * time.Second)
 
 	// client 2 opens the file
 	fmt.Printf("[file client 2] Open session on file 2/testfile3.txt\n")
-	fdC2, err = c2.Open("2/testfile3.txt")
+	fdC2, err = c2.Open(ctx, "2/testfile3.txt")
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
@@ -120,7 +145,7 @@ func senario1(c1, c2 *service.FileClient) {
 
 	// client 2 updates the file
 	fmt.Printf("[file client 2] Reading 2/testfile3.txt...\n")
-	data, err = c2.ReadAt(fdC2, 0, 1000)
+	data, err = c2.ReadAt(ctx, fdC2, 0, 1000)
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
@@ -130,7 +155,7 @@ func senario1(c1, c2 *service.FileClient) {
 	time.Sleep(2 * time.Second)
 
 	fmt.Printf("[file client 2] Writing text to file 2/testfile3.txt at position 0...\n")
-	n, err := c2.Write(fdC2, 0, []byte(fmt.Sprintf("write to file at %s by client 2\n", time.Now().Format(timeFormat))))
+	n, err := c2.Write(ctx, fdC2, 0, []byte(fmt.Sprintf("write to file at %s by client 2\n", time.Now().Format(timeFormat))))
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
@@ -140,20 +165,20 @@ func senario1(c1, c2 *service.FileClient) {
 	time.Sleep(2 * time.Second)
 
 	fmt.Printf("[file client 2] Reading 2/testfile3.txt...\n")
-	data, err = c2.ReadAt(fdC2, 0, 1000)
+	data, err = c2.ReadAt(ctx, fdC2, 0, 1000)
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
 	}
 	fmt.Printf("%s\n", string(data))
-	c2.Close(fdC2)
+	c2.Close(ctx, fdC2)
 	fmt.Printf("[file client 2] Close session on file 2/testfile3.txt\n")
 
 	time.Sleep(2 * time.Second)
 
 	// client 1 reads the file
 	fmt.Printf("[file client 1] Open session on file 1/testfile3.txt\n")
-	fdC1, err = c1.Open("1/testfile3.txt")
+	fdC1, err = c1.Open(ctx, "1/testfile3.txt")
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
@@ -161,7 +186,7 @@ func senario1(c1, c2 *service.FileClient) {
 	time.Sleep(2 * time.Second)
 
 	fmt.Printf("[file client 1] Reading 1/testfile3.txt...\n")
-	data, err = c1.ReadAt(fdC1, 0, 1000)
+	data, err = c1.ReadAt(ctx, fdC1, 0, 1000)
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
@@ -172,26 +197,26 @@ func senario1(c1, c2 *service.FileClient) {
 
 	// client 2 updates the file again
 	fmt.Printf("[file client 2] Writing text to file 2/testfile3.txt at position 0...\n")
-	n, err = c2.Write(fdC2, 0, []byte(fmt.Sprintf("write to file at %s by client 2 again\n", time.Now().Format(timeFormat))))
+	n, err = c2.Write(ctx, fdC2, 0, []byte(fmt.Sprintf("write to file at %s by client 2 again\n", time.Now().Format(timeFormat))))
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
 	}
 	fmt.Printf("[file client 2] %d bytes are written to %s\n", n, "2/testfile3.txt")
-	c2.Close(fdC2)
+	c2.Close(ctx, fdC2)
 	fmt.Printf("[file client 2] Close session on file 2/testfile3.txt\n")
 
 	time.Sleep(2 * time.Second)
 
 	// client 1 reads the file
 	fmt.Printf("[file client 1] Reading 1/testfile3.txt...\n")
-	data, err = c1.ReadAt(fdC1, 0, 1000)
+	data, err = c1.ReadAt(ctx, fdC1, 0, 1000)
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
 	}
 	fmt.Printf("%s\n", string(data))
-	c1.Close(fdC1)
+	c1.Close(ctx, fdC1)
 	fmt.Printf("[file client 1] Close session on file 1/testfile3.txt\n")
 }
 
@@ -199,7 +224,7 @@ func senario2(c1, c2 *service.FileClient) {
 	var fdC1, fdC2 *service.FileDescriptor
 	// client 1 opens the file
 	fmt.Printf("[file client 1] Open session on file 1/testfile2.txt\n")
-	fdC1, err := c1.Open("1/testfile2.txt")
+	fdC1, err := c1.Open(ctx, "1/testfile2.txt")
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
@@ -209,7 +234,7 @@ func senario2(c1, c2 *service.FileClient) {
 
 	// client 1 reads
 	fmt.Printf("[file client 1] Reading 1/testfile2.txt...\n")
-	data, err := c1.ReadAt(fdC1, 0, 1000)
+	data, err := c1.ReadAt(ctx, fdC1, 0, 1000)
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
@@ -220,14 +245,14 @@ func senario2(c1, c2 *service.FileClient) {
 
 	// client 2 opens the file
 	fmt.Printf("[file client 2] Open session on file 2/testfile2.txt\n")
-	fdC2, err = c2.Open("2/testfile2.txt")
+	fdC2, err = c2.Open(ctx, "2/testfile2.txt")
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
 	}
 	// client 2 reads
 	fmt.Printf("[file client 2] Reading 2/testfile2.txt...\n")
-	data, err = c2.ReadAt(fdC2, 0, 1000)
+	data, err = c2.ReadAt(ctx, fdC2, 0, 1000)
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
@@ -238,7 +263,7 @@ func senario2(c1, c2 *service.FileClient) {
 
 	// client 2 updates the file and close
 	fmt.Printf("[file client 2] Writing text to file 2/testfile2.txt at position 0...\n")
-	n, err := c2.Write(fdC2, 0, []byte(fmt.Sprintf("write to file at %s by client 2\n", time.Now().Format(timeFormat))))
+	n, err := c2.Write(ctx, fdC2, 0, []byte(fmt.Sprintf("write to file at %s by client 2\n", time.Now().Format(timeFormat))))
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
@@ -246,20 +271,20 @@ func senario2(c1, c2 *service.FileClient) {
 	fmt.Printf("[file client 2] %d bytes are written to %s\n", n, "2/testfile2.txt")
 
 	fmt.Printf("[file client 2] Reading 2/testfile2.txt...\n")
-	data, err = c2.ReadAt(fdC2, 0, 1000)
+	data, err = c2.ReadAt(ctx, fdC2, 0, 1000)
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
 	}
 	fmt.Printf("%s\n", string(data))
-	c2.Close(fdC2)
+	c2.Close(ctx, fdC2)
 	fmt.Printf("[file client 2] Close session on file 2/testfile2.txt\n")
 
 	time.Sleep(2 * time.Second)
 
 	// client 1 updates the file
 	fmt.Printf("[file client 1] Writing text to file 1/testfile2.txt at position 0...\n")
-	n, err = c1.Write(fdC1, 0, []byte(fmt.Sprintf("write to file at %s by client 1\n", time.Now().Format(timeFormat))))
+	n, err = c1.Write(ctx, fdC1, 0, []byte(fmt.Sprintf("write to file at %s by client 1\n", time.Now().Format(timeFormat))))
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
@@ -270,13 +295,13 @@ func senario2(c1, c2 *service.FileClient) {
 
 	// client 1 reads the file
 	fmt.Printf("[file client 1] Reading 1/testfile2.txt...\n")
-	data, err = c1.ReadAt(fdC1, 0, 1000)
+	data, err = c1.ReadAt(ctx, fdC1, 0, 1000)
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
 	}
 	fmt.Printf("%s\n", string(data))
-	c1.Close(fdC1)
+	c1.Close(ctx, fdC1)
 	fmt.Printf("[file client 1] Close session on file 1/testfile2.txt\n")
 }
 
@@ -300,11 +325,11 @@ func TestCacheConsistencyAFSSenario1() {
 	target1 := "1"
 	target2 := "2"
 	fmt.Printf("[file client 1] Mounting directory from server directory %s to local directory %s with cache consistency mechanism: Session Update...\n", src, target1)
-	c1.Mount(src, target1, service.AndrewFileSystemType)
+	c1.Mount(ctx, src, target1, service.AndrewFileSystemType)
 	c1.ListFiles(target1)
 
 	fmt.Printf("\n[file client 2] Mounting directory from server directory %s to local directory %s with cache consistency mechanism: Session Update...\n", src, target2)
-	c2.Mount(src, target2, service.AndrewFileSystemType)
+	c2.Mount(ctx, src, target2, service.AndrewFileSystemType)
 	c2.ListFiles(target2)
 	fmt.Printf("\n")
 
@@ -331,11 +356,11 @@ func TestCacheConsistencyAFSSenario2() {
 	target1 := "1"
 	target2 := "2"
 	fmt.Printf("[file client 1] Mounting directory from server directory %s to local directory %s with cache consistency mechanism: Session Update...\n", src, target1)
-	c1.Mount(src, target1, service.AndrewFileSystemType)
+	c1.Mount(ctx, src, target1, service.AndrewFileSystemType)
 	c1.ListFiles(target1)
 
 	fmt.Printf("\n[file client 2] Mounting directory from server directory %s to local directory %s with cache consistency mechanism: Session Update...\n", src, target2)
-	c2.Mount(src, target2, service.AndrewFileSystemType)
+	c2.Mount(ctx, src, target2, service.AndrewFileSystemType)
 	c2.ListFiles(target2)
 	fmt.Printf("\n")
 
@@ -364,11 +389,11 @@ func TestCacheConsistencyNFSSenario1() {
 	target1 := "1"
 	target2 := "2"
 	fmt.Printf("[file client 1] Mounting directory from server directory %s to local directory %s with cache consistency mechanism: One-Copy Update...\n", src, target1)
-	c1.Mount(src, target1, service.SunNetworkFileSystemType)
+	c1.Mount(ctx, src, target1, service.SunNetworkFileSystemType)
 	c1.ListFiles(target1)
 
 	fmt.Printf("\n[file client 2] Mounting directory from server directory %s to local directory %s with cache consistency mechanism: One-Copy Update...\n", src, target2)
-	c2.Mount(src, target2, service.SunNetworkFileSystemType)
+	c2.Mount(ctx, src, target2, service.SunNetworkFileSystemType)
 	c2.ListFiles(target2)
 	fmt.Printf("\n")
 	senario1(c1, c2)
@@ -395,11 +420,11 @@ func TestCacheConsistencyNFSSenario2() {
 	target1 := "1"
 	target2 := "2"
 	fmt.Printf("[file client 1] Mounting directory from server directory %s to local directory %s with cache consistency mechanism: One-Copy Update...\n", src, target1)
-	c1.Mount(src, target1, service.SunNetworkFileSystemType)
+	c1.Mount(ctx, src, target1, service.SunNetworkFileSystemType)
 	c1.ListFiles(target1)
 
 	fmt.Printf("\n[file client 2] Mounting directory from server directory %s to local directory %s with cache consistency mechanism: One-Copy Update...\n", src, target2)
-	c2.Mount(src, target2, service.SunNetworkFileSystemType)
+	c2.Mount(ctx, src, target2, service.SunNetworkFileSystemType)
 	c2.ListFiles(target2)
 	fmt.Printf("\n")
 
@@ -420,7 +445,7 @@ func performIdempotentRead() {
 	src := "etc/exports/mockdir1/subdir3/testidempotent.txt"
 	target := "localfile/1/testidempotent.txt"
 	fmt.Printf("Mounting directory from server directory %s to local directory %s...\n", src, target)
-	err := c1.Mount(src, target, service.SunNetworkFileSystemType)
+	err := c1.Mount(ctx, src, target, service.SunNetworkFileSystemType)
 	if err != nil {
 		fmt.Printf("mount error: %v\n", err)
 		return
@@ -428,7 +453,7 @@ func performIdempotentRead() {
 
 	time.Sleep(2 * time.Second)
 	localPath := "localfile/1/testidempotent.txt"
-	fd, err := c1.Open(localPath)
+	fd, err := c1.Open(ctx, localPath)
 	if err != nil {
 		fmt.Printf("open testidempotent.txt error: %v\n", err)
 		return
@@ -442,7 +467,7 @@ func performIdempotentRead() {
 
 	time.Sleep(2 * time.Second)
 
-	data, err := c1.ReadAt(fd, readAt, nToRead)
+	data, err := c1.ReadAt(ctx, fd, readAt, nToRead)
 	if err != nil {
 		fmt.Printf("read testidempotent.txt error: %v\n", err)
 		return
@@ -465,7 +490,7 @@ func performNonIdempotentRead() {
 	src := "etc/exports/mockdir1/subdir3/testidempotent.txt"
 	target := "localfile/1/testidempotent.txt"
 	fmt.Printf("Mounting directory from server directory %s to local directory %s...\n", src, target)
-	err := c1.Mount(src, target, service.SunNetworkFileSystemType)
+	err := c1.Mount(ctx, src, target, service.SunNetworkFileSystemType)
 	if err != nil {
 		fmt.Printf("mount error: %v\n", err)
 		return
@@ -474,7 +499,7 @@ func performNonIdempotentRead() {
 	time.Sleep(2 * time.Second)
 
 	localPath := "localfile/1/testidempotent.txt"
-	fd, err := c1.Open(localPath)
+	fd, err := c1.Open(ctx, localPath)
 	if err != nil {
 		fmt.Printf("open testidempotent.txt error: %v\n", err)
 		return
@@ -486,7 +511,7 @@ func performNonIdempotentRead() {
 	// fmt.Printf("Reading %s for %d bytes at position %d...\n", localPath, nToRead, readAt)
 	// time.Sleep(2 * time.Second)
 
-	// expected, err := c1.ReadAt(fd, readAt, nToRead)
+	// expected, err := c1.ReadAt(ctx, fd, readAt, nToRead)
 	// if err != nil {
 	// 	fmt.Printf("read testidempotent.txt error: %v\n", err)
 	// 	return
@@ -495,7 +520,7 @@ func performNonIdempotentRead() {
 
 	// time.Sleep(4 * time.Second)
 
-	actual, err := c1.Read(fd, nToRead)
+	actual, err := c1.Read(ctx, fd, nToRead)
 	if err != nil {
 		fmt.Printf("read testidempotent.txt error: %v\n", err)
 		return
@@ -535,6 +560,2530 @@ func AtMostOnceNonIdempotentRead() {
 	performNonIdempotentRead()
 }
 
+// scenario is a check run by the driver, it returns an error when the behavior it checks is broken
+type scenario struct {
+	name string
+	run  func() error
+}
+
+// scenarios are selected by name with -run. Those starting with "Simulated" run the file server and its
+// clients in process over a simulated network, the others need a file server listening at serverAddr.
+var scenarios = []scenario{
+	{"SimpleTest", manual(SimpleTest)},
+	{"TestCacheConsistencyAFSSenario1", manual(TestCacheConsistencyAFSSenario1)},
+	{"TestCacheConsistencyAFSSenario2", manual(TestCacheConsistencyAFSSenario2)},
+	{"TestCacheConsistencyNFSSenario1", manual(TestCacheConsistencyNFSSenario1)},
+	{"TestCacheConsistencyNFSSenario2", manual(TestCacheConsistencyNFSSenario2)},
+	{"AtLeastOnceIdempotentRead", manual(AtLeastOnceIdempotentRead)},
+	{"AtLeastOnceNonIdempotentRead", manual(AtLeastOnceNonIdempotentRead)},
+	{"AtMostOnceIdempotentRead", manual(AtMostOnceIdempotentRead)},
+	{"AtMostOnceNonIdempotentRead", manual(AtMostOnceNonIdempotentRead)},
+	{"SimulatedAtMostOnceNonIdempotentRead", func() error { return SimulatedNonIdempotentRead(1, true) }},
+	{"SimulatedConcurrentMountsAndCallbacks", SimulatedConcurrentMountsAndCallbacks},
+	{"SimulatedCallbackToIdlePeer", SimulatedCallbackToIdlePeer},
+	{"SimulatedCallbackCalledByOldServer", SimulatedCallbackCalledByOldServer},
+	{"SimulatedDuplicatedBatch", SimulatedDuplicatedBatch},
+	{"SimulatedCallbackAfterTCPReconnect", SimulatedCallbackAfterTCPReconnect},
+	{"SimulatedLossyFragments", SimulatedLossyFragments},
+	{"SimulatedIncompleteFragmentsFlood", SimulatedIncompleteFragmentsFlood},
+	{"SimulatedInterceptorContext", SimulatedInterceptorContext},
+	{"SimulatedRichLabMessages", SimulatedRichLabMessages},
+	{"SimulatedMalformedMessages", SimulatedMalformedMessages},
+	{"SimulatedSchemaEvolution", SimulatedSchemaEvolution},
+	{"SimulatedCodecPerClient", SimulatedCodecPerClient},
+	{"SimulatedCallDeadlineAndCancel", SimulatedCallDeadlineAndCancel},
+	{"SimulatedRetryPolicyPerMethod", SimulatedRetryPolicyPerMethod},
+	{"SimulatedAdaptiveRetransmissionTimeout", SimulatedAdaptiveRetransmissionTimeout},
+	{"SimulatedClientRestart", SimulatedClientRestart},
+	{"SimulatedServerRestartWithReplyLog", SimulatedServerRestartWithReplyLog},
+	{"SimulatedIdempotentMethods", SimulatedIdempotentMethods},
+	{"SimulatedCorruptedMessages", SimulatedCorruptedMessages},
+	{"SimulatedAuthenticatedCalls", SimulatedAuthenticatedCalls},
+	{"SimulatedEncryptedCalls", SimulatedEncryptedCalls},
+	{"SimulatedMetrics", SimulatedMetrics},
+	{"SimulatedThrottledClient", SimulatedThrottledClient},
+	{"SimulatedTraceAcrossCallbacks", SimulatedTraceAcrossCallbacks},
+	{"SimulatedCallbackPool", SimulatedCallbackPool},
+}
+
+// manual runs a scenario whose outcome is checked by reading its output
+func manual(run func()) func() error {
+	return func() error {
+		run()
+		return nil
+	}
+}
+
+// testFile is the file the non-idempotent reads go through, at the same path as in etc/exports
+const testFile = "etc/exports/mockdir1/subdir3/testidempotent.txt"
+
+// exportFiles writes the files, by path relative to the module root, into a fresh directory
+// and exports its etc/exports, so that a scenario neither depends on nor changes the files of the repository
+func exportFiles(files map[string][]byte) error {
+	dir, err := os.MkdirTemp("", "dfs-test-")
+	if err != nil {
+		return err
+	}
+	for path, data := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+	return os.Setenv("EXPORT_ROOT_PATHS", filepath.Join(dir, "etc/exports"))
+}
+
+// offsets returns size bytes made of lines of 10 bytes, each being its own offset,
+// so that what a read returns tells where it has read from
+func offsets(size int) []byte {
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		fmt.Fprintf(&buf, "%09d\n", buf.Len())
+	}
+	return buf.Bytes()[:size]
+}
+
+// newSimNet serves the "sim://" addresses with a network whose every link has the faults of config
+func newSimNet(seed int64, config rpc.LinkConfig) *rpc.SimNet {
+	network := rpc.NewSimNet(seed)
+	network.SetLink("*", "*", config)
+	rpc.SetSimNet(network)
+	return network
+}
+
+// startFileServer runs a file server at addr
+func startFileServer(addr string) *service.FileServer {
+	server := service.NewFileServer(addr)
+	go server.Run()
+	time.Sleep(100 * time.Millisecond) // to make sure server is up
+	return server
+}
+
+// seekerAt returns the seeker position of the file at the server
+func seekerAt(server *service.FileServer, file string) (int64, error) {
+	var reply service.GetAttributeResponse
+	if err := server.GetAttribute(ctx, service.GetAttributeRequest{FilePath: file}, &reply); err != nil {
+		return 0, err
+	}
+	return reply.FileSeeker, nil
+}
+
+// SimulatedNonIdempotentRead lets several clients perform the non-idempotent read against an
+// in-process server over a lossy simulated network, whose faults reproduce exactly from its seed.
+// At most once, every read moves the file seeker once, so that the clients read distinct
+// positions and the seeker ends at the sum of the reads; at least once, retransmissions move it further.
+func SimulatedNonIdempotentRead(seed int64, atMostOnce bool) error {
+	const clients, reads, n = 3, 3, 10
+	rpc.FilterDuplicatedRequest = atMostOnce
+	defer func() { rpc.FilterDuplicatedRequest = true }()
+	if err := exportFiles(map[string][]byte{testFile: offsets(1000)}); err != nil {
+		return err
+	}
+	network := newSimNet(seed, rpc.LinkConfig{Loss: 0.3, Duplicate: 0.1, Reorder: 0.1, Delay: 5 * time.Millisecond, Jitter: 5 * time.Millisecond})
+	defer network.Close()
+
+	simServerAddr := "sim://server"
+	server := startFileServer(simServerAddr)
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	positions := make(map[string]bool)
+	for i := 1; i <= clients; i++ {
+		id := strconv.Itoa(i)
+		c := service.NewFileClient(id, "", simServerAddr)
+		defer c.Shutdown()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fail := func(err error) {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("[file client %s] %v", id, err))
+				mu.Unlock()
+			}
+			target := "localfile/sim" + id + "/testidempotent.txt"
+			if err := c.Mount(ctx, testFile, target, service.SunNetworkFileSystemType); err != nil {
+				fail(fmt.Errorf("mount error: %v", err))
+				return
+			}
+			fd, err := c.Open(ctx, target)
+			if err != nil {
+				fail(fmt.Errorf("open error: %v", err))
+				return
+			}
+			for j := 0; j < reads; j++ {
+				data, err := c.Read(ctx, fd, n)
+				if err != nil {
+					fail(fmt.Errorf("read error: %v", err))
+					return
+				}
+				fmt.Printf("[file client %s] read: %q\n", id, string(data))
+				// the reads are aligned with the lines of the file, every one must read a different line
+				mu.Lock()
+				if positions[string(data)] && atMostOnce {
+					errs = append(errs, fmt.Errorf("[file client %s] read %q twice", id, string(data)))
+				}
+				positions[string(data)] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	seeker, err := seekerAt(server, testFile)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("file seeker position at server: %d\n", seeker)
+	if atMostOnce && seeker != clients*reads*n {
+		return fmt.Errorf("file seeker at %d after %d reads of %d bytes, some reads were executed more than once", seeker, clients*reads, n)
+	}
+	return nil
+}
+
+// eventually waits up to timeout for cond to hold
+func eventually(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// SimulatedConcurrentMountsAndCallbacks has a client mount, open and read several volumes at once while another
+// client writes their files, so that the callbacks are served alongside. Build the driver with -race to check
+// that the client is safe for concurrent use.
+func SimulatedConcurrentMountsAndCallbacks() error {
+	const dirs = 4
+	files := make(map[string][]byte)
+	for i := 0; i < dirs; i++ {
+		files[fmt.Sprintf("etc/exports/mockdir1/d%d/f%d.txt", i, i)] = offsets(100)
+	}
+	if err := exportFiles(files); err != nil {
+		return err
+	}
+	network := newSimNet(19, rpc.LinkConfig{Loss: 0.1, Duplicate: 0.1, Reorder: 0.1, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	defer network.Close()
+	simServerAddr := "sim://server"
+	server := startFileServer(simServerAddr)
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	c1 := service.NewFileClient("1", "", simServerAddr)
+	defer c1.Shutdown()
+	c2 := service.NewFileClient("2", "", simServerAddr)
+	defer c2.Shutdown()
+	if err := c2.Mount(ctx, "etc/exports/mockdir1", "2", service.AndrewFileSystemType); err != nil {
+		return err
+	}
+	fds2 := make([]*service.FileDescriptor, dirs)
+	for i := range fds2 {
+		fd, err := c2.Open(ctx, fmt.Sprintf("2/d%d/f%d.txt", i, i))
+		if err != nil {
+			return err
+		}
+		fds2[i] = fd
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*dirs)
+	write := func(i int) {
+		defer wg.Done()
+		if _, err := c2.Write(ctx, fds2[i], 0, []byte("written by client 2\n")); err != nil {
+			errs <- err
+			return
+		}
+		c2.Close(ctx, fds2[i])
+	}
+	// client 1 mounts, opens and reads while client 2 writes, its callbacks arrive meanwhile
+	fds1 := make([]*service.FileDescriptor, dirs)
+	for i := 0; i < dirs; i++ {
+		wg.Add(2)
+		go write(i)
+		go func(i int) {
+			defer wg.Done()
+			target := fmt.Sprintf("1/d%d", i)
+			if err := c1.Mount(ctx, fmt.Sprintf("etc/exports/mockdir1/d%d", i), target, service.AndrewFileSystemType); err != nil {
+				errs <- err
+				return
+			}
+			fd, err := c1.Open(ctx, fmt.Sprintf("%s/f%d.txt", target, i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := c1.ReadAt(ctx, fd, 0, 10); err != nil {
+				errs <- err
+				return
+			}
+			fds1[i] = fd
+		}(i)
+	}
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+
+	// every volume is mounted by now, so that the writes call client 1 back while it reads
+	for i := 0; i < dirs; i++ {
+		wg.Add(2)
+		go write(i)
+		go func(i int) {
+			defer wg.Done()
+			c1.ListAllFiles()
+			if _, err := c1.ReadAt(ctx, fds1[i], 0, 10); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+	for i, fd := range fds1 {
+		if !eventually(5*time.Second, fd.CallbackPromise.IsCanceled) {
+			return fmt.Errorf("[file client 1] callback promise of 1/d%d/f%d.txt still valid after client 2 wrote it", i, i)
+		}
+	}
+	return nil
+}
+
+// SimulatedCallbackToIdlePeer checks that a client is still called back over its connection once
+// it has been idle for longer than rpc.PeerIdleTimeout, after the server has closed the client calling it back
+func SimulatedCallbackToIdlePeer() error {
+	idleTimeout := rpc.PeerIdleTimeout
+	rpc.PeerIdleTimeout = 100 * time.Millisecond
+	defer func() { rpc.PeerIdleTimeout = idleTimeout }()
+	if err := exportFiles(map[string][]byte{"etc/exports/mockdir1/testfile2.txt": []byte("content of testfile2\n")}); err != nil {
+		return err
+	}
+	network := newSimNet(24, rpc.LinkConfig{Loss: 0.2, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	defer network.Close()
+	simServerAddr := "sim://server"
+	server := startFileServer(simServerAddr)
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	c1 := service.NewFileClient("1", "", simServerAddr)
+	defer c1.Shutdown()
+	c2 := service.NewFileClient("2", "", simServerAddr)
+	defer c2.Shutdown()
+	var fds []*service.FileDescriptor
+	for i, c := range []*service.FileClient{c1, c2} {
+		target := strconv.Itoa(i + 1)
+		if err := c.Mount(ctx, "etc/exports/mockdir1", target, service.AndrewFileSystemType); err != nil {
+			return err
+		}
+		fd, err := c.Open(ctx, target+"/testfile2.txt")
+		if err != nil {
+			return err
+		}
+		fds = append(fds, fd)
+	}
+	if fds[0].CallbackPromise.IsCanceled() {
+		return fmt.Errorf("[file client 1] callback promise canceled before the file is written")
+	}
+
+	// client 1 sends nothing for long enough to have the server close the client calling it back
+	time.Sleep(rpc.PeerIdleTimeout + 2*rpc.CacheCleanUpInterval)
+
+	if _, err := c2.Write(ctx, fds[1], 0, []byte("written by client 2\n")); err != nil {
+		return err
+	}
+	c2.Close(ctx, fds[1]) // sends the write to the server, which calls client 1 back
+	if !eventually(5*time.Second, fds[0].CallbackPromise.IsCanceled) {
+		return fmt.Errorf("[file client 1] callback promise still valid after client 2 wrote the file, the callback was not delivered")
+	}
+	return nil
+}
+
+// SimulatedCallbackCalledByOldServer checks that a client still serves the callbacks of the servers that predate
+// notifications, which call FileClient.UpdateCallbackPromise at the address of the client and wait for the response
+func SimulatedCallbackCalledByOldServer() error {
+	if err := exportFiles(map[string][]byte{"etc/exports/mockdir1/testfile2.txt": []byte("content of testfile2\n")}); err != nil {
+		return err
+	}
+	network := newSimNet(23, rpc.LinkConfig{Loss: 0.2, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	defer network.Close()
+	simServerAddr := "sim://server"
+	server := startFileServer(simServerAddr)
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	c1 := service.NewFileClient("1", "sim://client1", simServerAddr)
+	defer c1.Shutdown()
+	go c1.Run()
+	if err := c1.Mount(ctx, "etc/exports/mockdir1", "1", service.AndrewFileSystemType); err != nil {
+		return err
+	}
+	fd, err := c1.Open(ctx, "1/testfile2.txt")
+	if err != nil {
+		return err
+	}
+
+	oldServer, err := rpc.Dial("sim://client1", logger.NewLogger("./server.log"))
+	if err != nil {
+		return err
+	}
+	defer oldServer.Close()
+	args := &service.UpdateCallbackPromiseRequest{FilePath: fd.Filepath, IsValidOrCanceled: false}
+	var reply service.UpdateCallbackPromiseResponse
+	if err := oldServer.CallContext(ctx, "FileClient.UpdateCallbackPromise", args, &reply); err != nil {
+		return fmt.Errorf("call FileClient.UpdateCallbackPromise error: %v", err)
+	}
+	if !fd.CallbackPromise.IsCanceled() {
+		return fmt.Errorf("[file client 1] callback promise still valid after the call")
+	}
+	return nil
+}
+
+// SleepRequest asks the Sleeper to sleep for Millis milliseconds
+type SleepRequest struct {
+	Millis int64
+}
+
+type SleepResponse struct {
+	Millis int64
+}
+
+func init() {
+	rpc.RegisterType(SleepRequest{})
+	rpc.RegisterType(SleepResponse{})
+}
+
+// Sleeper is an rpc service whose calls take as long as asked, so that their copies arrive while they are served
+type Sleeper struct{}
+
+func (s *Sleeper) Sleep(req SleepRequest, resp *SleepResponse) error {
+	time.Sleep(time.Duration(req.Millis) * time.Millisecond)
+	resp.Millis = req.Millis
+	return nil
+}
+
+// startServer serves the services at addr over transport, wrapped by wrap if not nil
+func startServer(addr string, wrap func(rpc.Transport) rpc.Transport, services ...interface{}) (*rpc.Server, error) {
+	logger := logger.NewLogger("./server.log")
+	transport, err := rpc.Listen(addr, logger)
+	if err != nil {
+		return nil, err
+	}
+	if wrap != nil {
+		transport = wrap(transport)
+	}
+	server := rpc.NewServer(logger)
+	for _, service := range services {
+		if err := server.Register(service); err != nil {
+			transport.Close()
+			return nil, err
+		}
+	}
+	go server.Accept(transport)
+	return server, nil
+}
+
+// dropCompleteBatchResponse drops the first batch response answering n requests
+type dropCompleteBatchResponse struct {
+	rpc.Transport
+	n       int
+	dropped atomic.Bool
+}
+
+func (t *dropCompleteBatchResponse) WriteMessage(data []byte, addr net.Addr) error {
+	var m rpc.Message
+	if _, err := rpc.DecodeFrame(data, &m); err == nil {
+		if b, ok := m.Body.(*rpc.BatchResponse); ok && len(b.Responses) == t.n && t.dropped.CompareAndSwap(false, true) {
+			return nil
+		}
+	}
+	return t.Transport.WriteMessage(data, addr)
+}
+
+// SimulatedDuplicatedBatch checks that a copy of a batch answers the requests the other copy is still serving.
+// The network delivers every batch twice, each copy finds the request the other one serves first in flight,
+// and the first response answering the whole batch is lost: the other copy has to answer every request too,
+// or the client only completes the calls once it retransmits them.
+func SimulatedDuplicatedBatch() error {
+	network := newSimNet(22, rpc.LinkConfig{})
+	network.SetLink("*", "sleeper", rpc.LinkConfig{Duplicate: 1})
+	defer network.Close()
+	// the wrapper hides the simulated network from the server, which would drop responses on its own
+	defer func(p int) { rpc.ServerSideNetworkPacketLossProbability = p }(rpc.ServerSideNetworkPacketLossProbability)
+	rpc.ServerSideNetworkPacketLossProbability = 0
+	const calls = 2
+	server, err := startServer("sim://sleeper", func(t rpc.Transport) rpc.Transport {
+		return &dropCompleteBatchResponse{Transport: t, n: calls}
+	}, &Sleeper{})
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown()
+	client, err := rpc.Dial("sim://sleeper", logger.NewLogger("./client1.log"))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	retransmitAfter := 2 * time.Second
+	client.SetRetryPolicy(rpc.RetryPolicy{MaxAttempts: 10, InitialBackoff: retransmitAfter, Multiplier: 1})
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	batch := client.NewBatch(ctx)
+	replies := make([]SleepResponse, calls)
+	var sent []*rpc.Call
+	for i := range replies {
+		sent = append(sent, batch.Add("Sleeper.Sleep", &SleepRequest{Millis: int64(300 - 290*i)}, &replies[i]))
+	}
+	start := time.Now()
+	batch.Do()
+	elapsed := time.Since(start)
+	for _, call := range sent {
+		if call.Error != nil {
+			return call.Error
+		}
+	}
+	fmt.Printf("batch of %d calls answered in %v\n", calls, elapsed.Round(time.Millisecond))
+	if elapsed >= retransmitAfter {
+		return fmt.Errorf("batch answered in %v, only once its calls were retransmitted", elapsed.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// Watcher is an rpc service keeping the reference to the clients that watch it, so that it calls them back later
+type Watcher struct {
+	mu   sync.Mutex
+	refs []*rpc.PeerRef
+}
+
+func (w *Watcher) Watch(ctx context.Context, req SleepRequest, resp *SleepResponse) error {
+	ref, err := rpc.PeerOf(ctx)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.refs = append(w.refs, ref)
+	return nil
+}
+
+// tcpProxy forwards the connections it accepts to a server, and breaks them all on demand
+type tcpProxy struct {
+	listener net.Listener
+	target   string
+	accepted atomic.Int64
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+func startTCPProxy(target string) (*tcpProxy, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &tcpProxy{listener: l, target: target}
+	go p.serve()
+	return p, nil
+}
+
+func (p *tcpProxy) serve() {
+	for {
+		c, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		u, err := net.Dial("tcp", p.target)
+		if err != nil {
+			c.Close()
+			continue
+		}
+		p.mu.Lock()
+		p.conns = append(p.conns, c, u)
+		p.mu.Unlock()
+		p.accepted.Add(1)
+		forward := func(dst, src net.Conn) {
+			io.Copy(dst, src)
+			dst.Close()
+			src.Close()
+		}
+		go forward(u, c)
+		go forward(c, u)
+	}
+}
+
+// breakConnections closes every connection forwarded so far
+func (p *tcpProxy) breakConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+func (p *tcpProxy) Close() {
+	p.listener.Close()
+	p.breakConnections()
+}
+
+// SimulatedCallbackAfterTCPReconnect checks that a server keeping the reference to a client calls it back
+// once the tcp connection of the client broke and the client reconnected, although it sent no call since.
+func SimulatedCallbackAfterTCPReconnect() error {
+	logger := logger.NewLogger("./server.log")
+	transport, err := rpc.Listen("tcp://127.0.0.1:0", logger)
+	if err != nil {
+		return err
+	}
+	server := rpc.NewServer(logger)
+	defer server.Shutdown()
+	watcher := &Watcher{}
+	if err := server.Register(watcher); err != nil {
+		return err
+	}
+	go server.Accept(transport)
+	proxy, err := startTCPProxy(transport.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	defer proxy.Close()
+
+	client, err := rpc.Dial("tcp://"+proxy.listener.Addr().String(), logger)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	callbacks := rpc.NewServer(logger)
+	if err := callbacks.Register(&Sleeper{}); err != nil {
+		return err
+	}
+	client.Serve(callbacks)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := client.CallContext(ctx, "Watcher.Watch", &SleepRequest{}, &SleepResponse{}); err != nil {
+		return err
+	}
+	time.Sleep(500 * time.Millisecond) // the pings seeding the retransmission timeout are over, the client sends nothing more
+
+	proxy.breakConnections()
+	if !eventually(10*time.Second, func() bool { return proxy.accepted.Load() == 2 }) {
+		return fmt.Errorf("client did not reconnect")
+	}
+	watcher.mu.Lock()
+	ref := watcher.refs[0]
+	watcher.mu.Unlock()
+	// the client tells the server where it is now in the background, the call goes over the new connection once it has
+	var lastErr error
+	if !eventually(5*time.Second, func() bool {
+		peer, err := ref.Client()
+		if err != nil {
+			lastErr = err
+			return false
+		}
+		callCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		defer cancel()
+		var resp SleepResponse
+		lastErr = peer.CallContext(callCtx, "Sleeper.Sleep", &SleepRequest{Millis: 1}, &resp)
+		return lastErr == nil
+	}) {
+		return fmt.Errorf("client is not called back after reconnecting: %v", lastErr)
+	}
+	return nil
+}
+
+type BlobRequest struct {
+	Data []byte
+}
+
+type BlobResponse struct {
+	Length int64
+}
+
+func init() {
+	rpc.RegisterType(BlobRequest{})
+	rpc.RegisterType(BlobResponse{})
+}
+
+// Blobs is an rpc service taking messages larger than a datagram
+type Blobs struct{}
+
+func (b *Blobs) Length(req BlobRequest, resp *BlobResponse) error {
+	resp.Length = int64(len(req.Data))
+	return nil
+}
+
+// udpProxy forwards the datagrams of a single client to a server and back, losing some of those of the client
+type udpProxy struct {
+	conn     *net.UDPConn // the client talks to
+	upstream *net.UDPConn // to the server
+	mu       sync.Mutex
+	rng      *rand.Rand
+	loss     float64
+	client   *net.UDPAddr
+	lost     atomic.Int64
+}
+
+func startUDPProxy(target string, seed int64, loss float64) (*udpProxy, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	raddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	upstream, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p := &udpProxy{conn: conn, upstream: upstream, rng: rand.New(rand.NewSource(seed)), loss: loss}
+	go p.forward()
+	go p.backward()
+	return p, nil
+}
+
+// drop decides whether the next datagram is lost
+func (p *udpProxy) drop() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rng.Float64() < p.loss {
+		p.lost.Add(1)
+		return true
+	}
+	return false
+}
+
+func (p *udpProxy) forward() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.client = addr
+		p.mu.Unlock()
+		if !p.drop() {
+			p.upstream.Write(buf[:n])
+		}
+	}
+}
+
+func (p *udpProxy) backward() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := p.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		client := p.client
+		p.mu.Unlock()
+		if client != nil {
+			p.conn.WriteToUDP(buf[:n], client)
+		}
+	}
+}
+
+func (p *udpProxy) Close() {
+	p.conn.Close()
+	p.upstream.Close()
+}
+
+// startBlobs serves Blobs over udp on a port of the loopback interface
+func startBlobs() (*rpc.Server, rpc.Transport, error) {
+	logger := logger.NewLogger("./server.log")
+	transport, err := rpc.Listen("127.0.0.1:0", logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	server := rpc.NewServer(logger)
+	if err := server.Register(&Blobs{}); err != nil {
+		transport.Close()
+		return nil, nil, err
+	}
+	go server.Accept(transport)
+	return server, transport, nil
+}
+
+// SimulatedLossyFragments checks that the fragments of a large call lost on the way are sent again on their own,
+// as soon as the server asks for them, rather than with the whole call once the client retransmits it.
+// The responses, which fit in a datagram, are not lost: only a retransmission of the call makes up for them.
+func SimulatedLossyFragments() error {
+	defer func(c, s int) {
+		rpc.ClientSideNetworkPacketLossProbability, rpc.ServerSideNetworkPacketLossProbability = c, s
+	}(rpc.ClientSideNetworkPacketLossProbability, rpc.ServerSideNetworkPacketLossProbability)
+	// the datagrams, rather than the messages, are lost
+	rpc.ClientSideNetworkPacketLossProbability, rpc.ServerSideNetworkPacketLossProbability = 0, 0
+	server, transport, err := startBlobs()
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown()
+	defer transport.Close()
+	proxy, err := startUDPProxy(transport.LocalAddr().String(), 1, 0.2)
+	if err != nil {
+		return err
+	}
+	defer proxy.Close()
+
+	client, err := rpc.Dial(proxy.conn.LocalAddr().String(), logger.NewLogger("./client1.log"))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	retransmitAfter := 5 * time.Second
+	client.SetRetryPolicy(rpc.RetryPolicy{MaxAttempts: 10, InitialBackoff: retransmitAfter, Multiplier: 1})
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := client.CallContext(ctx, "Server.Ping", &rpc.PingRequest{}, &rpc.PingResponse{}); err != nil {
+		return err
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 50*1024) // 10 datagrams or so
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		var resp BlobResponse
+		if err := client.CallContext(ctx, "Blobs.Length", &BlobRequest{Data: data}, &resp); err != nil {
+			return err
+		}
+		elapsed := time.Since(start)
+		if resp.Length != int64(len(data)) {
+			return fmt.Errorf("server got %d bytes, want %d", resp.Length, len(data))
+		}
+		if elapsed >= retransmitAfter {
+			return fmt.Errorf("call %d took %v, the lost fragments were only sent again with the whole call", i, elapsed.Round(time.Millisecond))
+		}
+	}
+	fmt.Printf("%d datagrams lost\n", proxy.lost.Load())
+	return nil
+}
+
+// SimulatedIncompleteFragmentsFlood checks that a sender flooding the server with the first fragment of
+// messages it never completes does not get the server to keep them all until they time out.
+func SimulatedIncompleteFragmentsFlood() error {
+	server, transport, err := startBlobs()
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown()
+	defer transport.Close()
+	raddr, err := net.ResolveUDPAddr("udp", transport.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	// the first of 1000 fragments of a message, as the fragmenter of the rpc package lays it out
+	const messages, payload = 2000, 48 * 1024
+	datagram := make([]byte, 17+payload)
+	datagram[0] = 0xF1
+	binary.LittleEndian.PutUint32(datagram[13:17], 1000)
+	for id := uint64(0); id < messages; id++ {
+		binary.LittleEndian.PutUint64(datagram[1:9], id)
+		if _, err := conn.Write(datagram); err != nil {
+			return err
+		}
+		if id%5 == 0 {
+			time.Sleep(time.Millisecond) // the server reads them all
+		}
+	}
+	time.Sleep(100 * time.Millisecond) // well before the incomplete messages time out
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	grown := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	fmt.Printf("heap grew by %d MB with %d MB of incomplete messages\n", grown>>20, messages*payload>>20)
+	if grown > 16<<20 {
+		return fmt.Errorf("heap grew by %d MB, the server keeps every incomplete message", grown>>20)
+	}
+	return nil
+}
+
+type TagResponse struct {
+	Tag string
+}
+
+func init() {
+	rpc.RegisterType(TagResponse{})
+}
+
+type tagKey struct{}
+
+// Tagger is an rpc service answering with the tag its interceptor puts in the context of the request
+type Tagger struct{}
+
+func (t *Tagger) Tag(ctx context.Context, req SleepRequest, resp *TagResponse) error {
+	tag, ok := ctx.Value(tagKey{}).(string)
+	if !ok {
+		return fmt.Errorf("no tag in the context")
+	}
+	resp.Tag = tag
+	return nil
+}
+
+// tagRequests is a server interceptor tagging the context of the requests with their trace,
+// which it learns from the context the server gives it
+func tagRequests(ctx context.Context, addr net.Addr, h *rpc.Header, args, reply interface{}, next rpc.ServerHandler) error {
+	sc, ok := trace.FromContext(ctx)
+	if !ok {
+		return fmt.Errorf("no trace in the context of %s", h.ServiceMethod)
+	}
+	return next(context.WithValue(ctx, tagKey{}, fmt.Sprintf("%s in trace %x", h.ServiceMethod, sc.TraceId)), addr, h, args, reply)
+}
+
+// SimulatedInterceptorContext checks that server interceptors get the context of the request,
+// and that the method gets the context they pass on, retransmissions included.
+func SimulatedInterceptorContext() error {
+	network := newSimNet(17, rpc.LinkConfig{Loss: 0.3, Duplicate: 0.1, Reorder: 0.1, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	defer network.Close()
+	logger := logger.NewLogger("./server.log")
+	transport, err := rpc.Listen("sim://tagger", logger)
+	if err != nil {
+		return err
+	}
+	server := rpc.NewServer(logger)
+	defer server.Shutdown()
+	if err := server.Register(&Tagger{}); err != nil {
+		return err
+	}
+	server.Use(tagRequests)
+	go server.Accept(transport)
+
+	client, err := rpc.Dial("sim://tagger", logger)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	for i := 0; i < 20; i++ {
+		traceId := uint64(0xfeed + i)
+		ctx := trace.NewContext(ctx, trace.SpanContext{TraceId: traceId, SpanId: 1})
+		var resp TagResponse
+		if err := client.CallContext(ctx, "Tagger.Tag", &SleepRequest{}, &resp); err != nil {
+			return err
+		}
+		if want := fmt.Sprintf("Tagger.Tag in trace %x", traceId); resp.Tag != want {
+			return fmt.Errorf("method got tag %q, want %q", resp.Tag, want)
+		}
+	}
+	return nil
+}
+
+type Point struct {
+	X, Y float64
+}
+
+// RichMessage has a field of every kind LabCodec encodes
+type RichMessage struct {
+	Int8    int8
+	Int64   int64
+	Uint16  uint16
+	Uint64  uint64
+	Float32 float32
+	Float64 float64
+	Flag    bool
+	Name    string
+	Raw     []byte
+	Origin  Point
+	Next    *Point
+	Path    []Point
+	Grid    [3]uint8
+	Labels  map[string]int32
+	Nested  map[string][]Point
+}
+
+func init() {
+	rpc.RegisterType(RichMessage{})
+}
+
+// Echo is an rpc service answering with what it is sent
+type Echo struct{}
+
+func (e *Echo) Rich(req RichMessage, resp *RichMessage) error {
+	*resp = req
+	return nil
+}
+
+// richMessage returns the i-th message of a series covering the range of every kind
+func richMessage(i int) RichMessage {
+	sign := int64(1 - 2*(i%2))
+	return RichMessage{
+		Int8:    int8(sign * 127),
+		Int64:   sign * (math.MaxInt64 - int64(i)),
+		Uint16:  math.MaxUint16 - uint16(i),
+		Uint64:  math.MaxUint64 - uint64(i),
+		Float32: float32(sign) * 1.5e-30,
+		Float64: float64(sign) * (math.MaxFloat64 / float64(i+1)),
+		Flag:    i%2 == 0,
+		Name:    fmt.Sprintf("message %d, é", i),
+		Raw:     offsets(10 * (i + 1)),
+		Origin:  Point{X: float64(i), Y: -float64(i)},
+		Next:    &Point{X: 0.25, Y: float64(sign)},
+		Path:    []Point{{X: 1}, {Y: 2}, {X: float64(i), Y: float64(i)}},
+		Grid:    [3]uint8{0, uint8(i), 255},
+		Labels:  map[string]int32{"min": math.MinInt32, "max": math.MaxInt32, strconv.Itoa(i): int32(i)},
+		Nested:  map[string][]Point{"a": {{X: 1, Y: 2}}, "b": {{X: 3}, {Y: 4}}},
+	}
+}
+
+// SimulatedRichLabMessages checks that LabCodec carries nested structs, pointers, slices, arrays, maps
+// and numbers of every size and sign over a lossy network, whole and unchanged.
+func SimulatedRichLabMessages() error {
+	network := newSimNet(3, rpc.LinkConfig{Loss: 0.3, Duplicate: 0.1, Reorder: 0.1, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	defer network.Close()
+	server, err := startServer("sim://echo", nil, &Echo{})
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown()
+	client, err := rpc.Dial("sim://echo", logger.NewLogger("./client1.log"))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.SetCodec(rpc.LabType); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	for i := 0; i < 20; i++ {
+		req := richMessage(i)
+		var resp RichMessage
+		if err := client.CallContext(ctx, "Echo.Rich", &req, &resp); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(req, resp) {
+			return fmt.Errorf("message %d came back as\n%+v\nwant\n%+v", i, resp, req)
+		}
+	}
+	return nil
+}
+
+// malformed returns variants of a valid frame: truncated, with flipped bits and with random bytes overwritten
+func malformed(frame []byte, rng *rand.Rand) [][]byte {
+	var variants [][]byte
+	for n := 0; n < len(frame); n++ {
+		variants = append(variants, frame[:n])
+	}
+	for i := 0; i < 200; i++ {
+		v := bytes.Clone(frame)
+		for j := 0; j <= i%4; j++ {
+			v[rng.Intn(len(v))] ^= 1 << rng.Intn(8)
+		}
+		variants = append(variants, v)
+	}
+	for i := 0; i < 200; i++ {
+		v := bytes.Clone(frame)
+		// lengths and counts turned into huge or negative values
+		at := rng.Intn(len(v) - 4)
+		binary.LittleEndian.PutUint32(v[at:], rng.Uint32()|0x80000000)
+		variants = append(variants, v)
+	}
+	return variants
+}
+
+// decodeSafely decodes the frame, turning a panic of the decoder into an error
+func decodeSafely(data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decoder panicked: %v", r)
+		}
+	}()
+	var m rpc.Message
+	rpc.DecodeFrame(data, &m)
+	return nil
+}
+
+// SimulatedMalformedMessages checks that malformed messages, of every protocol version and codec,
+// are rejected rather than crash the server, which goes on serving the well-formed ones.
+func SimulatedMalformedMessages() error {
+	network := newSimNet(4, rpc.LinkConfig{Loss: 0.2, Reorder: 0.1, Delay: time.Millisecond})
+	defer network.Close()
+	server, err := startServer("sim://hardened", nil, &Echo{})
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown()
+	attacker, remote, err := rpc.DialTransport("sim://hardened", nil)
+	if err != nil {
+		return err
+	}
+	defer attacker.Close()
+
+	rng := rand.New(rand.NewSource(4))
+	body := richMessage(1)
+	sent := 0
+	for _, version := range []uint16{1, 2, 3, rpc.ProtocolVersion} {
+		for _, codec := range []rpc.Type{rpc.LabType, rpc.GobType, rpc.JSONType} {
+			h := &rpc.Header{ServiceMethod: "Echo.Rich", Seq: uint64(version), Version: version}
+			frame, err := rpc.EncodeFrame(codec, h, &body)
+			if err != nil {
+				return err
+			}
+			for _, v := range malformed(frame, rng) {
+				if err := decodeSafely(v); err != nil {
+					return fmt.Errorf("%s message of version %d: %w", codec, version, err)
+				}
+				if err := attacker.WriteMessage(v, remote); err != nil {
+					return err
+				}
+				sent++
+			}
+		}
+	}
+	fmt.Printf("%d malformed messages sent\n", sent)
+
+	client, err := rpc.Dial("sim://hardened", logger.NewLogger("./client1.log"))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var resp RichMessage
+	if err := client.CallContext(ctx, "Echo.Rich", &body, &resp); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(body, resp) {
+		return fmt.Errorf("message came back as %+v, want %+v", resp, body)
+	}
+	return nil
+}
+
+// withoutPackageLoss turns the packet loss of the rpc package off until the returned function is called,
+// for the scenarios wrapping the transports, which hides the simulated network from the rpc package
+func withoutPackageLoss() (restore func()) {
+	client, server := rpc.ClientSideNetworkPacketLossProbability, rpc.ServerSideNetworkPacketLossProbability
+	rpc.ClientSideNetworkPacketLossProbability, rpc.ServerSideNetworkPacketLossProbability = 0, 0
+	return func() {
+		rpc.ClientSideNetworkPacketLossProbability, rpc.ServerSideNetworkPacketLossProbability = client, server
+	}
+}
+
+// codecRecorder records the codec of the frames of every method going through the transport
+type codecRecorder struct {
+	rpc.Transport
+	mu     sync.Mutex
+	codecs map[string]map[rpc.Type]bool // key: method
+}
+
+func (t *codecRecorder) record(data []byte) {
+	var m rpc.Message
+	codec, err := rpc.DecodeFrame(data, &m)
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.codecs == nil {
+		t.codecs = make(map[string]map[rpc.Type]bool)
+	}
+	if t.codecs[m.Header.ServiceMethod] == nil {
+		t.codecs[m.Header.ServiceMethod] = make(map[rpc.Type]bool)
+	}
+	t.codecs[m.Header.ServiceMethod][codec] = true
+}
+
+func (t *codecRecorder) ReadMessage() ([]byte, net.Addr, error) {
+	data, addr, err := t.Transport.ReadMessage()
+	if err == nil {
+		t.record(data)
+	}
+	return data, addr, err
+}
+
+func (t *codecRecorder) WriteMessage(data []byte, addr net.Addr) error {
+	t.record(data)
+	return t.Transport.WriteMessage(data, addr)
+}
+
+// SimulatedCodecPerClient checks that a server answers each client with the codec of its requests,
+// whichever codec the other clients use, over a lossy network.
+func SimulatedCodecPerClient() error {
+	defer withoutPackageLoss()()
+	network := newSimNet(6, rpc.LinkConfig{Loss: 0.3, Duplicate: 0.1, Reorder: 0.1, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	defer network.Close()
+	server, err := startServer("sim://codecs", nil, &Echo{})
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	codecs := []rpc.Type{rpc.LabType, rpc.GobType, rpc.JSONType}
+	recorders := make([]*codecRecorder, len(codecs))
+	errs := make([]error, len(codecs))
+	var wg sync.WaitGroup
+	for i, codec := range codecs {
+		transport, remote, err := rpc.DialTransport("sim://codecs", nil)
+		if err != nil {
+			return err
+		}
+		recorders[i] = &codecRecorder{Transport: transport}
+		client := rpc.NewClient(recorders[i], remote, logger.NewLogger("./client1.log"))
+		defer client.Close()
+		if err := client.SetCodec(codec); err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func(i int, client *rpc.Client) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				req := richMessage(j)
+				var resp RichMessage
+				if err := client.CallContext(ctx, "Echo.Rich", &req, &resp); err != nil {
+					errs[i] = err
+					return
+				}
+				if !reflect.DeepEqual(req, resp) {
+					errs[i] = fmt.Errorf("message %d came back as %+v", j, resp)
+					return
+				}
+			}
+		}(i, client)
+	}
+	wg.Wait()
+	for i, codec := range codecs {
+		if errs[i] != nil {
+			return fmt.Errorf("%s client: %w", codec, errs[i])
+		}
+		recorders[i].mu.Lock()
+		used := recorders[i].codecs["Echo.Rich"]
+		recorders[i].mu.Unlock()
+		if len(used) != 1 || !used[codec] {
+			return fmt.Errorf("%s client: requests and responses are encoded with %v", codec, used)
+		}
+	}
+	return nil
+}
+
+// SimulatedCallDeadlineAndCancel checks that a call to an unreachable server ends when its context is done,
+// with the error of the context, and that the client calls the server once it is reachable again.
+func SimulatedCallDeadlineAndCancel() error {
+	network := newSimNet(7, rpc.LinkConfig{Loss: 0.2, Delay: time.Millisecond})
+	defer network.Close()
+	network.SetLink("*", "unreachable", rpc.LinkConfig{Loss: 1})
+	server, err := startServer("sim://unreachable", nil, &Echo{})
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown()
+	client, err := rpc.Dial("sim://unreachable", logger.NewLogger("./client1.log"))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	req := richMessage(7)
+
+	deadline := 300 * time.Millisecond
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	start := time.Now()
+	err = client.CallContext(ctx, "Echo.Rich", &req, &RichMessage{})
+	if elapsed := time.Since(start); !errors.Is(err, context.DeadlineExceeded) || elapsed > deadline+200*time.Millisecond {
+		return fmt.Errorf("call with a deadline of %v ended after %v with %v", deadline, elapsed.Round(time.Millisecond), err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	call := client.GoContext(ctx, "Echo.Rich", &req, &RichMessage{}, nil)
+	time.Sleep(100 * time.Millisecond)
+	start = time.Now()
+	cancel()
+	select {
+	case <-call.Done:
+		if !errors.Is(call.Error, context.Canceled) {
+			return fmt.Errorf("canceled call ended with %v", call.Error)
+		}
+	case <-time.After(200 * time.Millisecond):
+		return fmt.Errorf("call still running %v after it was canceled", time.Since(start).Round(time.Millisecond))
+	}
+
+	network.SetLink("*", "unreachable", rpc.LinkConfig{Loss: 0.2, Delay: time.Millisecond})
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var resp RichMessage
+	if err := client.CallContext(ctx, "Echo.Rich", &req, &resp); err != nil {
+		return fmt.Errorf("call once the server is reachable: %w", err)
+	}
+	if !reflect.DeepEqual(req, resp) {
+		return fmt.Errorf("message came back as %+v", resp)
+	}
+	return nil
+}
+
+// sendRecorder records when the requests of every method are sent over the transport
+type sendRecorder struct {
+	rpc.Transport
+	mu   sync.Mutex
+	sent map[string][]time.Time // key: method
+}
+
+func (t *sendRecorder) WriteMessage(data []byte, addr net.Addr) error {
+	var m rpc.Message
+	if _, err := rpc.DecodeFrame(data, &m); err == nil && !m.Header.Response {
+		t.mu.Lock()
+		if t.sent == nil {
+			t.sent = make(map[string][]time.Time)
+		}
+		t.sent[m.Header.ServiceMethod] = append(t.sent[m.Header.ServiceMethod], time.Now())
+		t.mu.Unlock()
+	}
+	return t.Transport.WriteMessage(data, addr)
+}
+
+func (t *sendRecorder) times(serviceMethod string) []time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]time.Time(nil), t.sent[serviceMethod]...)
+}
+
+// SimulatedRetryPolicyPerMethod checks that the calls to a server that never answers are retransmitted
+// as the policy of their method says, backing off exponentially within the jitter, up to its number of attempts,
+// and that the other methods follow the policy of the client.
+func SimulatedRetryPolicyPerMethod() error {
+	defer withoutPackageLoss()()
+	network := newSimNet(8, rpc.LinkConfig{Delay: time.Millisecond})
+	defer network.Close()
+	server, err := startServer("sim://silent", nil, &Echo{}, &Sleeper{})
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown()
+	transport, remote, err := rpc.DialTransport("sim://silent", nil)
+	if err != nil {
+		return err
+	}
+	recorder := &sendRecorder{Transport: transport}
+	client := rpc.NewClient(recorder, remote, logger.NewLogger("./client1.log"))
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := client.CallContext(ctx, "Server.Ping", &rpc.PingRequest{}, &rpc.PingResponse{}); err != nil {
+		return err
+	}
+	// the server is silent from now on
+	network.SetLink("*", "silent", rpc.LinkConfig{Loss: 1})
+
+	policy := rpc.RetryPolicy{MaxAttempts: 5, InitialBackoff: 40 * time.Millisecond, MaxBackoff: 200 * time.Millisecond, Multiplier: 2, Jitter: 0.25}
+	client.SetMethodRetryPolicy("Echo.Rich", policy)
+	client.SetRetryPolicy(rpc.RetryPolicy{MaxAttempts: 2, InitialBackoff: 30 * time.Millisecond, Multiplier: 1})
+	req := richMessage(8)
+	if err := client.CallContext(ctx, "Echo.Rich", &req, &RichMessage{}); err == nil {
+		return fmt.Errorf("call to a silent server succeeded")
+	}
+	if err := client.CallContext(ctx, "Sleeper.Sleep", &SleepRequest{}, &SleepResponse{}); err == nil {
+		return fmt.Errorf("call to a silent server succeeded")
+	}
+
+	sent := recorder.times("Echo.Rich")
+	if uint64(len(sent)) != policy.MaxAttempts {
+		return fmt.Errorf("Echo.Rich sent %d times, want %d", len(sent), policy.MaxAttempts)
+	}
+	backoff := policy.InitialBackoff
+	for i := 1; i < len(sent); i++ {
+		gap := sent[i].Sub(sent[i-1])
+		low := time.Duration(float64(backoff) * (1 - policy.Jitter))
+		high := time.Duration(float64(backoff)*(1+policy.Jitter)) + 20*time.Millisecond
+		if gap < low || gap > high {
+			return fmt.Errorf("retransmission %d of Echo.Rich after %v, want %v to %v", i, gap.Round(time.Millisecond), low, high)
+		}
+		backoff = min(2*backoff, policy.MaxBackoff)
+	}
+	if n := len(recorder.times("Sleeper.Sleep")); n != 2 {
+		return fmt.Errorf("Sleeper.Sleep sent %d times, want 2 as the policy of the client says", n)
+	}
+	return nil
+}
+
+// SimulatedAdaptiveRetransmissionTimeout checks that the retransmission timeout grows to the round trip time
+// of a network much slower than the initial backoff, so that the calls are no longer retransmitted for nothing.
+// Until then every call is retransmitted, and its reply, which may answer any of its transmissions, must not be
+// sampled: measured from the last transmission it would keep the timeout below the round trip time for good.
+func SimulatedAdaptiveRetransmissionTimeout() error {
+	defer withoutPackageLoss()()
+	delay := 100 * time.Millisecond // each way
+	network := newSimNet(9, rpc.LinkConfig{Delay: delay})
+	defer network.Close()
+	server, err := startServer("sim://faraway", nil, &Echo{})
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown()
+	transport, remote, err := rpc.DialTransport("sim://faraway", nil)
+	if err != nil {
+		return err
+	}
+	recorder := &sendRecorder{Transport: transport}
+	client := rpc.NewClient(recorder, remote, logger.NewLogger("./client1.log"))
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+
+	const calls = 30
+	req := richMessage(9)
+	for i := 0; i < calls; i++ {
+		if err := client.CallContext(ctx, "Echo.Rich", &req, &RichMessage{}); err != nil {
+			return err
+		}
+	}
+	sent := len(recorder.times("Echo.Rich"))
+	fmt.Printf("%d calls sent %d times, retransmission timeout %v\n", calls, sent, client.RTO())
+	if rto := client.RTO(); rto < 2*delay {
+		return fmt.Errorf("retransmission timeout %v is below the round trip time of %v", rto, 2*delay)
+	}
+	// a few calls are retransmitted while the timeout grows, the others are sent once
+	if sent > calls+calls/2 {
+		return fmt.Errorf("%d calls sent %d times", calls, sent)
+	}
+	return nil
+}
+
+// Profile is a message type whose schema version 2 adds Email. It is registered by the scenario rather than
+// in init, since a process acting as an older build registers version 1 of the type instead, see runOldSchemaClient
+type Profile struct {
+	Name  string
+	Age   int64
+	Email string
+}
+
+// Profiles is an rpc service updating profiles of version 2
+type Profiles struct {
+	mu     sync.Mutex
+	emails []string // email of the profiles received
+}
+
+func (p *Profiles) Birthday(req Profile, resp *Profile) error {
+	p.mu.Lock()
+	p.emails = append(p.emails, req.Email)
+	p.mu.Unlock()
+	*resp = req
+	resp.Age++
+	resp.Email = strings.ToLower(req.Name) + "@example.com"
+	return nil
+}
+
+// runOldSchemaClient calls the server at addr the way a build that predates Profile.Email does
+func runOldSchemaClient(addr string) error {
+	type Profile struct {
+		Name string
+		Age  int64
+	}
+	rpc.RegisterVersionedType(Profile{}, 1)
+	client, err := rpc.Dial(addr, logger.NewLogger("./client2.log"))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	req := Profile{Name: "Ada", Age: 36}
+	var resp Profile
+	if err := client.CallContext(ctx, "Profiles.Birthday", &req, &resp); err != nil {
+		return err
+	}
+	if want := (Profile{Name: "Ada", Age: 37}); resp != want {
+		return fmt.Errorf("got %+v, want %+v", resp, want)
+	}
+	return nil
+}
+
+// SimulatedSchemaEvolution checks that a client of an older build and a server whose messages gained a field
+// understand each other: the server leaves the missing field at its zero value, and the client skips the new one.
+// The older build is this driver run as another process, over udp with the packet loss of the rpc package.
+func SimulatedSchemaEvolution() error {
+	rpc.RegisterVersionedType(Profile{}, 2) // version 2 adds Email
+	profiles := &Profiles{}
+	logger := logger.NewLogger("./server.log")
+	transport, err := rpc.Listen("127.0.0.1:0", logger)
+	if err != nil {
+		return err
+	}
+	defer transport.Close()
+	server := rpc.NewServer(logger)
+	defer server.Shutdown()
+	if err := server.Register(profiles); err != nil {
+		return err
+	}
+	go server.Accept(transport)
+
+	out, err := exec.Command(os.Args[0], "-old-schema-client", transport.LocalAddr().String()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("old client: %v: %s", err, out)
+	}
+	profiles.mu.Lock()
+	defer profiles.mu.Unlock()
+	for _, email := range profiles.emails {
+		if email != "" {
+			return fmt.Errorf("server got email %q from a client that knows no email", email)
+		}
+	}
+	if len(profiles.emails) == 0 {
+		return fmt.Errorf("server got no profile")
+	}
+	return nil
+}
+
+// AddRequest and AddResponse are the messages of Counter.Add
+type AddRequest struct {
+	N int64
+}
+
+type AddResponse struct {
+	Total int64
+}
+
+func init() {
+	rpc.RegisterType(AddRequest{})
+	rpc.RegisterType(AddResponse{})
+}
+
+// Counter is an rpc service whose Add is not idempotent, every call that runs again counts again
+type Counter struct {
+	mu    sync.Mutex
+	total int64
+}
+
+func (c *Counter) Add(req AddRequest, resp *AddResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total += req.N
+	resp.Total = c.total
+	return nil
+}
+
+// dialFrom creates a client of the endpoint at addr of the simulated network, sending from the address from,
+// so that a restarted client comes from the address of the client it replaces
+func dialFrom(network *rpc.SimNet, from, addr, logFile string) (*rpc.Client, error) {
+	transport, err := network.Listen(from)
+	if err != nil {
+		return nil, err
+	}
+	dialed, remote, err := network.Dial(addr)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	dialed.Close() // only its remote address is needed
+	return rpc.NewClient(transport, remote, logger.NewLogger(logFile)), nil
+}
+
+// SimulatedClientRestart restarts a client on the same address over a lossy network. The sequence numbers of
+// the new client start over from 1, and its calls must run rather than being answered with the replies cached
+// for the calls of the previous client that had the same sequence numbers.
+func SimulatedClientRestart() error {
+	defer withoutPackageLoss()()
+	network := newSimNet(10, rpc.LinkConfig{Loss: 0.3, Duplicate: 0.1, Reorder: 0.1, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	defer network.Close()
+	counter := &Counter{}
+	server, err := startServer("sim://counter", nil, counter)
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	const calls = 10
+	var total int64
+	for restart := 0; restart < 2; restart++ {
+		client, err := dialFrom(network, "restarting", "counter", "./client1.log")
+		if err != nil {
+			return err
+		}
+		for i := 0; i < calls; i++ {
+			var resp AddResponse
+			if err := client.CallContext(ctx, "Counter.Add", &AddRequest{N: 1}, &resp); err != nil {
+				client.Close()
+				return err
+			}
+			total++
+			if resp.Total != total {
+				client.Close()
+				return fmt.Errorf("call %d of client incarnation %d got total %d, want %d", i+1, restart+1, resp.Total, total)
+			}
+		}
+		client.Close()
+	}
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	if counter.total != total {
+		return fmt.Errorf("counted %d, want %d", counter.total, total)
+	}
+	return nil
+}
+
+// startLoggedServer serves the services at addr with the reply cache logged to the file at path.
+// Shutting the server down leaves the transport open, so that it can be closed to restart the server.
+func startLoggedServer(addr, path string, services ...interface{}) (*rpc.Server, rpc.Transport, error) {
+	logger := logger.NewLogger("./server.log")
+	transport, err := rpc.Listen(addr, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	server := rpc.NewServer(logger)
+	if err := server.EnableReplyLog(path); err != nil {
+		transport.Close()
+		return nil, nil, err
+	}
+	for _, service := range services {
+		if err := server.Register(service); err != nil {
+			server.Shutdown()
+			transport.Close()
+			return nil, nil, err
+		}
+	}
+	go server.Accept(transport)
+	return server, transport, nil
+}
+
+// SimulatedServerRestartWithReplyLog restarts a server whose reply cache is logged, after it has run a call
+// whose response is lost. The retransmissions of the call reach the restarted server, which must answer them
+// with the logged reply rather than running the call again.
+func SimulatedServerRestartWithReplyLog() error {
+	defer withoutPackageLoss()()
+	lossy := rpc.LinkConfig{Loss: 0.2, Duplicate: 0.1, Reorder: 0.1, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond}
+	network := newSimNet(11, lossy)
+	defer network.Close()
+	dir, err := os.MkdirTemp("", "dfs-test-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "replies.log")
+	counter := &Counter{}
+	server, transport, err := startLoggedServer("sim://counter", path, counter)
+	if err != nil {
+		return err
+	}
+	client, err := rpc.Dial("sim://counter", logger.NewLogger("./client1.log"))
+	if err != nil {
+		server.Shutdown()
+		transport.Close()
+		return err
+	}
+	defer client.Close()
+	// the call must outlast the restart
+	client.SetRetryPolicy(rpc.RetryPolicy{MaxAttempts: math.MaxUint64, InitialBackoff: 20 * time.Millisecond, MaxBackoff: 100 * time.Millisecond, Multiplier: 2})
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	const calls = 5
+	for i := 0; i < calls; i++ {
+		if err := client.CallContext(ctx, "Counter.Add", &AddRequest{N: 1}, &AddResponse{}); err != nil {
+			server.Shutdown()
+			transport.Close()
+			return err
+		}
+	}
+	// the server runs the next call, but its responses are lost until it has restarted
+	network.SetLink("counter", "*", rpc.LinkConfig{Loss: 1})
+	var resp AddResponse
+	done := make(chan error, 1)
+	go func() { done <- client.CallContext(ctx, "Counter.Add", &AddRequest{N: 1}, &resp) }()
+	ran := eventually(5*time.Second, func() bool {
+		counter.mu.Lock()
+		defer counter.mu.Unlock()
+		return counter.total == calls+1
+	})
+	time.Sleep(100 * time.Millisecond) // to make sure the reply is logged
+	server.Shutdown()
+	transport.Close()
+	if !ran {
+		return fmt.Errorf("the server did not run call %d", calls+1)
+	}
+
+	// the count is kept across the restart, like the files of a file server
+	restarted := &Counter{total: calls + 1}
+	server, transport, err = startLoggedServer("sim://counter", path, restarted)
+	if err != nil {
+		return err
+	}
+	defer transport.Close()
+	defer server.Shutdown()
+	network.SetLink("counter", "*", lossy)
+	if err := <-done; err != nil {
+		return err
+	}
+	if resp.Total != calls+1 {
+		return fmt.Errorf("call %d got total %d, want %d", calls+1, resp.Total, calls+1)
+	}
+	restarted.mu.Lock()
+	defer restarted.mu.Unlock()
+	if restarted.total != calls+1 {
+		return fmt.Errorf("counted %d after the restart, want %d: the restarted server ran the call again", restarted.total, calls+1)
+	}
+	return nil
+}
+
+// PageRequest and PageResponse are the messages of Pages.Read
+type PageRequest struct {
+	Number int64
+	Size   int64
+}
+
+type PageResponse struct {
+	Data []byte
+}
+
+func init() {
+	rpc.RegisterType(PageRequest{})
+	rpc.RegisterType(PageResponse{})
+}
+
+// Pages is an rpc service whose Read returns large replies and is idempotent, like the reads of a file server
+type Pages struct {
+	reads atomic.Int64 // number of times Read has run
+}
+
+func (p *Pages) IdempotentMethods() []string {
+	return []string{"Read"}
+}
+
+func (p *Pages) Read(req PageRequest, resp *PageResponse) error {
+	p.reads.Add(1)
+	resp.Data = bytes.Repeat([]byte{byte(req.Number)}, int(req.Size))
+	return nil
+}
+
+// SimulatedIdempotentMethods has a client read pages and count over a lossy network, with the reply cache of the
+// server logged. The reads are declared idempotent, so their large replies must stay out of the cache and its log,
+// while the counts, which are not, must still run once per call.
+func SimulatedIdempotentMethods() error {
+	defer withoutPackageLoss()()
+	network := newSimNet(12, rpc.LinkConfig{Loss: 0.3, Duplicate: 0.1, Reorder: 0.1, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	defer network.Close()
+	dir, err := os.MkdirTemp("", "dfs-test-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "replies.log")
+	counter, pages := &Counter{}, &Pages{}
+	server, transport, err := startLoggedServer("sim://pages", path, counter, pages)
+	if err != nil {
+		return err
+	}
+	defer transport.Close()
+	defer server.Shutdown()
+	client, err := rpc.Dial("sim://pages", logger.NewLogger("./client1.log"))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	const calls, size = 20, 16 * 1024
+	for i := 0; i < calls; i++ {
+		var page PageResponse
+		if err := client.CallContext(ctx, "Pages.Read", &PageRequest{Number: int64(i), Size: size}, &page); err != nil {
+			return err
+		}
+		if !bytes.Equal(page.Data, bytes.Repeat([]byte{byte(i)}, size)) {
+			return fmt.Errorf("read %d bytes that are not page %d", len(page.Data), i)
+		}
+		if err := client.CallContext(ctx, "Counter.Add", &AddRequest{N: 1}, &AddResponse{}); err != nil {
+			return err
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d pages read %d times, reply log of %d bytes\n", calls, pages.reads.Load(), info.Size())
+	if info.Size() >= size {
+		return fmt.Errorf("reply log of %d bytes holds the replies of idempotent reads", info.Size())
+	}
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	if counter.total != calls {
+		return fmt.Errorf("counted %d, want %d: a call to a method that is not idempotent ran more than once", counter.total, calls)
+	}
+	return nil
+}
+
+// bitFlipper flips a bit in the byte fields of some of the messages going through the transport both ways,
+// like a faulty link whose corruption is left undetected by the checksums of udp
+type bitFlipper struct {
+	rpc.Transport
+	mu      sync.Mutex
+	rng     *rand.Rand
+	rate    float64
+	flipped atomic.Int64
+}
+
+// flip returns data with a bit flipped inside the first offsets(n) field it carries, if chosen to
+func (t *bitFlipper) flip(data []byte) []byte {
+	i := bytes.Index(data, []byte("000000000\n"))
+	t.mu.Lock()
+	chosen := t.rng.Float64() < t.rate
+	t.mu.Unlock()
+	if i < 0 || !chosen {
+		return data
+	}
+	flipped := append([]byte(nil), data...)
+	flipped[i+4] ^= 0x10
+	t.flipped.Add(1)
+	return flipped
+}
+
+func (t *bitFlipper) ReadMessage() ([]byte, net.Addr, error) {
+	data, addr, err := t.Transport.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	return t.flip(data), addr, nil
+}
+
+func (t *bitFlipper) WriteMessage(data []byte, addr net.Addr) error {
+	return t.Transport.WriteMessage(t.flip(data), addr)
+}
+
+// SimulatedCorruptedMessages has a client echo messages carrying bytes through a link that flips bits in them,
+// on top of losing, duplicating and reordering messages. The corrupted requests and responses must be dropped and
+// counted, and their retransmissions must bring every echo back whole.
+func SimulatedCorruptedMessages() error {
+	defer withoutPackageLoss()()
+	network := newSimNet(14, rpc.LinkConfig{Loss: 0.1, Duplicate: 0.1, Reorder: 0.1, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	defer network.Close()
+	flipper := &bitFlipper{rng: rand.New(rand.NewSource(14)), rate: 0.3}
+	server, err := startServer("sim://echo", func(t rpc.Transport) rpc.Transport {
+		flipper.Transport = t
+		return flipper
+	}, &Echo{})
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown()
+	client, err := rpc.Dial("sim://echo", logger.NewLogger("./client1.log"))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	corrupted := rpc.CorruptedMessages()
+	for i := 0; i < 20; i++ {
+		req := richMessage(i)
+		var resp RichMessage
+		if err := client.CallContext(ctx, "Echo.Rich", &req, &resp); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(req, resp) {
+			return fmt.Errorf("message %d came back corrupted: %q, want %q", i, resp.Raw, req.Raw)
+		}
+	}
+	dropped := rpc.CorruptedMessages() - corrupted
+	fmt.Printf("%d messages corrupted, %d dropped\n", flipper.flipped.Load(), dropped)
+	if flipper.flipped.Load() == 0 {
+		return fmt.Errorf("no message was corrupted")
+	}
+	if dropped == 0 {
+		return fmt.Errorf("no corrupted message was dropped")
+	}
+	return nil
+}
+
+// datagramRecorder keeps a copy of every message read from the transport, as an eavesdropper next to it would
+type datagramRecorder struct {
+	rpc.Transport
+	mu   sync.Mutex
+	read [][]byte
+}
+
+func (t *datagramRecorder) ReadMessage() ([]byte, net.Addr, error) {
+	data, addr, err := t.Transport.ReadMessage()
+	if err == nil {
+		t.mu.Lock()
+		t.read = append(t.read, append([]byte(nil), data...))
+		t.mu.Unlock()
+	}
+	return data, addr, err
+}
+
+func (t *datagramRecorder) messages() [][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([][]byte(nil), t.read...)
+}
+
+// SimulatedAuthenticatedCalls serves a counter to the holders of a key over a lossy network. The calls of the
+// client holding the key must run once each, while the calls of clients signing with another key or not at all,
+// and the requests of the client replayed from another address, must be rejected without running.
+func SimulatedAuthenticatedCalls() error {
+	defer withoutPackageLoss()()
+	network := newSimNet(15, rpc.LinkConfig{Loss: 0.2, Duplicate: 0.1, Reorder: 0.1, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	defer network.Close()
+	key := []byte("alice's secret")
+	keyring := rpc.NewKeyring()
+	keyring.Add("alice", key)
+	counter := &Counter{}
+	wire := &datagramRecorder{}
+	server, err := startServer("sim://vault", func(t rpc.Transport) rpc.Transport {
+		wire.Transport = t
+		return rpc.NewAuthTransport(wire, keyring, "", logger.NewLogger("./server.log"))
+	}, counter)
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	alice, err := rpc.DialWithKey("sim://vault", "alice", key, logger.NewLogger("./client1.log"))
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	const calls = 10
+	for i := 0; i < calls; i++ {
+		if err := alice.CallContext(ctx, "Counter.Add", &AddRequest{N: 1}, &AddResponse{}); err != nil {
+			return err
+		}
+	}
+	replayed := wire.messages()
+
+	forger, err := rpc.DialWithKey("sim://vault", "alice", []byte("a guess"), logger.NewLogger("./client2.log"))
+	if err != nil {
+		return err
+	}
+	anonymous, err := rpc.Dial("sim://vault", logger.NewLogger("./client2.log"))
+	if err != nil {
+		forger.Close()
+		return err
+	}
+	for name, client := range map[string]*rpc.Client{"client signing with another key": forger, "client signing with no key": anonymous} {
+		callCtx, cancel := context.WithTimeout(ctx, time.Second)
+		err := client.CallContext(callCtx, "Counter.Add", &AddRequest{N: 1}, &AddResponse{})
+		cancel()
+		if err == nil {
+			forger.Close()
+			anonymous.Close()
+			return fmt.Errorf("%s is served", name)
+		}
+	}
+	// their handshakes are retransmitted until they are closed
+	forger.Close()
+	anonymous.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// an eavesdropper sends the requests of alice the server has received again, from another address
+	replayer, remote, err := network.Dial("vault")
+	if err != nil {
+		return err
+	}
+	defer replayer.Close()
+	network.SetLink(replayer.LocalAddr().String(), "*", rpc.LinkConfig{}) // every replay reaches the server
+	answered := make(chan struct{}, 1)
+	go func() {
+		if _, _, err := replayer.ReadMessage(); err == nil {
+			answered <- struct{}{}
+		}
+	}()
+	rejected := rpc.RejectedMessages()
+	for _, data := range replayed {
+		if err := replayer.WriteMessage(data, remote); err != nil {
+			return err
+		}
+	}
+	if !eventually(2*time.Second, func() bool { return rpc.RejectedMessages()-rejected >= uint64(len(replayed)) }) {
+		return fmt.Errorf("%d of the %d replayed requests are rejected", rpc.RejectedMessages()-rejected, len(replayed))
+	}
+	select {
+	case <-answered:
+		return fmt.Errorf("the server answered a replayed request")
+	case <-time.After(100 * time.Millisecond):
+	}
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	if counter.total != calls {
+		return fmt.Errorf("counted %d, want the %d calls of alice", counter.total, calls)
+	}
+	return nil
+}
+
+// sniffer counts the messages going through the transport both ways, and those carrying plaintext
+type sniffer struct {
+	rpc.Transport
+	plaintext []byte
+	messages  atomic.Int64
+	leaked    atomic.Int64 // messages in which plaintext can be read
+}
+
+func (t *sniffer) sniff(data []byte) {
+	t.messages.Add(1)
+	if bytes.Contains(data, t.plaintext) {
+		t.leaked.Add(1)
+	}
+}
+
+func (t *sniffer) ReadMessage() ([]byte, net.Addr, error) {
+	data, addr, err := t.Transport.ReadMessage()
+	if err == nil {
+		t.sniff(data)
+	}
+	return data, addr, err
+}
+
+func (t *sniffer) WriteMessage(data []byte, addr net.Addr) error {
+	t.sniff(data)
+	return t.Transport.WriteMessage(data, addr)
+}
+
+// SimulatedEncryptedCalls has a client call a server and the server call the client back over the connection
+// of the client, both with a key they share and over a lossy network. The messages carry a secret, which must
+// come through whole both ways without being readable in any message on the network.
+func SimulatedEncryptedCalls() error {
+	defer withoutPackageLoss()()
+	network := newSimNet(16, rpc.LinkConfig{Loss: 0.2, Duplicate: 0.1, Reorder: 0.1, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	defer network.Close()
+	key := []byte("alice's secret")
+	keyring := rpc.NewKeyring()
+	keyring.Add("alice", key)
+	secret := "the contents of a file nobody else may read"
+	wire := &sniffer{plaintext: []byte(secret)}
+	watcher := &Watcher{}
+	server, err := startServer("sim://vault", func(t rpc.Transport) rpc.Transport {
+		wire.Transport = t
+		return rpc.NewSecureTransport(wire, keyring, "", logger.NewLogger("./server.log"))
+	}, &Echo{}, watcher)
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	client, err := rpc.DialSecure("sim://vault", "alice", key, logger.NewLogger("./client1.log"))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	callbacks := rpc.NewServer(logger.NewLogger("./client1.log"))
+	if err := callbacks.Register(&Echo{}); err != nil {
+		return err
+	}
+	client.Serve(callbacks)
+
+	req := richMessage(16)
+	req.Name = secret
+	for i := 0; i < 10; i++ {
+		var resp RichMessage
+		if err := client.CallContext(ctx, "Echo.Rich", &req, &resp); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(req, resp) {
+			return fmt.Errorf("server echoed %+v, want %+v", resp, req)
+		}
+	}
+	if err := client.CallContext(ctx, "Watcher.Watch", &SleepRequest{}, &SleepResponse{}); err != nil {
+		return err
+	}
+	watcher.mu.Lock()
+	ref := watcher.refs[0]
+	watcher.mu.Unlock()
+	peer, err := ref.Client()
+	if err != nil {
+		return err
+	}
+	var resp RichMessage
+	if err := peer.CallContext(ctx, "Echo.Rich", &req, &resp); err != nil {
+		return fmt.Errorf("call back: %v", err)
+	}
+	if !reflect.DeepEqual(req, resp) {
+		return fmt.Errorf("client echoed %+v, want %+v", resp, req)
+	}
+	fmt.Printf("%d messages on the network, %d carrying the secret in plaintext\n", wire.messages.Load(), wire.leaked.Load())
+	if wire.leaked.Load() > 0 {
+		return fmt.Errorf("%d of %d messages carry the secret in plaintext", wire.leaked.Load(), wire.messages.Load())
+	}
+	return nil
+}
+
+// freeAddr returns a local tcp address nothing listens on
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// scrape reads the metrics served at http://<addr>/metrics, by series, e.g. `name{label="value"}`
+func scrape(addr string) (map[string]float64, error) {
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	series := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line %q: %v", line, err)
+		}
+		series[line[:i]] = value
+	}
+	return series, scanner.Err()
+}
+
+// sum adds up the values of the series of the metric name
+func sum(series map[string]float64, name string) float64 {
+	total := 0.0
+	for s, value := range series {
+		if s == name || strings.HasPrefix(s, name+"{") {
+			total += value
+		}
+	}
+	return total
+}
+
+// SimulatedMetrics has two clients of a file server read and write a file over a lossy network, and reads
+// the metrics the server and the first client serve over http. They must count the calls, the reads served
+// from the cache of the client, the retransmissions the losses cause and the callbacks the write causes.
+func SimulatedMetrics() error {
+	if err := exportFiles(map[string][]byte{"etc/exports/mockdir1/testfile2.txt": []byte("content of testfile2\n")}); err != nil {
+		return err
+	}
+	network := newSimNet(18, rpc.LinkConfig{Loss: 0.3, Duplicate: 0.1, Reorder: 0.1, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	defer network.Close()
+	serverMetrics, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	clientMetrics, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	simServerAddr := "sim://server"
+	server := service.NewFileServer(simServerAddr)
+	if err := server.ServeMetrics(serverMetrics); err != nil {
+		return err
+	}
+	go server.Run()
+	time.Sleep(100 * time.Millisecond) // to make sure server is up
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	c1 := service.NewFileClient("1", "", simServerAddr)
+	defer c1.Shutdown()
+	if err := c1.ServeMetrics(clientMetrics); err != nil {
+		return err
+	}
+	c2 := service.NewFileClient("2", "", simServerAddr)
+	defer c2.Shutdown()
+	var fds []*service.FileDescriptor
+	for i, c := range []*service.FileClient{c1, c2} {
+		target := strconv.Itoa(i + 1)
+		if err := c.Mount(ctx, "etc/exports/mockdir1", target, service.AndrewFileSystemType); err != nil {
+			return err
+		}
+		fd, err := c.Open(ctx, target+"/testfile2.txt")
+		if err != nil {
+			return err
+		}
+		fds = append(fds, fd)
+	}
+	// opening the file has fetched it, the reads are served from the cache
+	for i := 0; i < 2; i++ {
+		if _, err := c1.ReadAt(ctx, fds[0], 0, 7); err != nil {
+			return err
+		}
+	}
+	if _, err := c2.Write(ctx, fds[1], 0, []byte("written by client 2\n")); err != nil {
+		return err
+	}
+	c2.Close(ctx, fds[1]) // sends the write to the server, which calls client 1 back
+	if !eventually(5*time.Second, fds[0].CallbackPromise.IsCanceled) {
+		return fmt.Errorf("[file client 1] callback promise still valid after client 2 wrote the file")
+	}
+
+	s, err := scrape(serverMetrics)
+	if err != nil {
+		return fmt.Errorf("server metrics: %v", err)
+	}
+	c, err := scrape(clientMetrics)
+	if err != nil {
+		return fmt.Errorf("client metrics: %v", err)
+	}
+	checks := []struct {
+		what      string
+		got, want float64
+		atLeast   bool
+	}{
+		{"calls of FileServer.Read served", s[`rpc_server_method_calls_total{method="FileServer.Read"}`], 1, true}, // runs again when its reply is lost
+		{"requests timed by the server", sum(s, "rpc_server_request_duration_seconds_count"), 1, true},
+		{"callbacks sent by the server", s[`file_server_callbacks_total{outcome="sent"}`], 1, true},
+		{"calls of FileServer.Read made by the client", c[`rpc_client_calls_total{method="FileServer.Read"}`], 1, false},
+		{"retransmissions of the client", sum(c, "rpc_client_retransmissions_total"), 1, true},
+		{"reads served from the cache", c["file_client_cache_hits_total"], 2, false},
+		{"callbacks served by the client", c[`rpc_server_method_calls_total{method="FileClient.UpdateCallbackPromise"}`], 1, true},
+	}
+	for _, check := range checks {
+		fmt.Printf("%s: %v\n", check.what, check.got)
+		if check.got < check.want || !check.atLeast && check.got != check.want {
+			return fmt.Errorf("%s: %v, want %v", check.what, check.got, check.want)
+		}
+	}
+	return nil
+}
+
+// SimulatedThrottledClient has a client flood a rate limited server with calls it retransmits early, over a lossy
+// network, while another client makes a few calls. The flooding client must back off as long as the server asks
+// rather than as its retry policy says, and the other client, which has a bucket of its own, must not wait for it.
+func SimulatedThrottledClient() error {
+	defer withoutPackageLoss()()
+	network := newSimNet(20, rpc.LinkConfig{Loss: 0.2, Duplicate: 0.1, Reorder: 0.1, Delay: time.Millisecond, Jitter: time.Millisecond})
+	defer network.Close()
+	counter := &Counter{}
+	server, err := startServer("sim://limited", nil, counter)
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown()
+	limit := rpc.RateLimit{Rate: 10, Burst: 2}
+	server.SetClientRateLimit(limit)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	transport, remote, err := rpc.DialTransport("sim://limited", nil)
+	if err != nil {
+		return err
+	}
+	flood := &sendRecorder{Transport: transport}
+	flooder := rpc.NewClient(flood, remote, logger.NewLogger("./client1.log"))
+	defer flooder.Close()
+	flooder.SetRetryPolicy(rpc.RetryPolicy{MaxAttempts: math.MaxUint64, InitialBackoff: 5 * time.Millisecond, MaxBackoff: 5 * time.Millisecond, Multiplier: 1})
+	polite, err := rpc.Dial("sim://limited", logger.NewLogger("./client2.log"))
+	if err != nil {
+		return err
+	}
+	defer polite.Close()
+
+	const calls, politeCalls = 10, 2
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := flooder.CallContext(ctx, "Counter.Add", &AddRequest{N: 1}, &AddResponse{}); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond) // the flood is throttled by now
+	politeStart := time.Now()
+	for i := 0; i < politeCalls; i++ {
+		if err := polite.CallContext(ctx, "Counter.Add", &AddRequest{N: 1}, &AddResponse{}); err != nil {
+			return err
+		}
+	}
+	politeTook := time.Since(politeStart)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+	took := time.Since(start)
+	sent := len(flood.times("Counter.Add"))
+	fmt.Printf("%d flooding calls sent %d times in %v, %d other calls took %v\n", calls, sent, took.Round(time.Millisecond), politeCalls, politeTook.Round(time.Millisecond))
+
+	counter.mu.Lock()
+	total := counter.total
+	counter.mu.Unlock()
+	if total != calls+politeCalls {
+		return fmt.Errorf("counted %d, want %d", total, calls+politeCalls)
+	}
+	least := time.Duration(float64(calls-limit.Burst) / limit.Rate * float64(time.Second))
+	if took < least {
+		return fmt.Errorf("%d calls served in %v, the rate limit allows no less than %v", calls, took, least)
+	}
+	// every waiting call is sent about once per token the server hands out, rather than every 5ms
+	if sent > 2*calls*calls {
+		return fmt.Errorf("%d throttled calls sent %d times, they do not back off as the server asks", calls, sent)
+	}
+	if politeTook > least/2 {
+		return fmt.Errorf("%d calls of another client took %v, they wait for the flooding client", politeCalls, politeTook)
+	}
+	return nil
+}
+
+// readSpans reads the spans exported to the files at paths, by span id
+func readSpans(paths ...string) (map[string]trace.Record, error) {
+	spans := make(map[string]trace.Record)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			var r trace.Record
+			if err := json.Unmarshal(line, &r); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			spans[r.SpanId] = r
+		}
+	}
+	return spans, nil
+}
+
+// SimulatedTraceAcrossCallbacks has a client write a file that another client has cached, over a lossy network,
+// with the server and both clients exporting their spans to files of their own. The callback the second client
+// serves must belong to the trace of the close that sent the write, through the spans of the server.
+func SimulatedTraceAcrossCallbacks() error {
+	if err := exportFiles(map[string][]byte{"etc/exports/mockdir1/testfile2.txt": []byte("content of testfile2\n")}); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "dfs-test-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	network := newSimNet(21, rpc.LinkConfig{Loss: 0.2, Duplicate: 0.1, Reorder: 0.1, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	defer network.Close()
+	simServerAddr := "sim://server"
+	server := service.NewFileServer(simServerAddr)
+	paths := []string{filepath.Join(dir, "server.jsonl"), filepath.Join(dir, "client1.jsonl"), filepath.Join(dir, "client2.jsonl")}
+	if err := server.ExportSpans(paths[0]); err != nil {
+		return err
+	}
+	go server.Run()
+	time.Sleep(100 * time.Millisecond) // to make sure server is up
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var fds []*service.FileDescriptor
+	for i := 1; i <= 2; i++ {
+		id := strconv.Itoa(i)
+		c := service.NewFileClient(id, "", simServerAddr)
+		defer c.Shutdown()
+		if err := c.ExportSpans(paths[i]); err != nil {
+			return err
+		}
+		if err := c.Mount(ctx, "etc/exports/mockdir1", id, service.AndrewFileSystemType); err != nil {
+			return err
+		}
+		fd, err := c.Open(ctx, id+"/testfile2.txt")
+		if err != nil {
+			return err
+		}
+		fds = append(fds, fd)
+		if i == 2 {
+			if _, err := c.Write(ctx, fd, 0, []byte("written by client 2\n")); err != nil {
+				return err
+			}
+			c.Close(ctx, fd) // sends the write to the server, which calls client 1 back
+		}
+	}
+	if !eventually(5*time.Second, fds[0].CallbackPromise.IsCanceled) {
+		return fmt.Errorf("[file client 1] callback promise still valid after client 2 wrote the file")
+	}
+
+	// the callback is served, its span is exported once the response is sent
+	var callback trace.Record
+	var spans map[string]trace.Record
+	if !eventually(time.Second, func() bool {
+		spans, err = readSpans(paths...)
+		for _, r := range spans {
+			if r.Process == "file client 1" && r.Name == "FileClient.UpdateCallbackPromise" && r.Kind == trace.KindServer {
+				callback = r
+				return true
+			}
+		}
+		return false
+	}) {
+		return fmt.Errorf("no span of the callback served by file client 1: %v", err)
+	}
+	var chain []string
+	for r, ok := callback, true; ok; r, ok = spans[r.ParentId] {
+		chain = append(chain, fmt.Sprintf("%s %s (%s)", r.Process, r.Name, r.Kind))
+		if r.TraceId != callback.TraceId {
+			return fmt.Errorf("span %s of %s is in trace %s, its child %s in trace %s", r.SpanId, r.Name, r.TraceId, callback.SpanId, callback.TraceId)
+		}
+		if r.ParentId == "" {
+			fmt.Printf("trace %s:\n  %s\n", r.TraceId, strings.Join(chain, "\n  "))
+			if r.Process != "file client 2" || r.Name != "FileClient.Close" {
+				return fmt.Errorf("the trace of the callback starts with %s %s, want the close of file client 2", r.Process, r.Name)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("the trace of the callback breaks after %s", strings.Join(chain, " <- "))
+}
+
+// FileClient stands in for the callback endpoint of a file client, as the subscriptions of a file server call it.
+// It counts the callbacks it is sent.
+type FileClient struct {
+	updates atomic.Int64
+}
+
+func (fc *FileClient) UpdateCallbackPromise(req service.UpdateCallbackPromiseRequest, resp *service.UpdateCallbackPromiseResponse) error {
+	fc.updates.Add(1)
+	resp.IsSuccess = true
+	return nil
+}
+
+// SimulatedCallbackPool broadcasts changes to the subscribers of a file through a pool of callback clients over
+// a lossy network, one of the subscribers being unreachable. Every broadcast must reach the other subscribers over
+// the clients dialed for the first one, the clients left idle must be closed and dialed again when needed,
+// and no callback must be sent once the pool is closed.
+func SimulatedCallbackPool() error {
+	idleTimeout, cleanUpInterval := service.CallbackIdleTimeout, service.CallbackCleanUpInterval
+	service.CallbackIdleTimeout, service.CallbackCleanUpInterval = 300*time.Millisecond, 50*time.Millisecond
+	defer func() { service.CallbackIdleTimeout, service.CallbackCleanUpInterval = idleTimeout, cleanUpInterval }()
+	network := newSimNet(25, rpc.LinkConfig{Loss: 0.2, Duplicate: 0.1, Reorder: 0.1, Delay: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	defer network.Close()
+	endpoints := []*FileClient{{}, {}}
+	for i, endpoint := range endpoints {
+		server, err := startServer(fmt.Sprintf("sim://subscriber%d", i+1), nil, endpoint)
+		if err != nil {
+			return err
+		}
+		defer server.Shutdown()
+	}
+
+	logger := logger.NewLogger("./server.log")
+	var dials atomic.Int64
+	pool := service.NewCallbackPool(func(member *service.Subscriber) (*rpc.Client, error) {
+		dials.Add(1)
+		if member.Addr == "sim://unreachable" {
+			return nil, fmt.Errorf("dial %s: no route to host", member.Addr)
+		}
+		return rpc.Dial(member.Addr, logger)
+	}, logger)
+	defer pool.Close()
+	sub := service.NewSubscription(pool.Get, logger)
+	sub.Subscribe("1", "sim://subscriber1", nil)
+	sub.Subscribe("unreachable", "sim://unreachable", nil)
+	sub.Subscribe("2", "sim://subscriber2", nil)
+	sub.Subscribe("writer", "sim://writer", nil) // sends the changes, so it is not called back
+	broadcast := func() (sent, failed int) {
+		done := make(chan [2]int, 1)
+		sub.Broadcast(ctx, "writer", &service.UpdateCallbackPromiseRequest{FilePath: "testfile2.txt"}, func(sent, failed int) {
+			done <- [2]int{sent, failed}
+		})
+		outcome := <-done
+		return outcome[0], outcome[1]
+	}
+
+	const broadcasts = 10
+	for i := 0; i < broadcasts; i++ {
+		if sent, failed := broadcast(); sent != len(endpoints) || failed != 1 {
+			return fmt.Errorf("broadcast %d sent %d callbacks and failed %d, want %d sent and 1 failed", i+1, sent, failed, len(endpoints))
+		}
+	}
+	// the callbacks are not acknowledged, each one is sent several times to make up for losses
+	if !eventually(time.Second, func() bool {
+		return endpoints[0].updates.Load() >= broadcasts-1 && endpoints[1].updates.Load() >= broadcasts-1
+	}) {
+		return fmt.Errorf("subscribers got %d and %d of %d callbacks", endpoints[0].updates.Load(), endpoints[1].updates.Load(), broadcasts)
+	}
+	// the subscribers that can be reached are dialed once, the other one every time
+	if n := dials.Load(); n != int64(len(endpoints)+broadcasts) {
+		return fmt.Errorf("%d dials for %d broadcasts, want %d", n, broadcasts, len(endpoints)+broadcasts)
+	}
+	if n := pool.Len(); n != len(endpoints) {
+		return fmt.Errorf("%d clients in the pool, want %d", n, len(endpoints))
+	}
+
+	if !eventually(2*time.Second, func() bool { return pool.Len() == 0 }) {
+		return fmt.Errorf("%d idle clients still in the pool after %v", pool.Len(), service.CallbackIdleTimeout)
+	}
+	if sent, _ := broadcast(); sent != len(endpoints) {
+		return fmt.Errorf("broadcast after the idle clients are closed sent %d callbacks, want %d", sent, len(endpoints))
+	}
+	if n := dials.Load(); n != int64(2*len(endpoints)+broadcasts+1) {
+		return fmt.Errorf("%d dials after the idle clients are closed, want %d", n, 2*len(endpoints)+broadcasts+1)
+	}
+
+	if err := pool.Close(); err != nil {
+		return err
+	}
+	if n := pool.Len(); n != 0 {
+		return fmt.Errorf("%d clients in the pool once it is closed", n)
+	}
+	if sent, failed := broadcast(); sent != 0 || failed != len(endpoints)+1 {
+		return fmt.Errorf("broadcast over a closed pool sent %d callbacks and failed %d", sent, failed)
+	}
+	return nil
+}
+
 func main() {
-	SimpleTest()
+	run := flag.String("run", "^Simulated", "run only the scenarios whose name matches the regular expression")
+	oldSchemaClient := flag.String("old-schema-client", "", "act as a client of an older build calling the server at this address, see SimulatedSchemaEvolution")
+	flag.Parse()
+	if *oldSchemaClient != "" {
+		if err := runOldSchemaClient(*oldSchemaClient); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	re, err := regexp.Compile(*run)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -run: %v\n", err)
+		os.Exit(2)
+	}
+	failed := false
+	for _, s := range scenarios {
+		if !re.MatchString(s.name) {
+			continue
+		}
+		fmt.Printf("=== RUN   %s\n", s.name)
+		start := time.Now()
+		if err := s.run(); err != nil {
+			failed = true
+			fmt.Printf("--- FAIL: %s (%v)\n    %v\n", s.name, time.Since(start).Round(time.Millisecond), err)
+			continue
+		}
+		fmt.Printf("--- PASS: %s (%v)\n", s.name, time.Since(start).Round(time.Millisecond))
+	}
+	if failed {
+		os.Exit(1)
+	}
 }